@@ -0,0 +1,156 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// scrapeGroup lets concurrent scrapes of the same collectors share a single
+// collection. The result of a finished collection is reused by further scrapes
+// within window. Create instances with newScrapeGroup.
+type scrapeGroup struct {
+	window time.Duration
+	shared prometheus.Counter
+
+	mtx   sync.Mutex
+	calls map[scrapeCallKey]*scrapeCall
+}
+
+// scrapeCallKey tells collections apart by the generation of the collector
+// set they run on and their filters, so that scrapes of a replaced set never
+// share a collection with scrapes of the current one.
+type scrapeCallKey struct {
+	generation uint64
+	filters    string
+}
+
+// scrapeCall is a collection which is in flight until done is closed.
+type scrapeCall struct {
+	done     chan struct{}
+	mfs      []*dto.MetricFamily
+	err      error
+	finished time.Time
+}
+
+// newScrapeGroup creates a scrapeGroup and registers its metrics with r.
+func newScrapeGroup(window time.Duration, r prometheus.Registerer) (*scrapeGroup, error) {
+	g := &scrapeGroup{
+		window: window,
+		shared: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "node_exporter",
+			Name:      "scrapes_shared_total",
+			Help:      "Number of scrapes served from a collection shared with a concurrent or recent scrape.",
+		}),
+		calls: map[scrapeCallKey]*scrapeCall{},
+	}
+	if err := r.Register(g.shared); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// gatherer returns a prometheus.Gatherer which shares the collections of g
+// among all gatherers for the same generation of collectors and filters.
+func (g *scrapeGroup) gatherer(inner prometheus.Gatherer, generation uint64, filters []string) prometheus.Gatherer {
+	return &sharedGatherer{group: g, key: scrapeCallKey{generation: generation, filters: scrapeKey(filters)}, inner: inner}
+}
+
+// gather returns the result of the collection for key which is in flight or
+// finished within the window, or runs a new one with inner.
+func (g *scrapeGroup) gather(key scrapeCallKey, inner prometheus.Gatherer) ([]*dto.MetricFamily, error) {
+	g.mtx.Lock()
+	if c, ok := g.calls[key]; ok {
+		select {
+		case <-c.done:
+			if time.Since(c.finished) <= g.window {
+				g.mtx.Unlock()
+				g.shared.Inc()
+				return c.mfs, c.err
+			}
+		default:
+			g.mtx.Unlock()
+			g.shared.Inc()
+			<-c.done
+			return c.mfs, c.err
+		}
+	}
+	c := &scrapeCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mtx.Unlock()
+
+	c.mfs, c.err = inner.Gather()
+	c.finished = time.Now()
+	close(c.done)
+	g.release(key, c)
+	return c.mfs, c.err
+}
+
+// release drops the finished collection c once it can't be reused anymore,
+// right away without a window. Its waiters already got the result.
+func (g *scrapeGroup) release(key scrapeCallKey, c *scrapeCall) {
+	drop := func() {
+		g.mtx.Lock()
+		defer g.mtx.Unlock()
+		// The entry may have been dropped by reset and taken by a new
+		// collection meanwhile.
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+	}
+	if g.window <= 0 {
+		drop()
+		return
+	}
+	time.AfterFunc(g.window, drop)
+}
+
+// reset drops all collections, e.g. after the collectors were replaced.
+// Scrapes waiting for a collection in flight still get its result.
+func (g *scrapeGroup) reset() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.calls = map[scrapeCallKey]*scrapeCall{}
+}
+
+// scrapeKey returns the same key for all orders and repetitions of filters.
+func scrapeKey(filters []string) string {
+	set := map[string]bool{}
+	for _, f := range filters {
+		set[f] = true
+	}
+	keys := make([]string, 0, len(set))
+	for f := range set {
+		keys = append(keys, f)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+type sharedGatherer struct {
+	group *scrapeGroup
+	key   scrapeCallKey
+	inner prometheus.Gatherer
+}
+
+// Gather implements prometheus.Gatherer.
+func (s *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return s.group.gather(s.key, s.inner)
+}
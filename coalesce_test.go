@@ -0,0 +1,171 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// countingGatherer counts its collections, which take delay each.
+type countingGatherer struct {
+	delay time.Duration
+	mtx   sync.Mutex
+	calls int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mtx.Lock()
+	g.calls++
+	g.mtx.Unlock()
+	time.Sleep(g.delay)
+	return nil, nil
+}
+
+func (g *countingGatherer) count() int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.calls
+}
+
+func TestScrapeGroupConcurrent(t *testing.T) {
+	g, err := newScrapeGroup(0, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &countingGatherer{delay: 100 * time.Millisecond}
+	other := &countingGatherer{delay: 100 * time.Millisecond}
+
+	var wg sync.WaitGroup
+	for _, gatherer := range []prometheus.Gatherer{
+		g.gatherer(inner, 1, []string{"cpu", "meminfo"}),
+		g.gatherer(inner, 1, []string{"meminfo", "cpu", "cpu"}),
+		g.gatherer(inner, 1, []string{"cpu", "meminfo"}),
+		g.gatherer(other, 1, []string{"cpu"}),
+	} {
+		wg.Add(1)
+		go func(gatherer prometheus.Gatherer) {
+			defer wg.Done()
+			gatherer.Gather()
+		}(gatherer)
+		// Make sure the first collection is in flight.
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if inner.count() != 1 || other.count() != 1 {
+		t.Errorf("want one collection per filter set, got %d and %d", inner.count(), other.count())
+	}
+	if got := counterValue(t, g.shared); got != 2 {
+		t.Errorf("want 2 shared scrapes, got %v", got)
+	}
+
+	// Without a window, finished collections aren't reused.
+	g.gatherer(inner, 1, []string{"cpu", "meminfo"}).Gather()
+	if inner.count() != 2 {
+		t.Errorf("want 2 collections, got %d", inner.count())
+	}
+}
+
+func TestScrapeGroupWindow(t *testing.T) {
+	g, err := newScrapeGroup(time.Hour, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &countingGatherer{}
+	gatherer := g.gatherer(inner, 1, nil)
+
+	gatherer.Gather()
+	gatherer.Gather()
+	if inner.count() != 1 {
+		t.Errorf("want the collection to be reused, got %d collections", inner.count())
+	}
+
+	g.reset()
+	gatherer.Gather()
+	if inner.count() != 2 {
+		t.Errorf("want a new collection after reset, got %d collections", inner.count())
+	}
+}
+
+func TestScrapeGroupRelease(t *testing.T) {
+	g, err := newScrapeGroup(0, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filters := range [][]string{{"cpu"}, {"meminfo"}, nil} {
+		g.gatherer(&countingGatherer{}, 1, filters).Gather()
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("want finished collections to be dropped, got %d", len(g.calls))
+	}
+
+	g.window = 50 * time.Millisecond
+	g.gatherer(&countingGatherer{}, 1, nil).Gather()
+	g.mtx.Lock()
+	n := len(g.calls)
+	g.mtx.Unlock()
+	if n != 1 {
+		t.Errorf("want the collection to be kept within the window, got %d", n)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		g.mtx.Lock()
+		n := len(g.calls)
+		g.mtx.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want the collection to be dropped after the window")
+		}
+	}
+}
+
+func TestScrapeGroupGenerations(t *testing.T) {
+	g, err := newScrapeGroup(time.Hour, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &countingGatherer{delay: 100 * time.Millisecond}
+	current := &countingGatherer{}
+
+	// A scrape of the replaced collectors which is still running stores its
+	// result after reset.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.gatherer(old, 1, nil).Gather()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	g.reset()
+	g.gatherer(old, 1, nil).Gather()
+	<-done
+
+	g.gatherer(current, 2, nil).Gather()
+	if old.count() != 2 || current.count() != 1 {
+		t.Errorf("want no collection shared across generations, got %d and %d", old.count(), current.count())
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cachedCollector runs a collector in the background at a fixed interval and
+// serves the metrics of its last run on scrapes, so that slow collectors don't
+// delay the scrape. Create instances with newCachedCollector and release them
+// with Close.
+type cachedCollector struct {
+	name      string
+	collector Collector
+	interval  time.Duration
+
+	// ready is closed once the first run finished.
+	ready chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+
+	mtx     sync.RWMutex
+	metrics []prometheus.Metric
+	last    collectorRun
+	updated time.Time
+}
+
+// newCachedCollector starts running c every interval.
+func newCachedCollector(name string, c Collector, interval time.Duration) *cachedCollector {
+	cc := &cachedCollector{
+		name:      name,
+		collector: c,
+		interval:  interval,
+		ready:     make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go cc.loop()
+	return cc
+}
+
+// Update implements Collector. It sends the metrics of the last run and returns
+// its error.
+func (c *cachedCollector) Update(ch chan<- prometheus.Metric) error {
+	select {
+	case <-c.ready:
+	case <-c.stop:
+		return nil
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, m := range c.metrics {
+		ch <- m
+	}
+	return c.last.err
+}
+
+// collect sends the metrics of the last run along with its scrape metrics and
+// age. Before the first run finished, it waits for it.
+func (c *cachedCollector) collect(ch chan<- prometheus.Metric) {
+	select {
+	case <-c.ready:
+	case <-c.stop:
+		return
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, m := range c.metrics {
+		ch <- m
+	}
+	c.last.send(c.name, ch)
+	ch <- prometheus.MustNewConstMetric(scrapeAgeDesc, prometheus.GaugeValue, time.Since(c.updated).Seconds(), c.name)
+}
+
+func (c *cachedCollector) loop() {
+	defer close(c.done)
+	c.refresh()
+	close(c.ready)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// refresh runs the collector once and replaces the cached metrics.
+func (c *cachedCollector) refresh() {
+	var (
+		metrics []prometheus.Metric
+		ch      = make(chan prometheus.Metric)
+		drained = make(chan struct{})
+	)
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(drained)
+	}()
+	r := run(c.name, c.collector, ch, collectorTimeout(c.name))
+	close(ch)
+	<-drained
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.metrics = metrics
+	c.last = r
+	c.updated = time.Now()
+}
+
+// Close stops the background runs and closes the wrapped collector.
+func (c *cachedCollector) Close() error {
+	close(c.stop)
+	<-c.done
+	if cl, ok := c.collector.(closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
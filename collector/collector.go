@@ -16,6 +16,7 @@ package collector
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -40,6 +41,18 @@ var (
 		[]string{"collector"},
 		nil,
 	)
+	scrapeTimeoutDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_timeout"),
+		"node_exporter: Whether a collector ran into its scrape timeout.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapeAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_age_seconds"),
+		"node_exporter: Seconds since the last background run of a collector with an interval.",
+		[]string{"collector"},
+		nil,
+	)
 )
 
 const (
@@ -48,8 +61,28 @@ const (
 )
 
 var (
-	factories      = make(map[string]func() (Collector, error))
-	collectorState = make(map[string]*bool)
+	factories          = make(map[string]func() (Collector, error))
+	collectorState     = make(map[string]*bool)
+	collectorTimeouts  = make(map[string]*time.Duration)
+	collectorIntervals = make(map[string]*time.Duration)
+
+	// inFlight are the collectors with a timed out run which is still going.
+	// They are skipped until it finished, so that a hanging collector doesn't
+	// pile up goroutines. It's keyed by instance, so that a hanging collector
+	// replaced by a reload doesn't block its successor.
+	inFlight    = make(map[Collector]bool)
+	inFlightMtx sync.Mutex
+
+	// flagsMtx guards the flags which are read while collecting, like the
+	// timeouts and the path.* flags, against them being changed by a reload.
+	// The flags which collectors only read when they're created don't need
+	// it, as a changed flag makes them be recreated.
+	flagsMtx sync.RWMutex
+
+	scrapeTimeout = kingpin.Flag(
+		"collector.timeout",
+		"Maximum duration of a scrape for all collectors. Collectors still running when it expires are reported as failed. Use 0 to disable.",
+	).Default("0s").Duration()
 )
 
 func registerCollector(collector string, isDefaultEnabled bool, factory func() (Collector, error)) {
@@ -67,16 +100,73 @@ func registerCollector(collector string, isDefaultEnabled bool, factory func() (
 	flag := kingpin.Flag(flagName, flagHelp).Default(defaultValue).Bool()
 	collectorState[collector] = flag
 
+	timeoutFlagName := fmt.Sprintf("collector.%s.timeout", collector)
+	timeoutFlagHelp := fmt.Sprintf("Maximum duration of the %s collector, overriding --collector.timeout if lower. Use 0 to disable.", collector)
+	collectorTimeouts[collector] = kingpin.Flag(timeoutFlagName, timeoutFlagHelp).Default("0s").Duration()
+
+	intervalFlagName := fmt.Sprintf("collector.%s.interval", collector)
+	intervalFlagHelp := fmt.Sprintf("Run the %s collector in the background at this interval and serve its last result on scrapes. Use 0 to run it on every scrape.", collector)
+	collectorIntervals[collector] = kingpin.Flag(intervalFlagName, intervalFlagHelp).Default("0s").Duration()
+
 	factories[collector] = factory
 }
 
+// UpdateFlags calls update, which changes the values of flags, while no
+// collector reads them.
+func UpdateFlags(update func()) {
+	flagsMtx.Lock()
+	defer flagsMtx.Unlock()
+	update()
+}
+
 // NodeCollector implements the prometheus.Collector interface.
 type NodeCollector struct {
 	Collectors map[string]Collector
 }
 
-// NewNodeCollector creates a new NodeCollector.
+// NewNodeCollector creates a new NodeCollector. Only the collectors named in
+// filters are instantiated, or all enabled ones if no filter is given.
 func NewNodeCollector(filters ...string) (*NodeCollector, error) {
+	f, err := checkFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	collectors := make(map[string]Collector)
+	for key, enabled := range collectorState {
+		if !*enabled || (len(f) > 0 && !f[key]) {
+			continue
+		}
+		collector, err := newCollector(key)
+		if err != nil {
+			return nil, err
+		}
+		collectors[key] = collector
+	}
+	return &NodeCollector{Collectors: collectors}, nil
+}
+
+// Filter returns a NodeCollector which shares the already instantiated
+// collectors named in filters with n, so that a filtered scrape doesn't create
+// any new collectors.
+func (n *NodeCollector) Filter(filters ...string) (*NodeCollector, error) {
+	f, err := checkFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	collectors := make(map[string]Collector)
+	for key, collector := range n.Collectors {
+		if len(f) == 0 || f[key] {
+			collectors[key] = collector
+		}
+	}
+	return &NodeCollector{Collectors: collectors}, nil
+}
+
+// checkFilters verifies that all filters name enabled collectors and returns
+// them as a set.
+func checkFilters(filters []string) (map[string]bool, error) {
+	flagsMtx.RLock()
+	defer flagsMtx.RUnlock()
 	f := make(map[string]bool)
 	for _, filter := range filters {
 		enabled, exist := collectorState[filter]
@@ -88,25 +178,87 @@ func NewNodeCollector(filters ...string) (*NodeCollector, error) {
 		}
 		f[filter] = true
 	}
+	return f, nil
+}
+
+// newCollector creates the named collector. Collectors with an interval are
+// wrapped to run in the background.
+func newCollector(name string) (Collector, error) {
+	c, err := factories[name]()
+	if err != nil {
+		return nil, err
+	}
+	if interval, ok := collectorIntervals[name]; ok && *interval > 0 {
+		return newCachedCollector(name, c, *interval), nil
+	}
+	return c, nil
+}
+
+// ReloadNodeCollector creates a NodeCollector for the currently enabled
+// collectors after the flags have been changed, e.g. by reloading the
+// configuration file. Collectors of old which are still enabled are reused,
+// unless one of the flags in changedFlags affects them. The collectors of old
+// which aren't reused have to be closed with CloseExcept once old is no longer
+// in use.
+func ReloadNodeCollector(old *NodeCollector, changedFlags map[string]bool) (*NodeCollector, error) {
 	collectors := make(map[string]Collector)
 	for key, enabled := range collectorState {
-		if *enabled {
-			collector, err := factories[key]()
-			if err != nil {
-				return nil, err
-			}
-			if len(f) == 0 || f[key] {
-				collectors[key] = collector
-			}
+		if !*enabled {
+			continue
 		}
+		if c, ok := old.Collectors[key]; ok && !affectedBy(key, changedFlags) {
+			collectors[key] = c
+			continue
+		}
+		c, err := newCollector(key)
+		if err != nil {
+			// Release the collectors created so far.
+			(&NodeCollector{Collectors: collectors}).CloseExcept(old)
+			return nil, fmt.Errorf("couldn't create %s collector: %s", key, err)
+		}
+		collectors[key] = c
 	}
 	return &NodeCollector{Collectors: collectors}, nil
 }
 
+// affectedBy returns whether a collector has to be recreated because of the
+// changed flags. These are its own flags, collector.<name>.*, apart from the
+// timeout, which is applied on every scrape, and the path.* flags.
+func affectedBy(collector string, changedFlags map[string]bool) bool {
+	prefix := fmt.Sprintf("collector.%s.", collector)
+	for flag := range changedFlags {
+		if strings.HasPrefix(flag, "path.") {
+			return true
+		}
+		if strings.HasPrefix(flag, prefix) && flag != prefix+"timeout" {
+			return true
+		}
+	}
+	return false
+}
+
+// CloseExcept closes all collectors of n which are not part of keep.
+func (n *NodeCollector) CloseExcept(keep *NodeCollector) {
+	for name, c := range n.Collectors {
+		if keep != nil && keep.Collectors[name] == c {
+			continue
+		}
+		cl, ok := c.(closer)
+		if !ok {
+			continue
+		}
+		if err := cl.Close(); err != nil {
+			log.Errorf("Error closing %s collector: %s", name, err)
+		}
+	}
+}
+
 // Describe implements the prometheus.Collector interface.
 func (n NodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- scrapeDurationDesc
 	ch <- scrapeSuccessDesc
+	ch <- scrapeTimeoutDesc
+	ch <- scrapeAgeDesc
 }
 
 // Collect implements the prometheus.Collector interface.
@@ -115,28 +267,131 @@ func (n NodeCollector) Collect(ch chan<- prometheus.Metric) {
 	wg.Add(len(n.Collectors))
 	for name, c := range n.Collectors {
 		go func(name string, c Collector) {
-			execute(name, c, ch)
+			execute(name, c, ch, collectorTimeout(name))
 			wg.Done()
 		}(name, c)
 	}
 	wg.Wait()
 }
 
-func execute(name string, c Collector, ch chan<- prometheus.Metric) {
+// collectorTimeout returns the effective timeout of the named collector, which
+// is the lower one of the global and the per-collector timeout. Zero means
+// no timeout.
+func collectorTimeout(name string) time.Duration {
+	flagsMtx.RLock()
+	defer flagsMtx.RUnlock()
+	timeout := *scrapeTimeout
+	if t, ok := collectorTimeouts[name]; ok && *t > 0 && (timeout <= 0 || *t < timeout) {
+		timeout = *t
+	}
+	return timeout
+}
+
+func execute(name string, c Collector, ch chan<- prometheus.Metric, timeout time.Duration) {
+	if cc, ok := c.(*cachedCollector); ok {
+		cc.collect(ch)
+		return
+	}
+	run(name, c, ch, timeout).send(name, ch)
+}
+
+// collectorRun is the outcome of a single run of a collector.
+type collectorRun struct {
+	duration time.Duration
+	timedOut bool
+	err      error
+}
+
+// run runs a collector once and logs the outcome. If a timed out run of the
+// collector is still going, it's reported as timed out again without running
+// it.
+func run(name string, c Collector, ch chan<- prometheus.Metric, timeout time.Duration) collectorRun {
+	inFlightMtx.Lock()
+	running := inFlight[c]
+	inFlightMtx.Unlock()
+	if running {
+		log.Errorf("%s collector is still running after timing out, skipping it", name)
+		return collectorRun{timedOut: true}
+	}
+
 	begin := time.Now()
-	err := c.Update(ch)
-	duration := time.Since(begin)
-	var success float64
+	timedOut, err := update(c, ch, timeout)
+	r := collectorRun{duration: time.Since(begin), timedOut: timedOut, err: err}
 
-	if err != nil {
-		log.Errorf("ERROR: %s collector failed after %fs: %s", name, duration.Seconds(), err)
-		success = 0
+	if timedOut {
+		log.Errorf("%s collector timed out after %fs", name, r.duration.Seconds())
+	} else if err != nil {
+		log.Errorf("%s collector failed after %fs: %s", name, r.duration.Seconds(), err)
 	} else {
-		log.Debugf("OK: %s collector succeeded after %fs.", name, duration.Seconds())
+		log.Debugf("OK: %s collector succeeded after %fs.", name, r.duration.Seconds())
+	}
+	return r
+}
+
+// send sends the scrape metrics of the run.
+func (r collectorRun) send(name string, ch chan<- prometheus.Metric) {
+	var success, timeoutValue float64
+	if r.timedOut {
+		timeoutValue = 1
+	} else if r.err == nil {
 		success = 1
 	}
-	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, r.duration.Seconds(), name)
 	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
+	ch <- prometheus.MustNewConstMetric(scrapeTimeoutDesc, prometheus.GaugeValue, timeoutValue, name)
+}
+
+// update runs c.Update and forwards its metrics to ch until the collector
+// returns or the timeout expires. The metrics are passed through an
+// intermediate channel, so that a collector which is still running after the
+// timeout never writes to ch once the scrape is over. Its remaining metrics are
+// discarded, and the collector is in flight until it returns.
+func update(c Collector, ch chan<- prometheus.Metric, timeout time.Duration) (bool, error) {
+	if timeout <= 0 {
+		return false, c.Update(ch)
+	}
+
+	var (
+		metrics = make(chan prometheus.Metric)
+		done    = make(chan error, 1)
+		// finished and abandoned are protected by inFlightMtx.
+		finished, abandoned bool
+	)
+	go func() {
+		err := c.Update(metrics)
+		close(metrics)
+		inFlightMtx.Lock()
+		finished = true
+		if abandoned {
+			delete(inFlight, c)
+		}
+		inFlightMtx.Unlock()
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case m, ok := <-metrics:
+			if !ok {
+				return false, <-done
+			}
+			ch <- m
+		case <-timer.C:
+			inFlightMtx.Lock()
+			if !finished {
+				inFlight[c] = true
+				abandoned = true
+			}
+			inFlightMtx.Unlock()
+			go func() {
+				for range metrics {
+				}
+			}()
+			return true, nil
+		}
+	}
 }
 
 // Collector is the interface a collector has to implement.
@@ -145,6 +400,12 @@ type Collector interface {
 	Update(ch chan<- prometheus.Metric) error
 }
 
+// closer is implemented by collectors holding resources, like file descriptors
+// or connections, which have to be released once the collector is replaced.
+type closer interface {
+	Close() error
+}
+
 type typedDesc struct {
 	desc      *prometheus.Desc
 	valueType prometheus.ValueType
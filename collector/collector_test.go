@@ -0,0 +1,303 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type testCollector struct {
+	delay time.Duration
+}
+
+func (c testCollector) Update(ch chan<- prometheus.Metric) error {
+	time.Sleep(c.delay)
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("node_test_value", "Test value.", nil, nil),
+		prometheus.GaugeValue, 1,
+	)
+	return nil
+}
+
+// gatherValues scrapes the given NodeCollector and returns the values of all
+// samples keyed by metric name and the value of the collector label.
+func gatherValues(t *testing.T, nc NodeCollector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(nc)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			key := mf.GetName()
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "collector" {
+					key += "/" + l.GetValue()
+				}
+			}
+			values[key] = m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestNodeCollectorTimeout(t *testing.T) {
+	slowTimeout := 50 * time.Millisecond
+	collectorTimeouts["slow"] = &slowTimeout
+	defer delete(collectorTimeouts, "slow")
+
+	nc := NodeCollector{Collectors: map[string]Collector{
+		"slow": testCollector{delay: time.Second},
+		"fast": testCollector{},
+	}}
+
+	begin := time.Now()
+	values := gatherValues(t, nc)
+	if took := time.Since(begin); took >= time.Second {
+		t.Errorf("scrape took %s, expected it to stop after the timeout", took)
+	}
+
+	for key, want := range map[string]float64{
+		"node_scrape_collector_success/slow": 0,
+		"node_scrape_collector_timeout/slow": 1,
+		"node_scrape_collector_success/fast": 1,
+		"node_scrape_collector_timeout/fast": 0,
+		"node_test_value":                    1,
+	} {
+		if got, ok := values[key]; !ok || got != want {
+			t.Errorf("%s: want %v, got %v (present: %v)", key, want, got, ok)
+		}
+	}
+}
+
+// blockingCollector blocks in Update until release is closed.
+type blockingCollector struct {
+	mtx     sync.Mutex
+	updates int
+	release chan struct{}
+}
+
+func (c *blockingCollector) Update(ch chan<- prometheus.Metric) error {
+	c.mtx.Lock()
+	c.updates++
+	c.mtx.Unlock()
+	<-c.release
+	return nil
+}
+
+func (c *blockingCollector) count() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.updates
+}
+
+func TestNodeCollectorInFlight(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	collectorTimeouts["blocking"] = &timeout
+	defer delete(collectorTimeouts, "blocking")
+
+	c := &blockingCollector{release: make(chan struct{})}
+	nc := NodeCollector{Collectors: map[string]Collector{"blocking": c}}
+
+	for i := 0; i < 3; i++ {
+		values := gatherValues(t, nc)
+		if got := values["node_scrape_collector_timeout/blocking"]; got != 1 {
+			t.Errorf("scrape %d: want timeout 1, got %v", i, got)
+		}
+		if got := values["node_scrape_collector_success/blocking"]; got != 0 {
+			t.Errorf("scrape %d: want success 0, got %v", i, got)
+		}
+	}
+	if got := c.count(); got != 1 {
+		t.Errorf("want 1 update while the first one is still running, got %d", got)
+	}
+
+	close(c.release)
+	for deadline := time.Now().Add(time.Second); ; {
+		inFlightMtx.Lock()
+		running := inFlight[c]
+		inFlightMtx.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("collector still in flight after it returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	values := gatherValues(t, nc)
+	if got := values["node_scrape_collector_success/blocking"]; got != 1 {
+		t.Errorf("want success 1 after the collector returned, got %v", got)
+	}
+	if got := c.count(); got != 2 {
+		t.Errorf("want 2 updates, got %d", got)
+	}
+}
+
+func TestNodeCollectorInFlightReplaced(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	collectorTimeouts["blocking"] = &timeout
+	defer delete(collectorTimeouts, "blocking")
+
+	old := &blockingCollector{release: make(chan struct{})}
+	defer close(old.release)
+	values := gatherValues(t, NodeCollector{Collectors: map[string]Collector{"blocking": old}})
+	if got := values["node_scrape_collector_timeout/blocking"]; got != 1 {
+		t.Errorf("want timeout 1, got %v", got)
+	}
+
+	// The collector replacing the hanging one under the same name runs.
+	replaced := &blockingCollector{release: make(chan struct{})}
+	close(replaced.release)
+	values = gatherValues(t, NodeCollector{Collectors: map[string]Collector{"blocking": replaced}})
+	if got := values["node_scrape_collector_success/blocking"]; got != 1 {
+		t.Errorf("want success 1 for the new collector, got %v", got)
+	}
+	if got := replaced.count(); got != 1 {
+		t.Errorf("want 1 update of the new collector, got %d", got)
+	}
+}
+
+func TestNodeCollectorFilter(t *testing.T) {
+	enabled, disabled := true, false
+	collectorState["test_enabled"] = &enabled
+	collectorState["test_disabled"] = &disabled
+	defer delete(collectorState, "test_enabled")
+	defer delete(collectorState, "test_disabled")
+
+	shared := &testCollector{}
+	nc := &NodeCollector{Collectors: map[string]Collector{
+		"test_enabled": shared,
+	}}
+
+	filtered, err := nc.Filter("test_enabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := filtered.Collectors["test_enabled"]; got != shared {
+		t.Errorf("filtered collector is not the shared instance")
+	}
+
+	if _, err := nc.Filter("test_disabled"); err == nil {
+		t.Error("expected an error for a disabled collector")
+	}
+	if _, err := nc.Filter("test_missing"); err == nil {
+		t.Error("expected an error for a missing collector")
+	}
+}
+
+type closingCollector struct {
+	testCollector
+	closed bool
+}
+
+func (c *closingCollector) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReloadNodeCollector(t *testing.T) {
+	enabled := true
+	for _, name := range []string{"test_kept", "test_changed"} {
+		name := name
+		collectorState[name] = &enabled
+		factories[name] = func() (Collector, error) { return &closingCollector{}, nil }
+		defer delete(collectorState, name)
+		defer delete(factories, name)
+	}
+	disabled := false
+	collectorState["test_disabled"] = &disabled
+	defer delete(collectorState, "test_disabled")
+
+	kept, changed, removed := &closingCollector{}, &closingCollector{}, &closingCollector{}
+	old := &NodeCollector{Collectors: map[string]Collector{
+		"test_kept":     kept,
+		"test_changed":  changed,
+		"test_disabled": removed,
+	}}
+
+	nc, err := ReloadNodeCollector(old, map[string]bool{
+		"collector.test_changed.option": true,
+		"collector.test_kept.timeout":   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.CloseExcept(nc)
+
+	if nc.Collectors["test_kept"] != kept {
+		t.Error("unchanged collector was recreated")
+	}
+	if c, ok := nc.Collectors["test_changed"]; !ok || c == changed {
+		t.Error("changed collector was not recreated")
+	}
+	if _, ok := nc.Collectors["test_disabled"]; ok {
+		t.Error("disabled collector is still present")
+	}
+	if kept.closed || !changed.closed || !removed.closed {
+		t.Errorf("unexpected closed state: kept %v, changed %v, removed %v", kept.closed, changed.closed, removed.closed)
+	}
+}
+
+type countingCollector struct {
+	closingCollector
+	mtx     sync.Mutex
+	updates int
+}
+
+func (c *countingCollector) Update(ch chan<- prometheus.Metric) error {
+	c.mtx.Lock()
+	c.updates++
+	c.mtx.Unlock()
+	return c.closingCollector.Update(ch)
+}
+
+func TestCachedCollector(t *testing.T) {
+	inner := &countingCollector{}
+	cc := newCachedCollector("cached", inner, time.Hour)
+	nc := NodeCollector{Collectors: map[string]Collector{"cached": cc}}
+
+	// Scrapes are served from the first run until the interval passed.
+	for i := 0; i < 3; i++ {
+		values := gatherValues(t, nc)
+		for key, want := range map[string]float64{
+			"node_scrape_collector_success/cached": 1,
+			"node_test_value":                      1,
+		} {
+			if got, ok := values[key]; !ok || got != want {
+				t.Errorf("scrape %d: %s: want %v, got %v (present: %v)", i, key, want, got, ok)
+			}
+		}
+		if _, ok := values["node_scrape_collector_age_seconds/cached"]; !ok {
+			t.Errorf("scrape %d: age metric missing", i)
+		}
+	}
+	if inner.updates != 1 {
+		t.Errorf("want 1 update, got %d", inner.updates)
+	}
+
+	if err := cc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !inner.closed {
+		t.Error("wrapped collector was not closed")
+	}
+}
@@ -0,0 +1,563 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var libvirtFixtures = kingpin.Flag("collector.libvirt.fixtures", "test fixtures to use for libvirt collector metrics").Default("").String()
+
+// libvirtDriver connects to libvirt. It's an interface, so that the libvirt
+// library only has to be linked with the libvirt build tag, and to swap it
+// out for tests.
+type libvirtDriver interface {
+	// Connect opens a connection to uri.
+	Connect(uri string) (libvirtConn, error)
+	// SubscribeLifecycle calls handler for every lifecycle event of the
+	// domains at uri, on a connection of its own.
+	SubscribeLifecycle(uri string, handler lifecycleHandler) (libvirtSubscription, error)
+}
+
+// lifecycleHandler is called with the name and UUID of the domain and the
+// name of the event, see lifecycleEventName, or domainEventTunable.
+type lifecycleHandler func(domain, uuid, event string)
+
+// libvirtSubscription is a subscription to lifecycle events.
+type libvirtSubscription interface {
+	// Alive returns whether events are still delivered.
+	Alive() bool
+	Close()
+}
+
+// libvirtConn is a connection to libvirt. Returned domains, storage pools and
+// volumes have to be freed by the caller.
+type libvirtConn interface {
+	Close() error
+	NumOfDomains() (int, error)
+	NumOfDefinedDomains() (int, error)
+	// GetAllDomainStats returns the statistics of all active domains.
+	GetAllDomainStats() ([]libvirtDomainStats, error)
+	ListInactiveDomains() ([]libvirtDomain, error)
+	ListStoragePools() ([]libvirtStoragePool, error)
+	GetNodeInfo() (*libvirtNodeInfo, error)
+	GetNodeCPUStats() (*libvirtNodeCPUStats, error)
+	GetNodeMemoryStats() (*libvirtNodeMemoryStats, error)
+	GetCapabilities() (string, error)
+	// GetCellFreeMemory returns the free memory of a NUMA cell in bytes.
+	GetCellFreeMemory(cell int) (uint64, error)
+	// GetCellFreePages returns the number of free pages of a NUMA cell for
+	// every page size in KiB.
+	GetCellFreePages(pageSizes []uint64, cell int) ([]uint64, error)
+}
+
+type libvirtDomain interface {
+	GetName() (string, error)
+	GetUUIDString() (string, error)
+	GetID() (uint, error)
+	GetXMLDesc() (string, error)
+	GetInfo() (*libvirtDomainInfo, error)
+	GetAutostart() (bool, error)
+	// GetVcpus returns the placement of the online vCPUs.
+	GetVcpus() ([]libvirtVcpuInfo, error)
+	Free() error
+}
+
+type libvirtStoragePool interface {
+	GetName() (string, error)
+	GetXMLDesc() (string, error)
+	GetInfo() (*libvirtStoragePoolInfo, error)
+	ListStorageVolumes() ([]libvirtStorageVolume, error)
+	Free() error
+}
+
+type libvirtStorageVolume interface {
+	GetName() (string, error)
+	GetPath() (string, error)
+	GetInfo() (*libvirtStorageVolumeInfo, error)
+	Free() error
+}
+
+// libvirtErrorCode are the libvirt errors the collector handles.
+type libvirtErrorCode int
+
+const (
+	libvirtErrOther libvirtErrorCode = iota
+	libvirtErrNoDomain
+	libvirtErrNoSupport
+)
+
+// libvirtError is an error returned by a libvirtDriver, which the collector
+// handles by its code.
+type libvirtError struct {
+	code libvirtErrorCode
+	err  error
+}
+
+func (e *libvirtError) Error() string {
+	return e.err.Error()
+}
+
+// libvirtErrorCodeOf returns the code of err, or libvirtErrOther.
+func libvirtErrorCodeOf(err error) libvirtErrorCode {
+	if lerr, ok := err.(*libvirtError); ok {
+		return lerr.code
+	}
+	return libvirtErrOther
+}
+
+// States of vCPUs and storage pools as numbered by libvirt.
+const (
+	libvirtVcpuOffline        = 0
+	libvirtStoragePoolRunning = 2
+)
+
+// libvirtDomainStats are the bulk statistics of a domain. Values not reported
+// by libvirt are nil.
+type libvirtDomainStats struct {
+	Domain  libvirtDomain `json:"-"`
+	State   *int
+	CPU     libvirtCPUStats
+	Balloon libvirtBalloonStats
+	// Vcpus are indexed by vCPU number.
+	Vcpus  []libvirtVcpuStats
+	Nets   []libvirtNetStats
+	Blocks []libvirtBlockStats
+}
+
+// libvirtCPUStats are CPU times in nanoseconds.
+type libvirtCPUStats struct {
+	Time   *uint64
+	User   *uint64
+	System *uint64
+}
+
+// libvirtBalloonStats are memory sizes in KiB.
+type libvirtBalloonStats struct {
+	Current    *uint64
+	Maximum    *uint64
+	Unused     *uint64
+	Available  *uint64
+	Rss        *uint64
+	Usable     *uint64
+	LastUpdate *uint64
+}
+
+// libvirtVcpuStats has the CPU and wait times of a vCPU in nanoseconds, and
+// its placement like libvirtVcpuInfo if the driver reports it.
+type libvirtVcpuStats struct {
+	State  *int
+	Time   *uint64
+	Wait   *uint64
+	Cpu    *int
+	CpuMap []bool
+}
+
+type libvirtNetStats struct {
+	Name    string
+	RxBytes *uint64
+	RxPkts  *uint64
+	RxErrs  *uint64
+	RxDrop  *uint64
+	TxBytes *uint64
+	TxPkts  *uint64
+	TxErrs  *uint64
+	TxDrop  *uint64
+}
+
+// libvirtBlockStats has sizes in bytes and times in nanoseconds.
+type libvirtBlockStats struct {
+	Name       string
+	Path       string
+	Capacity   *uint64
+	Allocation *uint64
+	Physical   *uint64
+	RdBytes    *uint64
+	RdReqs     *uint64
+	RdTimes    *uint64
+	WrBytes    *uint64
+	WrReqs     *uint64
+	WrTimes    *uint64
+	FlReqs     *uint64
+	FlTimes    *uint64
+}
+
+// libvirtDomainInfo has memory sizes in KiB.
+type libvirtDomainInfo struct {
+	State     int
+	MaxMem    uint64
+	NrVirtCpu uint
+}
+
+// libvirtVcpuInfo has the host CPU a vCPU runs on, or -1, and the host CPUs it
+// may run on.
+type libvirtVcpuInfo struct {
+	Number uint32
+	Cpu    int32
+	CpuMap []bool
+}
+
+type libvirtNodeInfo struct {
+	Model string
+	Cpus  uint
+	MHz   uint
+}
+
+// libvirtNodeCPUStats are the CPU times of all host CPUs in nanoseconds.
+type libvirtNodeCPUStats struct {
+	User   *uint64
+	Kernel *uint64
+	Idle   *uint64
+	Iowait *uint64
+	Intr   *uint64
+}
+
+// libvirtNodeMemoryStats are the memory sizes of the host in KiB.
+type libvirtNodeMemoryStats struct {
+	Total   *uint64
+	Free    *uint64
+	Buffers *uint64
+	Cached  *uint64
+}
+
+// libvirtStoragePoolInfo has sizes in bytes.
+type libvirtStoragePoolInfo struct {
+	State      int
+	Capacity   uint64
+	Allocation uint64
+	Available  uint64
+}
+
+// libvirtStorageVolumeInfo has sizes in bytes.
+type libvirtStorageVolumeInfo struct {
+	Capacity   uint64
+	Allocation uint64
+}
+
+// newLibvirtDriver determines if mocked test fixtures from files should be
+// used for collecting libvirt metrics, or the libvirt library.
+func newLibvirtDriver(fixtures string) (libvirtDriver, error) {
+	if fixtures != "" {
+		return &mockLibvirtDriver{fixtures: fixtures}, nil
+	}
+	return newNativeLibvirtDriver()
+}
+
+// All code below this point is used to assist with end-to-end tests for the
+// libvirt collector, since libvirt is not available in CI. The fixtures are
+// used for all URIs.
+
+var _ libvirtDriver = &mockLibvirtDriver{}
+
+type mockLibvirtDriver struct {
+	fixtures string
+}
+
+func (d *mockLibvirtDriver) Connect(uri string) (libvirtConn, error) {
+	return &mockLibvirtConn{fixtures: d.fixtures}, nil
+}
+
+// mockLifecycleEvent is an event of events.json with the type and detail as
+// numbered by libvirt.
+type mockLifecycleEvent struct {
+	Domain string
+	UUID   string
+	Event  int
+	Detail int
+}
+
+// SubscribeLifecycle delivers all events of events.json at once.
+func (d *mockLibvirtDriver) SubscribeLifecycle(uri string, handler lifecycleHandler) (libvirtSubscription, error) {
+	var events []mockLifecycleEvent
+	if err := unmarshalLibvirtFixture(d.fixtures, "events.json", &events); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, event := range events {
+		handler(event.Domain, event.UUID, lifecycleEventName(event.Event, event.Detail))
+	}
+	return mockLibvirtSubscription{}, nil
+}
+
+type mockLibvirtSubscription struct{}
+
+func (mockLibvirtSubscription) Alive() bool { return true }
+func (mockLibvirtSubscription) Close()      {}
+
+func unmarshalLibvirtFixture(fixtures, filename string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(fixtures, filename))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func readLibvirtFixture(fixtures, filename string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(fixtures, filename))
+	return string(b), err
+}
+
+type mockLibvirtConn struct {
+	fixtures string
+}
+
+// mockLibvirtNode is the host in node.json.
+type mockLibvirtNode struct {
+	Info        libvirtNodeInfo
+	CPUStats    libvirtNodeCPUStats
+	MemoryStats libvirtNodeMemoryStats
+	// The free memory in bytes and free pages by cell ID.
+	CellFreeMemory map[int]uint64
+	CellFreePages  map[int][]uint64
+}
+
+func (c *mockLibvirtConn) Close() error { return nil }
+
+func (c *mockLibvirtConn) domains() ([]*mockLibvirtDomain, error) {
+	var domains []*mockLibvirtDomain
+	if err := unmarshalLibvirtFixture(c.fixtures, "domains.json", &domains); err != nil {
+		return nil, err
+	}
+	for _, d := range domains {
+		d.fixtures = c.fixtures
+	}
+	return domains, nil
+}
+
+func (c *mockLibvirtConn) node() (*mockLibvirtNode, error) {
+	var node mockLibvirtNode
+	if err := unmarshalLibvirtFixture(c.fixtures, "node.json", &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (c *mockLibvirtConn) NumOfDomains() (int, error) {
+	domains, err := c.domains()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, d := range domains {
+		if d.Active {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (c *mockLibvirtConn) NumOfDefinedDomains() (int, error) {
+	domains, err := c.domains()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, d := range domains {
+		if !d.Active {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (c *mockLibvirtConn) GetAllDomainStats() ([]libvirtDomainStats, error) {
+	domains, err := c.domains()
+	if err != nil {
+		return nil, err
+	}
+	var stats []libvirtDomainStats
+	for _, d := range domains {
+		if d.Active {
+			s := d.Stats
+			s.Domain = d
+			stats = append(stats, s)
+		}
+	}
+	return stats, nil
+}
+
+func (c *mockLibvirtConn) ListInactiveDomains() ([]libvirtDomain, error) {
+	domains, err := c.domains()
+	if err != nil {
+		return nil, err
+	}
+	var inactive []libvirtDomain
+	for _, d := range domains {
+		if !d.Active {
+			inactive = append(inactive, d)
+		}
+	}
+	return inactive, nil
+}
+
+// ListStoragePools reports the pools of pools.json. Without the file, the
+// driver doesn't support storage.
+func (c *mockLibvirtConn) ListStoragePools() ([]libvirtStoragePool, error) {
+	var pools []*mockLibvirtStoragePool
+	if err := unmarshalLibvirtFixture(c.fixtures, "pools.json", &pools); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &libvirtError{code: libvirtErrNoSupport, err: err}
+		}
+		return nil, err
+	}
+	result := make([]libvirtStoragePool, 0, len(pools))
+	for _, p := range pools {
+		p.fixtures = c.fixtures
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func (c *mockLibvirtConn) GetNodeInfo() (*libvirtNodeInfo, error) {
+	node, err := c.node()
+	if err != nil {
+		return nil, err
+	}
+	return &node.Info, nil
+}
+
+func (c *mockLibvirtConn) GetNodeCPUStats() (*libvirtNodeCPUStats, error) {
+	node, err := c.node()
+	if err != nil {
+		return nil, err
+	}
+	return &node.CPUStats, nil
+}
+
+func (c *mockLibvirtConn) GetNodeMemoryStats() (*libvirtNodeMemoryStats, error) {
+	node, err := c.node()
+	if err != nil {
+		return nil, err
+	}
+	return &node.MemoryStats, nil
+}
+
+func (c *mockLibvirtConn) GetCapabilities() (string, error) {
+	return readLibvirtFixture(c.fixtures, "capabilities.xml")
+}
+
+func (c *mockLibvirtConn) GetCellFreeMemory(cell int) (uint64, error) {
+	node, err := c.node()
+	if err != nil {
+		return 0, err
+	}
+	free, ok := node.CellFreeMemory[cell]
+	if !ok {
+		return 0, fmt.Errorf("no free memory of cell %d", cell)
+	}
+	return free, nil
+}
+
+func (c *mockLibvirtConn) GetCellFreePages(pageSizes []uint64, cell int) ([]uint64, error) {
+	node, err := c.node()
+	if err != nil {
+		return nil, err
+	}
+	free, ok := node.CellFreePages[cell]
+	if !ok || len(free) != len(pageSizes) {
+		return nil, fmt.Errorf("no free pages of cell %d", cell)
+	}
+	return free, nil
+}
+
+// mockLibvirtDomain is a domain of domains.json. Its XML description is read
+// from domain-<name>.xml.
+type mockLibvirtDomain struct {
+	fixtures string
+
+	Name      string
+	UUID      string
+	ID        uint
+	Active    bool
+	Autostart bool
+	Info      libvirtDomainInfo
+	// Stats are the bulk statistics of active domains.
+	Stats libvirtDomainStats
+	Vcpus []libvirtVcpuInfo
+}
+
+func (d *mockLibvirtDomain) GetName() (string, error)             { return d.Name, nil }
+func (d *mockLibvirtDomain) GetUUIDString() (string, error)       { return d.UUID, nil }
+func (d *mockLibvirtDomain) GetAutostart() (bool, error)          { return d.Autostart, nil }
+func (d *mockLibvirtDomain) GetVcpus() ([]libvirtVcpuInfo, error) { return d.Vcpus, nil }
+func (d *mockLibvirtDomain) Free() error                          { return nil }
+
+func (d *mockLibvirtDomain) GetID() (uint, error) {
+	if !d.Active {
+		return 0, fmt.Errorf("domain %s is not running", d.Name)
+	}
+	return d.ID, nil
+}
+
+func (d *mockLibvirtDomain) GetXMLDesc() (string, error) {
+	return readLibvirtFixture(d.fixtures, "domain-"+d.Name+".xml")
+}
+
+func (d *mockLibvirtDomain) GetInfo() (*libvirtDomainInfo, error) {
+	info := d.Info
+	return &info, nil
+}
+
+// mockLibvirtStoragePool is a pool of pools.json. Its XML description is read
+// from pool-<name>.xml.
+type mockLibvirtStoragePool struct {
+	fixtures string
+
+	Name    string
+	Info    libvirtStoragePoolInfo
+	Volumes []*mockLibvirtStorageVolume
+}
+
+func (p *mockLibvirtStoragePool) GetName() (string, error) { return p.Name, nil }
+func (p *mockLibvirtStoragePool) Free() error              { return nil }
+
+func (p *mockLibvirtStoragePool) GetXMLDesc() (string, error) {
+	return readLibvirtFixture(p.fixtures, "pool-"+p.Name+".xml")
+}
+
+func (p *mockLibvirtStoragePool) GetInfo() (*libvirtStoragePoolInfo, error) {
+	info := p.Info
+	return &info, nil
+}
+
+func (p *mockLibvirtStoragePool) ListStorageVolumes() ([]libvirtStorageVolume, error) {
+	volumes := make([]libvirtStorageVolume, 0, len(p.Volumes))
+	for _, v := range p.Volumes {
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+type mockLibvirtStorageVolume struct {
+	Name string
+	Path string
+	Info libvirtStorageVolumeInfo
+}
+
+func (v *mockLibvirtStorageVolume) GetName() (string, error) { return v.Name, nil }
+func (v *mockLibvirtStorageVolume) GetPath() (string, error) { return v.Path, nil }
+func (v *mockLibvirtStorageVolume) Free() error              { return nil }
+
+func (v *mockLibvirtStorageVolume) GetInfo() (*libvirtStorageVolumeInfo, error) {
+	info := v.Info
+	return &info, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var libvirtLifecycleEvents = kingpin.Flag("collector.libvirt.lifecycle-events", "Subscribe to the lifecycle events of domains and count them.").Default("true").Bool()
+
+// Lifecycle event types and details of stopped events as numbered by libvirt.
+const (
+	libvirtEventDefined = iota
+	libvirtEventUndefined
+	libvirtEventStarted
+	libvirtEventSuspended
+	libvirtEventResumed
+	libvirtEventStopped
+	libvirtEventShutdown
+	libvirtEventPMSuspended
+	libvirtEventCrashed
+)
+
+const (
+	libvirtEventStoppedCrashed  = 2
+	libvirtEventStoppedMigrated = 3
+)
+
+// Lifecycle events as exported in the event label. Stopped events caused by
+// a crash or a migration to another host are counted as crashed and migrated.
+var lifecycleEventNames = map[int]string{
+	libvirtEventDefined:     "defined",
+	libvirtEventUndefined:   "undefined",
+	libvirtEventStarted:     "started",
+	libvirtEventSuspended:   "suspended",
+	libvirtEventResumed:     "resumed",
+	libvirtEventStopped:     "stopped",
+	libvirtEventShutdown:    "shutdown",
+	libvirtEventPMSuspended: "pmsuspended",
+	libvirtEventCrashed:     "crashed",
+}
+
+const (
+	lifecycleEventRebooted = "rebooted"
+	lifecycleEventMigrated = "migrated"
+	lifecycleEventUnknown  = "unknown"
+)
+
+// domainEventTunable is passed to lifecycle handlers when tunables of a
+// running domain like its I/O limits changed. It isn't counted.
+const domainEventTunable = "tunable"
+
+// lifecycleEventName returns the event label of a lifecycle event with the
+// type and detail reported by libvirt.
+func lifecycleEventName(event, detail int) string {
+	if event == libvirtEventStopped {
+		switch detail {
+		case libvirtEventStoppedCrashed:
+			return lifecycleEventNames[libvirtEventCrashed]
+		case libvirtEventStoppedMigrated:
+			return lifecycleEventMigrated
+		}
+	}
+	if name, ok := lifecycleEventNames[event]; ok {
+		return name
+	}
+	return lifecycleEventUnknown
+}
+
+type lifecycleKey struct {
+	domain string
+	uuid   string
+	event  string
+}
+
+// lifecycleWatcher counts the lifecycle events of all domains at a libvirt
+// URI. Create instances with newLifecycleWatcher.
+type lifecycleWatcher struct {
+	uri    string
+	driver libvirtDriver
+
+	// subMtx guards the subscription.
+	subMtx sync.Mutex
+	sub    libvirtSubscription
+
+	// countsMtx is separate from subMtx, as closing a subscription may wait
+	// for running handlers.
+	countsMtx sync.Mutex
+	counts    map[lifecycleKey]float64
+
+	// changed is called with the UUID of every domain whose definition or
+	// tunables changed, if not nil.
+	changed func(uuid string)
+}
+
+func newLifecycleWatcher(uri string, driver libvirtDriver, changed func(uuid string)) *lifecycleWatcher {
+	return &lifecycleWatcher{uri: uri, driver: driver, counts: map[lifecycleKey]float64{}, changed: changed}
+}
+
+// connect subscribes to the events unless the subscription is still alive.
+// Events are missed while there is no subscription, e.g. while libvirtd
+// restarts.
+func (w *lifecycleWatcher) connect() error {
+	w.subMtx.Lock()
+	defer w.subMtx.Unlock()
+	if w.sub != nil {
+		if w.sub.Alive() {
+			return nil
+		}
+		w.sub.Close()
+		w.sub = nil
+	}
+
+	sub, err := w.driver.SubscribeLifecycle(w.uri, w.count)
+	if err != nil {
+		return err
+	}
+	w.sub = sub
+	return nil
+}
+
+// close stops the subscription.
+func (w *lifecycleWatcher) close() {
+	w.subMtx.Lock()
+	defer w.subMtx.Unlock()
+	if w.sub != nil {
+		w.sub.Close()
+		w.sub = nil
+	}
+}
+
+func (w *lifecycleWatcher) count(domain, uuid, event string) {
+	if (event == lifecycleEventNames[libvirtEventDefined] || event == domainEventTunable) && w.changed != nil {
+		w.changed(uuid)
+	}
+	if event == domainEventTunable {
+		return
+	}
+	w.countsMtx.Lock()
+	defer w.countsMtx.Unlock()
+	w.counts[lifecycleKey{domain: domain, uuid: uuid, event: event}]++
+}
+
+// collect sends the event counts. The counts of domains not in seen, which
+// don't exist anymore, are sent a last time and dropped.
+func (w *lifecycleWatcher) collect(ch chan<- prometheus.Metric, desc *prometheus.Desc, seen map[string]bool) {
+	w.countsMtx.Lock()
+	defer w.countsMtx.Unlock()
+	for key, count := range w.counts {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, count, w.uri, key.domain, key.uuid, key.event)
+		if !seen[key.uuid] {
+			delete(w.counts, key)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLifecycleEventName(t *testing.T) {
+	for _, tt := range []struct {
+		event  int
+		detail int
+		want   string
+	}{
+		{libvirtEventStarted, 0, "started"},
+		{libvirtEventStopped, 0, "stopped"},
+		{libvirtEventStopped, libvirtEventStoppedCrashed, "crashed"},
+		{libvirtEventStopped, libvirtEventStoppedMigrated, "migrated"},
+		{libvirtEventCrashed, 0, "crashed"},
+		{100, 0, "unknown"},
+	} {
+		if got := lifecycleEventName(tt.event, tt.detail); got != tt.want {
+			t.Errorf("event %d detail %d: want %q, got %q", tt.event, tt.detail, tt.want, got)
+		}
+	}
+}
+
+func TestLifecycleWatcherCollect(t *testing.T) {
+	w := newLifecycleWatcher("test:///default", nil, nil)
+	w.counts[lifecycleKey{domain: "a", uuid: "1", event: "started"}] = 2
+	w.counts[lifecycleKey{domain: "b", uuid: "2", event: "undefined"}] = 1
+	desc := prometheus.NewDesc("test", "", []string{"hypervisor_uri", "domain", "uuid", "event"}, nil)
+
+	collect := func() int {
+		ch := make(chan prometheus.Metric, 10)
+		w.collect(ch, desc, map[string]bool{"1": true})
+		close(ch)
+		return len(ch)
+	}
+	// The counts of the undefined domain are sent a last time.
+	if n := collect(); n != 2 {
+		t.Errorf("want 2 metrics, got %d", n)
+	}
+	if n := collect(); n != 1 {
+		t.Errorf("want 1 metric after the domain is gone, got %d", n)
+	}
+}
+
+// subscriptionDriver counts the subscriptions to lifecycle events.
+type subscriptionDriver struct {
+	libvirtDriver
+	subs []*fakeSubscription
+}
+
+type fakeSubscription struct {
+	alive  bool
+	closed bool
+}
+
+func (s *fakeSubscription) Alive() bool { return s.alive }
+func (s *fakeSubscription) Close()      { s.closed = true }
+
+func (d *subscriptionDriver) SubscribeLifecycle(uri string, handler lifecycleHandler) (libvirtSubscription, error) {
+	sub := &fakeSubscription{alive: true}
+	d.subs = append(d.subs, sub)
+	handler("a", "1", "started")
+	return sub, nil
+}
+
+func TestLifecycleWatcherResubscribe(t *testing.T) {
+	driver := &subscriptionDriver{}
+	w := newLifecycleWatcher("test:///default", driver, nil)
+	for i := 0; i < 2; i++ {
+		if err := w.connect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(driver.subs) != 1 {
+		t.Fatalf("want 1 subscription while it's alive, got %d", len(driver.subs))
+	}
+
+	driver.subs[0].alive = false
+	if err := w.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.subs) != 2 || !driver.subs[0].closed {
+		t.Fatalf("want the dead subscription to be closed and replaced, got %+v", driver.subs)
+	}
+	if got := w.counts[lifecycleKey{domain: "a", uuid: "1", event: "started"}]; got != 2 {
+		t.Errorf("want 2 events, got %v", got)
+	}
+
+	w.close()
+	if !driver.subs[1].closed {
+		t.Error("want the subscription to be closed")
+	}
+}
+
+func TestLifecycleWatcherChanged(t *testing.T) {
+	var changed []string
+	w := newLifecycleWatcher("test:///default", nil, func(uuid string) {
+		changed = append(changed, uuid)
+	})
+	w.count("a", "1", "started")
+	w.count("a", "1", "defined")
+	w.count("b", "2", "tunable")
+	if len(changed) != 2 || changed[0] != "1" || changed[1] != "2" {
+		t.Errorf("want calls for the defined event of domain 1 and the tunable event of domain 2, got %v", changed)
+	}
+	// Tunable events aren't counted.
+	if _, ok := w.counts[lifecycleKey{domain: "b", uuid: "2", event: "tunable"}]; ok || len(w.counts) != 2 {
+		t.Errorf("want counts of the started and defined events, got %v", w.counts)
+	}
+}
@@ -1,5 +1,3 @@
-// +build libvirt
-
 // Copyright 2018 The Prometheus Authors
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -13,31 +11,54 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build !nolibvirt
+
 package collector
 
 import (
 	"encoding/xml"
-	"github.com/libvirt/libvirt-go"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
-	"log"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	libvirtURIs          = kingpin.Flag("collector.libvirt.uri", "Comma-separated list of libvirt URIs to connect to, e.g. qemu:///system,lxc:///.").Default("qemu:///system").String()
+	libvirtNovaMetadata  = kingpin.Flag("collector.libvirt.nova-metadata", "Export the name, flavor and project_name labels from the OpenStack Nova metadata of domains, a preset of --collector.libvirt.metadata-labels.").Default("true").Bool()
+	libvirtXMLCacheTTL   = kingpin.Flag("collector.libvirt.xml-cache-ttl", "Maximum age of the cached XML description of a domain, after which it is read again to pick up e.g. changed metadata. Use 0 to read it on every scrape.").Default("5m").Duration()
+	libvirtVcpuPlacement = kingpin.Flag("collector.libvirt.vcpu-placement", "Export the host CPU and pinning of every vCPU. Unless the driver reports them with the vCPU statistics, this reads the vCPUs of every domain separately.").Default("true").Bool()
 )
 
 // LibvirtExporter implements a Prometheus exporter for libvirt state.
 type LibvirtExporter struct {
-	uri                string
-	exportNovaMetadata bool
+	driver         libvirtDriver
+	uris           []string
+	metadataLabels []metadataLabel
+	exportVolumes  bool
+	exportVcpus    bool
 
 	libvirtUpDesc *prometheus.Desc
 
 	libvirtDomainActive *prometheus.Desc
 	libvirtDomainTotal  *prometheus.Desc
 
+	libvirtDomainScrapeErrors    *prometheus.Desc
+	libvirtDomainLifecycleEvents *prometheus.Desc
+
 	// domain info
 	libvirtDomainInfoMaxMemDesc    *prometheus.Desc
 	libvirtDomainInfoMemoryDesc    *prometheus.Desc
 	libvirtDomainInfoNrVirtCpuDesc *prometheus.Desc
 	libvirtDomainInfoCpuTimeDesc   *prometheus.Desc
 	libvirtDomainInfoDomainState   *prometheus.Desc
+	libvirtDomainInfoAutostart     *prometheus.Desc
 
 	//domain cpu info
 	libvirtDomainCpuCpuTime    *prometheus.Desc
@@ -45,6 +66,13 @@ type LibvirtExporter struct {
 	libvirtDomainCpuSystemTime *prometheus.Desc
 	libvirtDomainCpuVcpuTime   *prometheus.Desc
 
+	// domain vcpu info
+	libvirtDomainVcpuState   *prometheus.Desc
+	libvirtDomainVcpuTime    *prometheus.Desc
+	libvirtDomainVcpuWait    *prometheus.Desc
+	libvirtDomainVcpuCpu     *prometheus.Desc
+	libvirtDomainVcpuPinning *prometheus.Desc
+
 	//domain mem info
 	libvirtDomainMemUnused     *prometheus.Desc
 	libvirtDomainMemAvailable  *prometheus.Desc
@@ -65,8 +93,14 @@ type LibvirtExporter struct {
 	libvirtDomainBlockFlushReqDesc        *prometheus.Desc
 	libvirtDomainBlockFlushTotalTimesDesc *prometheus.Desc
 
+	// domain block io tune
+	libvirtDomainBlockLimitBytes    *prometheus.Desc
+	libvirtDomainBlockLimitRequests *prometheus.Desc
+
+	// domain device info
+	libvirtDomainDeviceInfo *prometheus.Desc
+
 	// domain interface info
-	libvirtDomainInterfaceAddresses     *prometheus.Desc
 	libvirtDomainInterfaceRxBytesDesc   *prometheus.Desc
 	libvirtDomainInterfaceRxPacketsDesc *prometheus.Desc
 	libvirtDomainInterfaceRxErrsDesc    *prometheus.Desc
@@ -76,33 +110,161 @@ type LibvirtExporter struct {
 	libvirtDomainInterfaceTxErrsDesc    *prometheus.Desc
 	libvirtDomainInterfaceTxDropDesc    *prometheus.Desc
 
+	// node info
+	libvirtNodeInfo            *prometheus.Desc
+	libvirtNodeCpus            *prometheus.Desc
+	libvirtNodeCPUFrequency    *prometheus.Desc
+	libvirtNodeCPUSeconds      *prometheus.Desc
+	libvirtNodeMemoryTotal     *prometheus.Desc
+	libvirtNodeMemoryFree      *prometheus.Desc
+	libvirtNodeMemoryBuffers   *prometheus.Desc
+	libvirtNodeMemoryCached    *prometheus.Desc
+	libvirtNodeCellFreeMemory  *prometheus.Desc
+	libvirtNodeCellPages       *prometheus.Desc
+	libvirtNodeCellFreePages   *prometheus.Desc
+	libvirtNodeAllocatedVcpus  *prometheus.Desc
+	libvirtNodeAllocatedMemory *prometheus.Desc
+
+	// storage pool info
+	libvirtStoragePoolState      *prometheus.Desc
+	libvirtStoragePoolCapacity   *prometheus.Desc
+	libvirtStoragePoolAllocation *prometheus.Desc
+	libvirtStoragePoolAvailable  *prometheus.Desc
+
+	// storage volume info
+	libvirtStorageVolumeCapacity   *prometheus.Desc
+	libvirtStorageVolumeAllocation *prometheus.Desc
+
 	// domain interface params
+	libvirtDomainInterfaceBandwidthAverage *prometheus.Desc
+	libvirtDomainInterfaceBandwidthPeak    *prometheus.Desc
+	libvirtDomainInterfaceBandwidthBurst   *prometheus.Desc
+
+	xmlCache *domainXMLCache
+
+	// domainErrorsMtx guards domainErrors, the number of skipped domains by
+	// URI and reason.
+	domainErrorsMtx sync.Mutex
+	domainErrors    map[string]map[string]float64
+
+	// lifecycleWatchers count the lifecycle events by URI, if enabled.
+	lifecycleWatchers map[string]*lifecycleWatcher
+}
+
+// Reasons for skipping a domain, see domainScrapeError.
+const (
+	domainErrorNotFound = "not_found"
+	domainErrorLookup   = "lookup"
+	domainErrorXML      = "xml"
+)
+
+// domainScrapeError is an error scraping a single domain. It only causes the
+// domain to be skipped and is counted by reason.
+type domainScrapeError struct {
+	reason string
+	err    error
+}
+
+func newDomainScrapeError(reason string, err error) domainScrapeError {
+	// The domain may have been shut down since the statistics were read.
+	if libvirtErrorCodeOf(err) == libvirtErrNoDomain {
+		reason = domainErrorNotFound
+	}
+	return domainScrapeError{reason: reason, err: err}
+}
+
+func (e domainScrapeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err)
 }
 
 func init() {
-	registerCollector("libvirt", defaultEnabled, NewLibvirtExporter)
+	registerCollector("libvirt", libvirtDefaultState, NewLibvirtExporter)
 }
 
-// NewLibvirtExporter creates a new Prometheus exporter for libvirt.使用uri和是否导出nova信息2个参数启动exporter
+// NewLibvirtExporter creates a new Prometheus exporter for libvirt, connecting
+// to the URIs given by --collector.libvirt.uri.
 func NewLibvirtExporter() (Collector, error) {
-	var domainLabels = []string{"domain", "uuid", "name", "flavor", "project_name"}
+	var uris []string
+	for _, uri := range strings.Split(*libvirtURIs, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("no libvirt URI given")
+	}
+
+	hypervisorLabels := []string{"hypervisor_uri"}
+	poolLabels := []string{"hypervisor_uri", "pool", "type"}
+	volumeLabels := []string{"hypervisor_uri", "pool", "volume", "path", "domain", "uuid"}
+	domainLabels := []string{"hypervisor_uri", "domain", "uuid"}
+	metadataLabels, err := parseMetadataLabels(*libvirtMetadataLabels)
+	if err != nil {
+		return nil, err
+	}
+	if *libvirtNovaMetadata {
+		metadataLabels = append(append([]metadataLabel{}, novaMetadataLabels...), metadataLabels...)
+	}
+	if err := checkMetadataLabels(metadataLabels); err != nil {
+		return nil, err
+	}
+	for _, l := range metadataLabels {
+		domainLabels = append(domainLabels, l.name)
+	}
+	// withDomainLabels returns a new slice, so that the descs don't share
+	// the backing array of domainLabels.
+	withDomainLabels := func(labels ...string) []string {
+		return append(append([]string{}, domainLabels...), labels...)
+	}
+
+	driver, err := newLibvirtDriver(*libvirtFixtures)
+	if err != nil {
+		return nil, err
+	}
+	xmlCache := &domainXMLCache{ttl: *libvirtXMLCacheTTL}
+	var lifecycleWatchers map[string]*lifecycleWatcher
+	if *libvirtLifecycleEvents {
+		lifecycleWatchers = make(map[string]*lifecycleWatcher, len(uris))
+		for _, uri := range uris {
+			uri := uri
+			lifecycleWatchers[uri] = newLifecycleWatcher(uri, driver, func(uuid string) {
+				xmlCache.invalidate(uri, uuid)
+			})
+		}
+	}
 	return &LibvirtExporter{
-		uri:                "qemu:///system",
-		exportNovaMetadata: true,
+		driver:         driver,
+		xmlCache:       xmlCache,
+		uris:           uris,
+		metadataLabels: metadataLabels,
+		exportVolumes:  *libvirtStorageVolumes,
+		exportVcpus:    *libvirtVcpuPlacement,
 		libvirtUpDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "", "up"),
 			"Whether scraping libvirt's metrics was successful.",
-			nil,
+			hypervisorLabels,
 			nil),
 		libvirtDomainActive: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "", "active"),
 			"the number of active domains.",
-			nil,
+			hypervisorLabels,
 			nil),
 		libvirtDomainTotal: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "", "total"),
 			"the number of active and inactive domains (total).",
-			nil,
+			hypervisorLabels,
+			nil),
+		libvirtDomainScrapeErrors: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "", "domain_scrape_errors_total"),
+			"Number of domains skipped in scrapes because of errors, by reason.",
+			[]string{"hypervisor_uri", "reason"},
+			nil),
+		domainErrors:      map[string]map[string]float64{},
+		lifecycleWatchers: lifecycleWatchers,
+		libvirtDomainLifecycleEvents: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain", "lifecycle_events_total"),
+			"Number of lifecycle events of the domain since the exporter subscribed to them, by event.",
+			[]string{"hypervisor_uri", "domain", "uuid", "event"},
 			nil),
 		// domain info
 		libvirtDomainInfoDomainState: prometheus.NewDesc(
@@ -110,6 +272,11 @@ func NewLibvirtExporter() (Collector, error) {
 			"the state of the domain.",
 			domainLabels,
 			nil),
+		libvirtDomainInfoAutostart: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_info", "autostart"),
+			"Whether the inactive domain is started when the host boots.",
+			domainLabels,
+			nil),
 		libvirtDomainInfoMaxMemDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_info", "maximum_memory_bytes"),
 			"Maximum allowed memory of the domain, in bytes.",
@@ -150,6 +317,32 @@ func NewLibvirtExporter() (Collector, error) {
 			"vcpu time used in ns.",
 			domainLabels,
 			nil),
+		// domain vcpu info
+		libvirtDomainVcpuState: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_vcpu", "state"),
+			"State of the virtual CPU: 0 offline, 1 running, 2 blocked.",
+			withDomainLabels("vcpu"),
+			nil),
+		libvirtDomainVcpuTime: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_vcpu", "time_seconds_total"),
+			"Amount of CPU time used by the virtual CPU, in seconds.",
+			withDomainLabels("vcpu"),
+			nil),
+		libvirtDomainVcpuWait: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_vcpu", "wait_seconds_total"),
+			"Amount of time the virtual CPU was runnable but waited for a host CPU, in seconds. The guest sees it as steal time.",
+			withDomainLabels("vcpu"),
+			nil),
+		libvirtDomainVcpuCpu: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_vcpu", "cpu"),
+			"Host CPU the virtual CPU is running on.",
+			withDomainLabels("vcpu"),
+			nil),
+		libvirtDomainVcpuPinning: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_vcpu", "pinning"),
+			"Host CPUs the virtual CPU may run on, as list of CPUs and ranges in the cpus label. Value is always 1.",
+			withDomainLabels("vcpu", "cpus"),
+			nil),
 		// domain memory info
 		libvirtDomainMemUnused: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_mem_state", "mem_unused"),
@@ -180,104 +373,229 @@ func NewLibvirtExporter() (Collector, error) {
 		libvirtDomainBlockCapacity: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "block_capacity"),
 			"logical size in bytes of the image (how much storage the guest will see).",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockAllocation: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "block_allocation"),
 			"host storage in bytes occupied by the image (such as highest allocated extent if there are no holes, similar to 'du').",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockPhysical: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "block_physical"),
 			"host physical size in bytes of the image container (last offset, similar to 'ls'.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockRdBytesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "read_bytes_total"),
 			"Number of bytes read from a block device, in bytes.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockRdReqDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "read_requests_total"),
 			"Number of read requests from a block device.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockRdTotalTimesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "read_seconds_total"),
 			"Amount of time spent reading from a block device, in seconds.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockWrBytesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "write_bytes_total"),
 			"Number of bytes written from a block device, in bytes.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 
 		libvirtDomainBlockWrReqDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "write_requests_total"),
 			"Number of write requests from a block device.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockWrTotalTimesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "write_seconds_total"),
 			"Amount of time spent writing from a block device, in seconds.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockFlushReqDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_requests_total"),
 			"Number of flush requests from a block device.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 		libvirtDomainBlockFlushTotalTimesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_seconds_total"),
 			"Amount of time spent flushing of a block device, in seconds.",
-			append(domainLabels, "source_file", "target_device"),
+			withDomainLabels("source_file", "target_device"),
 			nil),
 
-		libvirtDomainInterfaceAddresses: prometheus.NewDesc(
-			prometheus.BuildFQName("libvirt", "domain_interface_info", "interface_info_addresses"),
-			"Network interface info .",
-			append(domainLabels, "source_bridge", "target_device", "domain_interface"),
+		// domain block io tune
+		libvirtDomainBlockLimitBytes: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_bytes_per_second"),
+			"Throttle of the bytes read, written or both of a block device, in bytes per second. Not reported for unlimited block devices.",
+			withDomainLabels("source_file", "target_device", "operation"),
+			nil),
+		libvirtDomainBlockLimitRequests: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_requests_per_second"),
+			"Throttle of the read, write or all requests of a block device, in requests per second. Not reported for unlimited block devices.",
+			withDomainLabels("source_file", "target_device", "operation"),
+			nil),
+		// domain interface params
+		libvirtDomainInterfaceBandwidthAverage: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_interface_stats", "bandwidth_average_bytes_per_second"),
+			"Average bandwidth limit of a network interface, in bytes per second. Not reported for unlimited interfaces.",
+			withDomainLabels("source_bridge", "target_device", "direction"),
+			nil),
+		libvirtDomainInterfaceBandwidthPeak: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_interface_stats", "bandwidth_peak_bytes_per_second"),
+			"Peak bandwidth limit of a network interface, in bytes per second. Not reported for unlimited interfaces.",
+			withDomainLabels("source_bridge", "target_device", "direction"),
+			nil),
+		libvirtDomainInterfaceBandwidthBurst: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain_interface_stats", "bandwidth_burst_bytes"),
+			"Bytes a network interface may send or receive at peak bandwidth. Not reported for unlimited interfaces.",
+			withDomainLabels("source_bridge", "target_device", "direction"),
+			nil),
+		libvirtDomainDeviceInfo: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "domain", "device_info"),
+			"Maps the disks and interfaces of the domain to their host devices, as named by the diskstats and netdev collectors in the device label. Value is always 1.",
+			withDomainLabels("type", "device", "target_device", "source"),
 			nil),
 		libvirtDomainInterfaceRxBytesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_bytes_total"),
 			"Number of bytes received on a network interface, in bytes.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceRxPacketsDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_packets_total"),
 			"Number of packets received on a network interface.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceRxErrsDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_errors_total"),
 			"Number of packet receive errors on a network interface.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceRxDropDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_drops_total"),
 			"Number of packet receive drops on a network interface.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceTxBytesDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_bytes_total"),
 			"Number of bytes transmitted on a network interface, in bytes.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceTxPacketsDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_packets_total"),
 			"Number of packets transmitted on a network interface.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceTxErrsDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_errors_total"),
 			"Number of packet transmit errors on a network interface.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
 			nil),
 		libvirtDomainInterfaceTxDropDesc: prometheus.NewDesc(
 			prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_drops_total"),
 			"Number of packet transmit drops on a network interface.",
-			append(domainLabels, "source_bridge", "target_device"),
+			withDomainLabels("source_bridge", "target_device"),
+			nil),
+		// node info
+		libvirtNodeInfo: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "info"),
+			"CPU model of the host. Value is always 1.",
+			[]string{"hypervisor_uri", "model"},
+			nil),
+		libvirtNodeCpus: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "cpus"),
+			"Number of active CPUs of the host.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeCPUFrequency: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "cpu_frequency_hertz"),
+			"Expected CPU frequency of the host, in hertz.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeCPUSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "cpu_seconds_total"),
+			"Time the CPUs of the host spent in each mode, in seconds.",
+			[]string{"hypervisor_uri", "mode"},
+			nil),
+		libvirtNodeMemoryTotal: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "memory_total_bytes"),
+			"Total memory of the host, in bytes.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeMemoryFree: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "memory_free_bytes"),
+			"Free memory of the host, in bytes.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeMemoryBuffers: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "memory_buffers_bytes"),
+			"Memory of the host used for buffers, in bytes.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeMemoryCached: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "memory_cached_bytes"),
+			"Memory of the host used for the page cache, in bytes.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeCellFreeMemory: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "cell_free_memory_bytes"),
+			"Free memory of a NUMA cell of the host, in bytes.",
+			[]string{"hypervisor_uri", "cell"},
+			nil),
+		libvirtNodeCellPages: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "cell_pages"),
+			"Number of pages of a size of a NUMA cell of the host.",
+			[]string{"hypervisor_uri", "cell", "page_size_bytes"},
+			nil),
+		libvirtNodeCellFreePages: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "cell_free_pages"),
+			"Number of free pages of a size of a NUMA cell of the host.",
+			[]string{"hypervisor_uri", "cell", "page_size_bytes"},
+			nil),
+		libvirtNodeAllocatedVcpus: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "allocated_vcpus"),
+			"Number of online vCPUs of all active domains.",
+			hypervisorLabels,
+			nil),
+		libvirtNodeAllocatedMemory: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "node", "allocated_memory_bytes"),
+			"Maximum memory of all active domains, in bytes.",
+			hypervisorLabels,
+			nil),
+		// storage pool info
+		libvirtStoragePoolState: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "storage_pool", "state"),
+			"State of the storage pool: 0 inactive, 1 building, 2 running, 3 degraded, 4 inaccessible.",
+			poolLabels,
+			nil),
+		libvirtStoragePoolCapacity: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "storage_pool", "capacity_bytes"),
+			"Logical size of the storage pool, in bytes.",
+			poolLabels,
+			nil),
+		libvirtStoragePoolAllocation: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "storage_pool", "allocation_bytes"),
+			"Storage allocated by the volumes of the storage pool, in bytes.",
+			poolLabels,
+			nil),
+		libvirtStoragePoolAvailable: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "storage_pool", "available_bytes"),
+			"Storage available for new volumes of the storage pool, in bytes.",
+			poolLabels,
+			nil),
+		// storage volume info
+		libvirtStorageVolumeCapacity: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "storage_volume", "capacity_bytes"),
+			"Logical size of the storage volume, in bytes.",
+			volumeLabels,
+			nil),
+		libvirtStorageVolumeAllocation: prometheus.NewDesc(
+			prometheus.BuildFQName("libvirt", "storage_volume", "allocation_bytes"),
+			"Storage allocated by the storage volume, in bytes.",
+			volumeLabels,
 			nil),
 	}, nil
 }
@@ -287,17 +605,26 @@ func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.libvirtUpDesc
 	ch <- e.libvirtDomainActive
 	ch <- e.libvirtDomainTotal
+	ch <- e.libvirtDomainScrapeErrors
+	ch <- e.libvirtDomainLifecycleEvents
 
 	ch <- e.libvirtDomainCpuCpuTime
 	ch <- e.libvirtDomainCpuUserTime
 	ch <- e.libvirtDomainCpuSystemTime
 	ch <- e.libvirtDomainCpuVcpuTime
 
+	ch <- e.libvirtDomainVcpuState
+	ch <- e.libvirtDomainVcpuTime
+	ch <- e.libvirtDomainVcpuWait
+	ch <- e.libvirtDomainVcpuCpu
+	ch <- e.libvirtDomainVcpuPinning
+
 	ch <- e.libvirtDomainInfoDomainState
 	ch <- e.libvirtDomainInfoMaxMemDesc
 	ch <- e.libvirtDomainInfoMemoryDesc
 	ch <- e.libvirtDomainInfoNrVirtCpuDesc
 	ch <- e.libvirtDomainInfoCpuTimeDesc
+	ch <- e.libvirtDomainInfoAutostart
 
 	// domain memory info
 	ch <- e.libvirtDomainMemUnused
@@ -317,376 +644,733 @@ func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.libvirtDomainBlockWrTotalTimesDesc
 	ch <- e.libvirtDomainBlockFlushReqDesc
 	ch <- e.libvirtDomainBlockFlushTotalTimesDesc
+
+	ch <- e.libvirtDomainBlockLimitBytes
+	ch <- e.libvirtDomainBlockLimitRequests
+
+	ch <- e.libvirtDomainInterfaceBandwidthAverage
+	ch <- e.libvirtDomainInterfaceBandwidthPeak
+	ch <- e.libvirtDomainInterfaceBandwidthBurst
+
+	ch <- e.libvirtDomainDeviceInfo
+
+	ch <- e.libvirtNodeInfo
+	ch <- e.libvirtNodeCpus
+	ch <- e.libvirtNodeCPUFrequency
+	ch <- e.libvirtNodeCPUSeconds
+	ch <- e.libvirtNodeMemoryTotal
+	ch <- e.libvirtNodeMemoryFree
+	ch <- e.libvirtNodeMemoryBuffers
+	ch <- e.libvirtNodeMemoryCached
+	ch <- e.libvirtNodeCellFreeMemory
+	ch <- e.libvirtNodeCellPages
+	ch <- e.libvirtNodeCellFreePages
+	ch <- e.libvirtNodeAllocatedVcpus
+	ch <- e.libvirtNodeAllocatedMemory
+
+	ch <- e.libvirtStoragePoolState
+	ch <- e.libvirtStoragePoolCapacity
+	ch <- e.libvirtStoragePoolAllocation
+	ch <- e.libvirtStoragePoolAvailable
+	ch <- e.libvirtStorageVolumeCapacity
+	ch <- e.libvirtStorageVolumeAllocation
 }
 
-// Collect scrapes Prometheus metrics from libvirt.
+// Update scrapes Prometheus metrics from all libvirt URIs. A failing URI
+// doesn't affect the metrics of the others.
 func (e *LibvirtExporter) Update(ch chan<- prometheus.Metric) error {
-	err := e.CollectFromLibvirt(ch)
-	if err == nil {
-		ch <- prometheus.MustNewConstMetric(
-			e.libvirtUpDesc,
-			prometheus.GaugeValue,
-			1.0)
-	} else {
-		log.Printf("Failed to scrape metrics: %s", err)
+	var failed []string
+	for _, uri := range e.uris {
+		// Subscribe first, so that no events are missed between the scrape
+		// and the subscription.
+		if w, ok := e.lifecycleWatchers[uri]; ok {
+			if err := w.connect(); err != nil {
+				log.Errorf("Failed to subscribe to libvirt lifecycle events of %s: %s", uri, err)
+			}
+		}
+		err := e.CollectFromLibvirt(ch, uri)
+		if err == nil {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtUpDesc,
+				prometheus.GaugeValue,
+				1.0,
+				uri)
+			continue
+		}
+		log.Errorf("Failed to scrape libvirt metrics from %s: %s", uri, err)
 		ch <- prometheus.MustNewConstMetric(
 			e.libvirtUpDesc,
 			prometheus.GaugeValue,
-			0.0)
-		return err
+			0.0,
+			uri)
+		failed = append(failed, uri)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to scrape libvirt metrics from %s", strings.Join(failed, ", "))
 	}
 	return nil
 }
 
-// CollectFromLibvirt obtains Prometheus metrics from all domains in a
-// libvirt setup.
-func (e *LibvirtExporter) CollectFromLibvirt(ch chan<- prometheus.Metric) error {
-	conn, err := libvirt.NewConnect(e.uri)
+// CollectFromLibvirt obtains Prometheus metrics from all domains of the
+// libvirt setup at uri. The statistics of all active domains are read with a
+// single bulk call, inactive domains are reported with their definition.
+func (e *LibvirtExporter) CollectFromLibvirt(ch chan<- prometheus.Metric, uri string) error {
+	conn, err := e.driver.Connect(uri)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	// Use ListDomains() as opposed to using ListAllDomains(), as
-	// the latter is unsupported when talking to a system using
-	// libvirt 0.9.12 or older.
-	domainIds, err := conn.ListDomains()
+	active, err := conn.NumOfDomains()
 	if err != nil {
 		return err
 	}
 	ch <- prometheus.MustNewConstMetric(
 		e.libvirtDomainActive,
 		prometheus.GaugeValue,
-		float64(len(domainIds)))
-
-	//allDomain, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE | libvirt.CONNECT_LIST_DOMAINS_INACTIVE)
-	allDomain, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_INACTIVE)
+		float64(active),
+		uri)
+	inactive, err := conn.NumOfDefinedDomains()
 	if err != nil {
 		return err
 	}
 	ch <- prometheus.MustNewConstMetric(
 		e.libvirtDomainTotal,
 		prometheus.GaugeValue,
-		float64(len(allDomain)+len(domainIds)))
-	for _, ad := range allDomain {
-		ad.Free()
+		float64(active+inactive),
+		uri)
+
+	stats, err := conn.GetAllDomainStats()
+	if err != nil {
+		return err
 	}
+	defer func() {
+		for _, stat := range stats {
+			stat.Domain.Free()
+		}
+	}()
 
-	for _, id := range domainIds {
-		domain, err := conn.LookupDomainById(id)
-		if err == nil {
-			err = e.CollectDomain(ch, domain)
+	// The domains which volumes are attached to are only needed for the
+	// volume metrics.
+	var owners *volumeOwners
+	if e.exportVolumes {
+		owners = newVolumeOwners()
+	}
+
+	// An error only skips the affected domain, so that a single domain can't
+	// hide all others.
+	seen := make(map[string]bool, len(stats))
+	for i := range stats {
+		uuid, err := e.CollectDomain(ch, uri, &stats[i], owners)
+		if err != nil {
+			e.skipDomain(uri, err)
+			continue
+		}
+		seen[uuid] = true
+	}
+	e.xmlCache.prune(uri, seen)
+
+	domains, err := conn.ListInactiveDomains()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, domain := range domains {
 			domain.Free()
-			if err != nil {
-				return err
-			}
 		}
+	}()
+	for _, domain := range domains {
+		uuid, err := e.CollectInactiveDomain(ch, uri, domain, owners)
+		if err != nil {
+			e.skipDomain(uri, err)
+			continue
+		}
+		seen[uuid] = true
 	}
 
+	e.collectNode(ch, uri, conn, stats)
+
+	if err := e.collectStoragePools(ch, uri, conn, owners); err != nil {
+		return err
+	}
+
+	e.sendDomainErrors(ch, uri)
+	if w, ok := e.lifecycleWatchers[uri]; ok {
+		w.collect(ch, e.libvirtDomainLifecycleEvents, seen)
+	}
 	return nil
 }
 
-// CollectDomain extracts Prometheus metrics from a libvirt domain.
-func (e *LibvirtExporter) CollectDomain(ch chan<- prometheus.Metric, domain *libvirt.Domain) error {
-	// Decode XML description of domain to get block device names, etc.
-	xmlDesc, err := domain.GetXMLDesc(0)
+// skipDomain logs and counts a domain of uri which failed to be scraped.
+func (e *LibvirtExporter) skipDomain(uri string, err error) {
+	reason := domainErrorLookup
+	if derr, ok := err.(domainScrapeError); ok {
+		reason = derr.reason
+	}
+	log.Warnf("Skipping libvirt domain of %s: %s", uri, err)
+	e.countDomainError(uri, reason)
+}
+
+// Close stops the subscriptions to lifecycle events.
+func (e *LibvirtExporter) Close() error {
+	for _, w := range e.lifecycleWatchers {
+		w.close()
+	}
+	return nil
+}
+
+// countDomainError counts a domain of uri which was skipped for reason.
+func (e *LibvirtExporter) countDomainError(uri, reason string) {
+	e.domainErrorsMtx.Lock()
+	defer e.domainErrorsMtx.Unlock()
+	e.domainErrorCounts(uri)[reason]++
+}
+
+// sendDomainErrors sends the number of skipped domains of uri for all
+// reasons.
+func (e *LibvirtExporter) sendDomainErrors(ch chan<- prometheus.Metric, uri string) {
+	e.domainErrorsMtx.Lock()
+	defer e.domainErrorsMtx.Unlock()
+	for reason, count := range e.domainErrorCounts(uri) {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainScrapeErrors,
+			prometheus.CounterValue,
+			count,
+			uri, reason)
+	}
+}
+
+// domainErrorCounts returns the error counts of uri, initialized with all
+// reasons. domainErrorsMtx must be held.
+func (e *LibvirtExporter) domainErrorCounts(uri string) map[string]float64 {
+	counts, ok := e.domainErrors[uri]
+	if !ok {
+		counts = map[string]float64{
+			domainErrorNotFound: 0,
+			domainErrorLookup:   0,
+			domainErrorXML:      0,
+		}
+		e.domainErrors[uri] = counts
+	}
+	return counts
+}
+
+// CollectDomain extracts Prometheus metrics from the bulk statistics of a
+// domain of the libvirt setup at uri and returns the UUID of the domain. The
+// disks of the domain are added to owners, if not nil.
+func (e *LibvirtExporter) CollectDomain(ch chan<- prometheus.Metric, uri string, stats *libvirtDomainStats, owners *volumeOwners) (string, error) {
+	domain := stats.Domain
+	domainName, err := domain.GetName()
 	if err != nil {
-		return err
+		return "", newDomainScrapeError(domainErrorLookup, err)
 	}
-	var desc Domain
-	err = xml.Unmarshal([]byte(xmlDesc), &desc)
+	domainUUID, err := domain.GetUUIDString()
 	if err != nil {
-		return err
+		return "", newDomainScrapeError(domainErrorLookup, err)
 	}
-	domainName, err := domain.GetName()
+	// The XML description is only read again if the domain was restarted or
+	// devices were attached which it doesn't know about yet.
+	desc, err := e.xmlCache.get(uri, domainUUID, domain, func(desc *Domain) bool {
+		for _, block := range stats.Blocks {
+			if desc.disk(block.Name) == nil {
+				return false
+			}
+		}
+		for _, net := range stats.Nets {
+			if desc.iface(net.Name) == nil {
+				return false
+			}
+		}
+		return true
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	var domainUUID = desc.UUID
 
-	// Extract domain label valuies
-	var domainLabelValues []string
-	if e.exportNovaMetadata {
-		var (
-			novaName        = desc.Metadata.NovaInstance.Name
-			novaFlavor      = desc.Metadata.NovaInstance.Flavor.Name
-			novaProjectName = desc.Metadata.NovaInstance.Owner.ProjectName
-		)
-		domainLabelValues = []string{domainName, domainUUID, novaName, novaFlavor, novaProjectName}
-	} else {
-		domainLabelValues = []string{domainName, domainUUID}
-	}
+	owners.add(domainName, domainUUID, desc)
+	domainLabelValues := e.domainLabelValues(uri, domainName, domainUUID, desc)
 
 	// Report domain info.
-	info, err := domain.GetInfo()
-	if err != nil {
-		return err
+	if stats.State != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainInfoDomainState,
+			prometheus.GaugeValue,
+			float64(*stats.State),
+			domainLabelValues...)
+	}
+	b := stats.Balloon
+	if b.Maximum != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainInfoMaxMemDesc,
+			prometheus.GaugeValue,
+			float64(*b.Maximum)*1024,
+			domainLabelValues...)
+	}
+	if b.Current != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainInfoMemoryDesc,
+			prometheus.GaugeValue,
+			float64(*b.Current)*1024,
+			domainLabelValues...)
+	}
+	var (
+		vcpuTime    uint64
+		vcpuTimeSet bool
+	)
+	for _, vcpu := range stats.Vcpus {
+		if vcpu.Time != nil {
+			vcpuTime += *vcpu.Time
+			vcpuTimeSet = true
+		}
 	}
-	ch <- prometheus.MustNewConstMetric(
-		e.libvirtDomainInfoDomainState,
-		prometheus.GaugeValue,
-		float64(info.State),
-		domainLabelValues...)
-	ch <- prometheus.MustNewConstMetric(
-		e.libvirtDomainInfoMaxMemDesc,
-		prometheus.GaugeValue,
-		float64(info.MaxMem)*1024,
-		domainLabelValues...)
-	ch <- prometheus.MustNewConstMetric(
-		e.libvirtDomainInfoMemoryDesc,
-		prometheus.GaugeValue,
-		float64(info.Memory)*1024,
-		domainLabelValues...)
 	ch <- prometheus.MustNewConstMetric(
 		e.libvirtDomainInfoNrVirtCpuDesc,
 		prometheus.GaugeValue,
-		float64(info.NrVirtCpu),
-		domainLabelValues...)
-	ch <- prometheus.MustNewConstMetric(
-		e.libvirtDomainInfoCpuTimeDesc,
-		prometheus.CounterValue,
-		float64(info.CpuTime)/1e9,
+		float64(onlineVcpus(stats.Vcpus)),
 		domainLabelValues...)
 
 	// Report cpu statistics
-	// -1返回的是整个虚机的cpu统计信息,因此虽然是个数组，但是只有1个
-	cpuStates, err := domain.GetCPUStats(-1, 0, 0)
-	if err != nil {
-		return err
-	}
-	cpuState := cpuStates[0]
-	if cpuState.CpuTimeSet {
+	c := stats.CPU
+	if c.Time != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainInfoCpuTimeDesc,
+			prometheus.CounterValue,
+			float64(*c.Time)/1e9,
+			domainLabelValues...)
 		ch <- prometheus.MustNewConstMetric(
 			e.libvirtDomainCpuCpuTime,
 			prometheus.CounterValue,
-			float64(cpuState.CpuTime),
-			append(domainLabelValues)...)
+			float64(*c.Time),
+			domainLabelValues...)
 	}
-	if cpuState.SystemTimeSet {
+	if c.System != nil {
 		ch <- prometheus.MustNewConstMetric(
 			e.libvirtDomainCpuSystemTime,
 			prometheus.CounterValue,
-			float64(cpuState.SystemTime),
-			append(domainLabelValues)...)
+			float64(*c.System),
+			domainLabelValues...)
 	}
-	if cpuState.UserTimeSet {
+	if c.User != nil {
 		ch <- prometheus.MustNewConstMetric(
 			e.libvirtDomainCpuUserTime,
 			prometheus.CounterValue,
-			float64(cpuState.UserTime),
-			append(domainLabelValues)...)
+			float64(*c.User),
+			domainLabelValues...)
 	}
-	if cpuState.VcpuTimeSet {
+	if vcpuTimeSet {
 		ch <- prometheus.MustNewConstMetric(
 			e.libvirtDomainCpuVcpuTime,
 			prometheus.CounterValue,
-			float64(cpuState.VcpuTime),
-			append(domainLabelValues)...)
+			float64(vcpuTime),
+			domainLabelValues...)
 	}
 
-	// Report memory statistics
-	memStats, err := domain.MemoryStats(15, 0) // 15 DOMAIN_MEMORY_STAT totally,flags not used.
-	if err != nil {
-		return err
+	// Report vcpu statistics. The bulk statistics are indexed by vCPU number.
+	for i, vcpu := range stats.Vcpus {
+		vcpuLabelValues := append(append([]string{}, domainLabelValues...), strconv.Itoa(i))
+		if vcpu.State != nil {
+			ch <- prometheus.MustNewConstMetric(e.libvirtDomainVcpuState, prometheus.GaugeValue, float64(*vcpu.State), vcpuLabelValues...)
+		}
+		for _, m := range []struct {
+			value     *uint64
+			desc      *prometheus.Desc
+			valueType prometheus.ValueType
+		}{
+			{vcpu.Time, e.libvirtDomainVcpuTime, prometheus.CounterValue},
+			{vcpu.Wait, e.libvirtDomainVcpuWait, prometheus.CounterValue},
+		} {
+			if m.value != nil {
+				ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, float64(*m.value)/1e9, vcpuLabelValues...)
+			}
+		}
 	}
-	// see https://libvirt.org/html/libvirt-libvirt-domain.html#VIR_DOMAIN_MEMORY_STAT_UNUSED
-	for _, memStat := range memStats {
-		switch memStat.Tag {
-		case 4:
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainMemUnused,
-				prometheus.GaugeValue,
-				float64(memStat.Val),
-				append(domainLabelValues)...)
-		case 5:
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainMemAvailable,
-				prometheus.GaugeValue,
-				float64(memStat.Val),
-				append(domainLabelValues)...)
-		case 7:
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainMemRss,
-				prometheus.GaugeValue,
-				float64(memStat.Val),
-				append(domainLabelValues)...)
-		case 8:
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainMemUsable,
-				prometheus.GaugeValue,
-				float64(memStat.Val),
-				append(domainLabelValues)...)
-		case 9:
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainMemLastUpdate,
-				prometheus.GaugeValue,
-				float64(memStat.Val),
-				append(domainLabelValues)...)
-		default:
-			// no need to do
+	if e.exportVcpus {
+		e.collectVcpuPlacement(ch, domain, domainName, stats.Vcpus, domainLabelValues)
+	}
+	e.collectDeviceInfo(ch, desc, domainLabelValues)
+
+	// Report memory statistics
+	for _, m := range []struct {
+		value *uint64
+		desc  *prometheus.Desc
+	}{
+		{b.Unused, e.libvirtDomainMemUnused},
+		{b.Available, e.libvirtDomainMemAvailable},
+		{b.Rss, e.libvirtDomainMemRss},
+		{b.Usable, e.libvirtDomainMemUsable},
+		{b.LastUpdate, e.libvirtDomainMemLastUpdate},
+	} {
+		if m.value != nil {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(*m.value), domainLabelValues...)
 		}
 	}
 
 	// Report block device statistics.
-	for _, disk := range desc.Devices.Disks {
+	for _, block := range stats.Blocks {
+		disk := desc.disk(block.Name)
+		if disk == nil {
+			log.Debugf("Skipping block device %q of domain %s, it's not in the domain XML", block.Name, domainName)
+			continue
+		}
 		if disk.Device == "cdrom" || disk.Device == "fd" {
 			continue
 		}
-		blockStats, err := domain.BlockStats(disk.Target.Device)
-		if err != nil {
-			return err
+		blockLabelValues := append(append([]string{}, domainLabelValues...), block.Path, block.Name)
+		for _, m := range []struct {
+			value     *uint64
+			scale     float64
+			desc      *prometheus.Desc
+			valueType prometheus.ValueType
+		}{
+			{block.Capacity, 1, e.libvirtDomainBlockCapacity, prometheus.GaugeValue},
+			{block.Allocation, 1, e.libvirtDomainBlockAllocation, prometheus.GaugeValue},
+			{block.Physical, 1, e.libvirtDomainBlockPhysical, prometheus.GaugeValue},
+			{block.RdBytes, 1, e.libvirtDomainBlockRdBytesDesc, prometheus.CounterValue},
+			{block.RdReqs, 1, e.libvirtDomainBlockRdReqDesc, prometheus.CounterValue},
+			{block.RdTimes, 1e-9, e.libvirtDomainBlockRdTotalTimesDesc, prometheus.CounterValue},
+			{block.WrBytes, 1, e.libvirtDomainBlockWrBytesDesc, prometheus.CounterValue},
+			{block.WrReqs, 1, e.libvirtDomainBlockWrReqDesc, prometheus.CounterValue},
+			{block.WrTimes, 1e-9, e.libvirtDomainBlockWrTotalTimesDesc, prometheus.CounterValue},
+			{block.FlReqs, 1, e.libvirtDomainBlockFlushReqDesc, prometheus.CounterValue},
+			{block.FlTimes, 1e-9, e.libvirtDomainBlockFlushTotalTimesDesc, prometheus.CounterValue},
+		} {
+			if m.value != nil {
+				ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, float64(*m.value)*m.scale, blockLabelValues...)
+			}
 		}
+		// Skip "Errors", as the documentation does not clearly
+		// explain what this means.
 
-		//block total info
-		blockInfo, err := domain.GetBlockInfo(disk.Target.Device, 0)
-		if err != nil {
-			return err
-		}
-		ch <- prometheus.MustNewConstMetric(
-			e.libvirtDomainBlockCapacity,
-			prometheus.GaugeValue,
-			float64(blockInfo.Capacity),
-			append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
-		ch <- prometheus.MustNewConstMetric(
-			e.libvirtDomainBlockAllocation,
-			prometheus.GaugeValue,
-			float64(blockInfo.Allocation),
-			append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
-		ch <- prometheus.MustNewConstMetric(
-			e.libvirtDomainBlockPhysical,
-			prometheus.GaugeValue,
-			float64(blockInfo.Physical),
-			append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
+		e.collectBlockIoTune(ch, disk.IOTune, blockLabelValues)
+	}
 
-		//block rx info.
-		if blockStats.RdBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockRdBytesDesc,
-				prometheus.CounterValue,
-				float64(blockStats.RdBytes),
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
-		}
-		if blockStats.RdReqSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockRdReqDesc,
-				prometheus.CounterValue,
-				float64(blockStats.RdReq),
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
-		}
-		if blockStats.RdTotalTimesSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockRdTotalTimesDesc,
-				prometheus.CounterValue,
-				float64(blockStats.RdTotalTimes)/1e9,
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
-		}
-		if blockStats.WrBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockWrBytesDesc,
-				prometheus.CounterValue,
-				float64(blockStats.WrBytes),
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
-		}
-		if blockStats.WrReqSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockWrReqDesc,
-				prometheus.CounterValue,
-				float64(blockStats.WrReq),
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
+	// Report network interface statistics.
+	for _, net := range stats.Nets {
+		iface := desc.iface(net.Name)
+		if iface == nil {
+			log.Debugf("Skipping interface %q of domain %s, it's not in the domain XML", net.Name, domainName)
+			continue
 		}
-		if blockStats.WrTotalTimesSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockWrTotalTimesDesc,
-				prometheus.CounterValue,
-				float64(blockStats.WrTotalTimes)/1e9,
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
+		ifaceLabelValues := append(append([]string{}, domainLabelValues...), iface.Source.Bridge, net.Name)
+		for _, m := range []struct {
+			value *uint64
+			desc  *prometheus.Desc
+		}{
+			{net.RxBytes, e.libvirtDomainInterfaceRxBytesDesc},
+			{net.RxPkts, e.libvirtDomainInterfaceRxPacketsDesc},
+			{net.RxErrs, e.libvirtDomainInterfaceRxErrsDesc},
+			{net.RxDrop, e.libvirtDomainInterfaceRxDropDesc},
+			{net.TxBytes, e.libvirtDomainInterfaceTxBytesDesc},
+			{net.TxPkts, e.libvirtDomainInterfaceTxPacketsDesc},
+			{net.TxErrs, e.libvirtDomainInterfaceTxErrsDesc},
+			{net.TxDrop, e.libvirtDomainInterfaceTxDropDesc},
+		} {
+			if m.value != nil {
+				ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, float64(*m.value), ifaceLabelValues...)
+			}
 		}
-		if blockStats.FlushReqSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockFlushReqDesc,
-				prometheus.CounterValue,
-				float64(blockStats.FlushReq),
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
+
+		e.collectInterfaceBandwidth(ch, iface.Bandwidth, ifaceLabelValues)
+	}
+
+	return domainUUID, nil
+}
+
+// CollectInactiveDomain extracts Prometheus metrics from the definition of an
+// inactive domain of the libvirt setup at uri and returns the UUID of the
+// domain. The disks of the domain are added to owners, if not nil.
+func (e *LibvirtExporter) CollectInactiveDomain(ch chan<- prometheus.Metric, uri string, domain libvirtDomain, owners *volumeOwners) (string, error) {
+	domainName, err := domain.GetName()
+	if err != nil {
+		return "", newDomainScrapeError(domainErrorLookup, err)
+	}
+	domainUUID, err := domain.GetUUIDString()
+	if err != nil {
+		return "", newDomainScrapeError(domainErrorLookup, err)
+	}
+	// Inactive domains have no ID, so their XML description isn't cached.
+	desc, err := readDomainXML(domain)
+	if err != nil {
+		return "", err
+	}
+	info, err := domain.GetInfo()
+	if err != nil {
+		return "", newDomainScrapeError(domainErrorLookup, err)
+	}
+	autostart, err := domain.GetAutostart()
+	if err != nil {
+		return "", newDomainScrapeError(domainErrorLookup, err)
+	}
+
+	owners.add(domainName, domainUUID, desc)
+	domainLabelValues := e.domainLabelValues(uri, domainName, domainUUID, desc)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainInfoDomainState,
+		prometheus.GaugeValue,
+		float64(info.State),
+		domainLabelValues...)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainInfoMaxMemDesc,
+		prometheus.GaugeValue,
+		float64(info.MaxMem)*1024,
+		domainLabelValues...)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainInfoNrVirtCpuDesc,
+		prometheus.GaugeValue,
+		float64(info.NrVirtCpu),
+		domainLabelValues...)
+	var autostartValue float64
+	if autostart {
+		autostartValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainInfoAutostart,
+		prometheus.GaugeValue,
+		autostartValue,
+		domainLabelValues...)
+
+	return domainUUID, nil
+}
+
+// domainLabelValues returns the label values of a domain, they have to match
+// the labels set up in NewLibvirtExporter.
+func (e *LibvirtExporter) domainLabelValues(uri, name, uuid string, desc *Domain) []string {
+	values := []string{uri, name, uuid}
+	for _, l := range e.metadataLabels {
+		values = append(values, desc.tree.lookup(l.path))
+	}
+	return values
+}
+
+// collectVcpuPlacement reports the host CPU every online vCPU of domain runs
+// on and the host CPUs it is pinned to. They are taken from the vCPU
+// statistics if the driver reports them there, otherwise they are read
+// separately, and failing to read them doesn't skip the domain.
+func (e *LibvirtExporter) collectVcpuPlacement(ch chan<- prometheus.Metric, domain libvirtDomain, domainName string, stats []libvirtVcpuStats, domainLabelValues []string) {
+	vcpus := vcpuPlacement(stats)
+	if vcpus == nil {
+		var err error
+		if vcpus, err = domain.GetVcpus(); err != nil {
+			log.Debugf("Failed to read the vCPUs of domain %s: %s", domainName, err)
+			return
 		}
-		if blockStats.FlushTotalTimesSet {
+	}
+	for _, vcpu := range vcpus {
+		vcpuLabelValues := append(append([]string{}, domainLabelValues...), strconv.Itoa(int(vcpu.Number)))
+		if vcpu.Cpu >= 0 {
 			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainBlockFlushTotalTimesDesc,
-				prometheus.CounterValue,
-				float64(blockStats.FlushTotalTimes)/1e9,
-				append(domainLabelValues, disk.Source.File, disk.Target.Device)...)
+				e.libvirtDomainVcpuCpu,
+				prometheus.GaugeValue,
+				float64(vcpu.Cpu),
+				vcpuLabelValues...)
 		}
-		// Skip "Errs", as the documentation does not clearly
-		// explain what this means.
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainVcpuPinning,
+			prometheus.GaugeValue,
+			1,
+			append(vcpuLabelValues, formatCPUSet(vcpu.CpuMap))...)
 	}
+}
 
-	// Report network interface statistics.
-	for _, iface := range desc.Devices.Interfaces {
-		if iface.Target.Device == "" {
+// vcpuPlacement returns the placement of the online vCPUs in the vCPU
+// statistics, or nil if it's missing for any of them.
+func vcpuPlacement(stats []libvirtVcpuStats) []libvirtVcpuInfo {
+	vcpus := make([]libvirtVcpuInfo, 0, len(stats))
+	for i, vcpu := range stats {
+		if vcpu.State != nil && *vcpu.State == libvirtVcpuOffline {
 			continue
 		}
-		interfaceStats, err := domain.InterfaceStats(iface.Target.Device)
-		if err != nil {
-			return err
+		if vcpu.Cpu == nil || vcpu.CpuMap == nil {
+			return nil
 		}
+		vcpus = append(vcpus, libvirtVcpuInfo{Number: uint32(i), Cpu: int32(*vcpu.Cpu), CpuMap: vcpu.CpuMap})
+	}
+	return vcpus
+}
 
-		// network rx state
-		if interfaceStats.RxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceRxBytesDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.RxBytes),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
-		}
-		if interfaceStats.RxPacketsSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceRxPacketsDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.RxPackets),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
+// collectBlockIoTune reports the throttling of a block device, as in the
+// domain XML. Limits of zero mean unlimited and aren't reported.
+func (e *LibvirtExporter) collectBlockIoTune(ch chan<- prometheus.Metric, tune DiskIOTune, blockLabelValues []string) {
+	for _, m := range []struct {
+		value     uint64
+		desc      *prometheus.Desc
+		operation string
+	}{
+		{tune.ReadBytesSec, e.libvirtDomainBlockLimitBytes, "read"},
+		{tune.WriteBytesSec, e.libvirtDomainBlockLimitBytes, "write"},
+		{tune.TotalBytesSec, e.libvirtDomainBlockLimitBytes, "total"},
+		{tune.ReadIopsSec, e.libvirtDomainBlockLimitRequests, "read"},
+		{tune.WriteIopsSec, e.libvirtDomainBlockLimitRequests, "write"},
+		{tune.TotalIopsSec, e.libvirtDomainBlockLimitRequests, "total"},
+	} {
+		if m.value > 0 {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(m.value), append(blockLabelValues, m.operation)...)
 		}
-		if interfaceStats.RxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceRxErrsDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.RxErrs),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
-		}
-		if interfaceStats.RxDropSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceRxDropDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.RxDrop),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
+	}
+}
+
+// collectInterfaceBandwidth reports the bandwidth limits of a network
+// interface, as in the domain XML. Limits of zero mean unlimited and aren't
+// reported.
+func (e *LibvirtExporter) collectInterfaceBandwidth(ch chan<- prometheus.Metric, bandwidth InterfaceBandwidth, ifaceLabelValues []string) {
+	// libvirt has the bandwidth in KiB/s and the burst in KiB.
+	for _, m := range []struct {
+		value     uint64
+		desc      *prometheus.Desc
+		direction string
+	}{
+		{bandwidth.Inbound.Average, e.libvirtDomainInterfaceBandwidthAverage, "in"},
+		{bandwidth.Inbound.Peak, e.libvirtDomainInterfaceBandwidthPeak, "in"},
+		{bandwidth.Inbound.Burst, e.libvirtDomainInterfaceBandwidthBurst, "in"},
+		{bandwidth.Outbound.Average, e.libvirtDomainInterfaceBandwidthAverage, "out"},
+		{bandwidth.Outbound.Peak, e.libvirtDomainInterfaceBandwidthPeak, "out"},
+		{bandwidth.Outbound.Burst, e.libvirtDomainInterfaceBandwidthBurst, "out"},
+	} {
+		if m.value > 0 {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(m.value)*1024, append(ifaceLabelValues, m.direction)...)
 		}
-		if interfaceStats.TxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceTxBytesDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.TxBytes),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
+	}
+}
+
+// collectDeviceInfo reports the host devices of the disks and interfaces of a
+// domain.
+func (e *LibvirtExporter) collectDeviceInfo(ch chan<- prometheus.Metric, desc *Domain, domainLabelValues []string) {
+	for _, disk := range desc.Devices.Disks {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainDeviceInfo,
+			prometheus.GaugeValue,
+			1,
+			append(append([]string{}, domainLabelValues...), "disk", hostBlockDevice(disk.Source.Dev), disk.Target.Device, disk.Source.path())...)
+	}
+	for _, iface := range desc.Devices.Interfaces {
+		// The target of an interface is the tap device on the host.
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainDeviceInfo,
+			prometheus.GaugeValue,
+			1,
+			append(append([]string{}, domainLabelValues...), "interface", iface.Target.Device, iface.Target.Device, iface.Source.name())...)
+	}
+}
+
+// hostBlockDevice returns the kernel name of the block device at path, e.g.
+// dm-7 for an LVM volume, or "" if path isn't a local block device. Only
+// devices of the host the exporter runs on can be resolved.
+func hostBlockDevice(path string) string {
+	if path == "" {
+		return ""
+	}
+	resolved, err := filepath.EvalSymlinks(rootfsFilePath(path))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(resolved)
+}
+
+// formatCPUSet formats a CPU map in the cpuset list format of libvirt and
+// Linux, e.g. "0-3,8".
+func formatCPUSet(cpuMap []bool) string {
+	var ranges []string
+	for i := 0; i < len(cpuMap); i++ {
+		if !cpuMap[i] {
+			continue
 		}
-		if interfaceStats.TxPacketsSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceTxPacketsDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.TxPackets),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
+		j := i
+		for j+1 < len(cpuMap) && cpuMap[j+1] {
+			j++
 		}
-		if interfaceStats.TxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceTxErrsDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.TxErrs),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(i))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", i, j))
 		}
-		if interfaceStats.TxDropSet {
-			ch <- prometheus.MustNewConstMetric(
-				e.libvirtDomainInterfaceTxDropDesc,
-				prometheus.CounterValue,
-				float64(interfaceStats.TxDrop),
-				append(domainLabelValues, iface.Source.Bridge, iface.Target.Device)...)
+		i = j
+	}
+	return strings.Join(ranges, ",")
+}
+
+// domainXMLCache caches the parsed XML descriptions of domains by URI, UUID
+// and domain ID. libvirt doesn't expose a generation of the description, but a
+// domain gets a new ID whenever it is started, which covers most changes.
+// Changes of running domains, like their metadata or title, are picked up once
+// the description is older than ttl, or right away if a defined event of the
+// domain invalidates it.
+type domainXMLCache struct {
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[string]map[string]cachedDomainXML
+}
+
+type cachedDomainXML struct {
+	id   uint
+	read time.Time
+	desc *Domain
+}
+
+// get returns the parsed XML description of domain. A cached description is
+// only used if the domain ID didn't change, it's younger than the TTL and
+// valid returns true for it.
+func (c *domainXMLCache) get(uri, uuid string, domain libvirtDomain, valid func(*Domain) bool) (*Domain, error) {
+	id, err := domain.GetID()
+	if err != nil {
+		return nil, newDomainScrapeError(domainErrorLookup, err)
+	}
+
+	c.mtx.Lock()
+	cached, ok := c.entries[uri][uuid]
+	c.mtx.Unlock()
+	if ok && cached.id == id && time.Since(cached.read) < c.ttl && valid(cached.desc) {
+		return cached.desc, nil
+	}
+
+	desc, err := readDomainXML(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]map[string]cachedDomainXML{}
+	}
+	if c.entries[uri] == nil {
+		c.entries[uri] = map[string]cachedDomainXML{}
+	}
+	c.entries[uri][uuid] = cachedDomainXML{id: id, read: time.Now(), desc: desc}
+	return desc, nil
+}
+
+// invalidate drops the description of a domain, e.g. because it was
+// redefined.
+func (c *domainXMLCache) invalidate(uri, uuid string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.entries[uri], uuid)
+}
+
+// prune drops the descriptions of all domains of uri not in seen.
+func (c *domainXMLCache) prune(uri string, seen map[string]bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for uuid := range c.entries[uri] {
+		if !seen[uuid] {
+			delete(c.entries[uri], uuid)
 		}
 	}
+}
 
-	return nil
+// readDomainXML reads and parses the XML description of domain.
+func readDomainXML(domain libvirtDomain) (*Domain, error) {
+	xmlDesc, err := domain.GetXMLDesc()
+	if err != nil {
+		return nil, newDomainScrapeError(domainErrorXML, err)
+	}
+	var desc Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &desc); err != nil {
+		return nil, newDomainScrapeError(domainErrorXML, err)
+	}
+	// The generic tree is used for the metadata labels.
+	if err := xml.Unmarshal([]byte(xmlDesc), &desc.tree); err != nil {
+		return nil, newDomainScrapeError(domainErrorXML, err)
+	}
+	return &desc, nil
 }
@@ -0,0 +1,231 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFormatCPUSet(t *testing.T) {
+	for _, tt := range []struct {
+		cpuMap []bool
+		want   string
+	}{
+		{nil, ""},
+		{[]bool{false, false}, ""},
+		{[]bool{true, true, true, true}, "0-3"},
+		{[]bool{false, true, false, true, true, false, false, false, true}, "1,3-4,8"},
+	} {
+		if got := formatCPUSet(tt.cpuMap); got != tt.want {
+			t.Errorf("formatCPUSet(%v): want %q, got %q", tt.cpuMap, tt.want, got)
+		}
+	}
+}
+
+func TestVcpuPlacement(t *testing.T) {
+	online, offline, cpu := 1, libvirtVcpuOffline, 3
+	cpuMap := []bool{false, false, false, true}
+	for _, tt := range []struct {
+		name  string
+		stats []libvirtVcpuStats
+		want  []libvirtVcpuInfo
+	}{
+		{"no vCPUs", nil, []libvirtVcpuInfo{}},
+		{"placement", []libvirtVcpuStats{
+			{State: &offline},
+			{State: &online, Cpu: &cpu, CpuMap: cpuMap},
+		}, []libvirtVcpuInfo{{Number: 1, Cpu: 3, CpuMap: cpuMap}}},
+		{"missing placement", []libvirtVcpuStats{
+			{State: &online, Cpu: &cpu, CpuMap: cpuMap},
+			{State: &online},
+		}, nil},
+	} {
+		if got := vcpuPlacement(tt.stats); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestHostBlockDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "dm-7"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// LVM links the logical volumes to the device mapper devices.
+	if err := os.Symlink("dm-7", filepath.Join(dir, "lv0")); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"":                         "",
+		filepath.Join(dir, "lv0"):  "dm-7",
+		filepath.Join(dir, "dm-7"): "dm-7",
+		filepath.Join(dir, "nope"): "",
+	} {
+		if got := hostBlockDevice(path); got != want {
+			t.Errorf("%q: want %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestLibvirtExporter(t *testing.T) {
+	for flag, value := range map[*string]string{
+		libvirtFixtures:       "fixtures/libvirt",
+		libvirtURIs:           "qemu:///system",
+		libvirtMetadataLabels: "",
+	} {
+		defer func(flag *string, old string) { *flag = old }(flag, *flag)
+		*flag = value
+	}
+	for flag, value := range map[*bool]bool{
+		libvirtNovaMetadata:    true,
+		libvirtLifecycleEvents: true,
+		libvirtStorageVolumes:  true,
+	} {
+		defer func(flag *bool, old bool) { *flag = old }(flag, *flag)
+		*flag = value
+	}
+
+	c, err := NewLibvirtExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorAdapter{c})
+
+	want := `# HELP libvirt_up Whether scraping libvirt's metrics was successful.
+# TYPE libvirt_up gauge
+libvirt_up{hypervisor_uri="qemu:///system"} 1
+# HELP libvirt_total the number of active and inactive domains (total).
+# TYPE libvirt_total gauge
+libvirt_total{hypervisor_uri="qemu:///system"} 3
+# HELP libvirt_domain_info_domain_state the state of the domain.
+# TYPE libvirt_domain_info_domain_state gauge
+libvirt_domain_info_domain_state{domain="backup",flavor="",hypervisor_uri="qemu:///system",name="",project_name="",uuid="9d3f5a7c-1e2b-4d6f-8a0c-3e5f7a9b1c2d"} 5
+libvirt_domain_info_domain_state{domain="instance-00000001",flavor="m1.small",hypervisor_uri="qemu:///system",name="web-1",project_name="demo-project",uuid="b6f8d8a2-4d4e-4a57-9a0c-2f1c0e6e3f01"} 1
+libvirt_domain_info_domain_state{domain="web",flavor="",hypervisor_uri="qemu:///system",name="",project_name="",uuid="5c1e8f3a-9d2b-4c6e-8a7f-1b3d5e7f9a0c"} 3
+# HELP libvirt_domain_lifecycle_events_total Number of lifecycle events of the domain since the exporter subscribed to them, by event.
+# TYPE libvirt_domain_lifecycle_events_total counter
+libvirt_domain_lifecycle_events_total{domain="deleted",event="undefined",hypervisor_uri="qemu:///system",uuid="0f0e0d0c-0b0a-4908-8706-050403020100"} 1
+libvirt_domain_lifecycle_events_total{domain="instance-00000001",event="crashed",hypervisor_uri="qemu:///system",uuid="b6f8d8a2-4d4e-4a57-9a0c-2f1c0e6e3f01"} 1
+libvirt_domain_lifecycle_events_total{domain="instance-00000001",event="started",hypervisor_uri="qemu:///system",uuid="b6f8d8a2-4d4e-4a57-9a0c-2f1c0e6e3f01"} 2
+libvirt_domain_lifecycle_events_total{domain="web",event="started",hypervisor_uri="qemu:///system",uuid="5c1e8f3a-9d2b-4c6e-8a7f-1b3d5e7f9a0c"} 1
+# HELP libvirt_node_allocated_vcpus Number of online vCPUs of all active domains.
+# TYPE libvirt_node_allocated_vcpus gauge
+libvirt_node_allocated_vcpus{hypervisor_uri="qemu:///system"} 3
+# HELP libvirt_storage_volume_capacity_bytes Logical size of the storage volume, in bytes.
+# TYPE libvirt_storage_volume_capacity_bytes gauge
+libvirt_storage_volume_capacity_bytes{domain="",hypervisor_uri="qemu:///system",path="/var/lib/libvirt/images/unused.qcow2",pool="default",uuid="",volume="unused.qcow2"} 1.073741824e+10
+libvirt_storage_volume_capacity_bytes{domain="backup",hypervisor_uri="qemu:///system",path="/var/lib/libvirt/images/backup.qcow2",pool="default",uuid="9d3f5a7c-1e2b-4d6f-8a0c-3e5f7a9b1c2d",volume="backup.qcow2"} 1.073741824e+10
+libvirt_storage_volume_capacity_bytes{domain="instance-00000001",hypervisor_uri="qemu:///system",path="/var/lib/libvirt/images/instance-00000001.qcow2",pool="default",uuid="b6f8d8a2-4d4e-4a57-9a0c-2f1c0e6e3f01",volume="instance-00000001.qcow2"} 2.147483648e+10
+# HELP libvirt_domain_block_stats_limit_bytes_per_second Throttle of the bytes read, written or both of a block device, in bytes per second. Not reported for unlimited block devices.
+# TYPE libvirt_domain_block_stats_limit_bytes_per_second gauge
+libvirt_domain_block_stats_limit_bytes_per_second{domain="instance-00000001",flavor="m1.small",hypervisor_uri="qemu:///system",name="web-1",operation="total",project_name="demo-project",source_file="/var/lib/libvirt/images/instance-00000001.qcow2",target_device="vda",uuid="b6f8d8a2-4d4e-4a57-9a0c-2f1c0e6e3f01"} 1.048576e+08
+# HELP libvirt_domain_block_stats_limit_requests_per_second Throttle of the read, write or all requests of a block device, in requests per second. Not reported for unlimited block devices.
+# TYPE libvirt_domain_block_stats_limit_requests_per_second gauge
+libvirt_domain_block_stats_limit_requests_per_second{domain="instance-00000001",flavor="m1.small",hypervisor_uri="qemu:///system",name="web-1",operation="total",project_name="demo-project",source_file="/var/lib/libvirt/images/instance-00000001.qcow2",target_device="vda",uuid="b6f8d8a2-4d4e-4a57-9a0c-2f1c0e6e3f01"} 1000
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want),
+		"libvirt_up",
+		"libvirt_total",
+		"libvirt_domain_info_domain_state",
+		"libvirt_domain_lifecycle_events_total",
+		"libvirt_node_allocated_vcpus",
+		"libvirt_storage_volume_capacity_bytes",
+		"libvirt_domain_block_stats_limit_bytes_per_second",
+		"libvirt_domain_block_stats_limit_requests_per_second",
+	); err != nil {
+		t.Error(err)
+	}
+
+	// The counts of the undefined domain are dropped after they were sent.
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "libvirt_domain_lifecycle_events_total" && len(mf.Metric) != 3 {
+			t.Errorf("want the events of 3 domains, got %d", len(mf.Metric))
+		}
+	}
+}
+
+// countingDomain counts the reads of the XML description of a domain.
+type countingDomain struct {
+	*mockLibvirtDomain
+	reads int
+}
+
+func (d *countingDomain) GetXMLDesc() (string, error) {
+	d.reads++
+	return d.mockLibvirtDomain.GetXMLDesc()
+}
+
+func TestDomainXMLCache(t *testing.T) {
+	const uri, uuid = "qemu:///system", "5c1e8f3a-9d2b-4c6e-8a7f-1b3d5e7f9a0c"
+	domain := &countingDomain{mockLibvirtDomain: &mockLibvirtDomain{
+		fixtures: "fixtures/libvirt",
+		Name:     "web",
+		UUID:     uuid,
+		ID:       2,
+		Active:   true,
+	}}
+	valid := func(*Domain) bool { return true }
+	get := func(c *domainXMLCache) {
+		t.Helper()
+		if _, err := c.get(uri, uuid, domain, valid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &domainXMLCache{ttl: time.Hour}
+	get(c)
+	get(c)
+	if domain.reads != 1 {
+		t.Errorf("want 1 read within the TTL, got %d", domain.reads)
+	}
+	c.invalidate(uri, uuid)
+	get(c)
+	if domain.reads != 2 {
+		t.Errorf("want 2 reads after invalidating the domain, got %d", domain.reads)
+	}
+	domain.ID = 3
+	get(c)
+	if domain.reads != 3 {
+		t.Errorf("want 3 reads after restarting the domain, got %d", domain.reads)
+	}
+
+	domain.reads = 0
+	c = &domainXMLCache{}
+	get(c)
+	get(c)
+	if domain.reads != 2 {
+		t.Errorf("want 2 reads without a TTL, got %d", domain.reads)
+	}
+}
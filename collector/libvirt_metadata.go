@@ -0,0 +1,183 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var libvirtMetadataLabels = kingpin.Flag("collector.libvirt.metadata-labels", "Comma-separated list of label=path pairs, adding the text of an element or attribute of the domain XML as label to all domain metrics, e.g. title=/domain/title,team=/domain/metadata/tags/team/@name.").Default("").String()
+
+// novaMetadataLabels is the preset of --collector.libvirt.nova-metadata for
+// the metadata written by OpenStack Nova.
+var novaMetadataLabels = []metadataLabel{
+	{name: "name", path: xmlPath{elements: []string{"domain", "metadata", "instance", "name"}}},
+	{name: "flavor", path: xmlPath{elements: []string{"domain", "metadata", "instance", "flavor"}, attr: "name"}},
+	{name: "project_name", path: xmlPath{elements: []string{"domain", "metadata", "instance", "owner", "project"}}},
+}
+
+// reservedLibvirtLabels are the labels of the libvirt metrics which can't be
+// used for metadata.
+var reservedLibvirtLabels = map[string]bool{
+	"hypervisor_uri":   true,
+	"domain":           true,
+	"uuid":             true,
+	"source_file":      true,
+	"target_device":    true,
+	"source_bridge":    true,
+	"domain_interface": true,
+	"vcpu":             true,
+	"cpus":             true,
+	"type":             true,
+	"device":           true,
+	"source":           true,
+	"operation":        true,
+	"direction":        true,
+}
+
+// metadataLabel is a label taken from the domain XML.
+type metadataLabel struct {
+	name string
+	path xmlPath
+}
+
+// parseMetadataLabels parses a comma-separated list of label=path pairs.
+func parseMetadataLabels(s string) ([]metadataLabel, error) {
+	var labels []metadataLabel
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid metadata label %q, want label=path", pair)
+		}
+		path, err := parseXMLPath(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata label %q: %s", pair, err)
+		}
+		labels = append(labels, metadataLabel{name: parts[0], path: path})
+	}
+	return labels, nil
+}
+
+// checkMetadataLabels returns an error if the names of labels are invalid,
+// duplicated or clash with the labels of the libvirt metrics.
+func checkMetadataLabels(labels []metadataLabel) error {
+	seen := map[string]bool{}
+	for _, l := range labels {
+		if !model.LabelName(l.name).IsValid() {
+			return fmt.Errorf("invalid metadata label name %q", l.name)
+		}
+		if reservedLibvirtLabels[l.name] {
+			return fmt.Errorf("metadata label %q clashes with a label of the libvirt metrics", l.name)
+		}
+		if seen[l.name] {
+			return fmt.Errorf("duplicate metadata label %q", l.name)
+		}
+		seen[l.name] = true
+	}
+	return nil
+}
+
+// xmlPath is a simple XPath-like expression, an absolute path of element
+// names optionally ending with an attribute, like /domain/metadata/a/@b.
+// Namespace prefixes are ignored, elements are only matched by local name.
+// If several elements match, the first one is used.
+type xmlPath struct {
+	elements []string
+	attr     string
+}
+
+func parseXMLPath(s string) (xmlPath, error) {
+	if !strings.HasPrefix(s, "/") {
+		return xmlPath{}, fmt.Errorf("path %q isn't absolute", s)
+	}
+	var p xmlPath
+	parts := strings.Split(s[1:], "/")
+	if last := parts[len(parts)-1]; strings.HasPrefix(last, "@") {
+		p.attr = localName(last[1:])
+		parts = parts[:len(parts)-1]
+		if p.attr == "" {
+			return xmlPath{}, fmt.Errorf("empty attribute in path %q", s)
+		}
+	}
+	if len(parts) == 0 {
+		return xmlPath{}, fmt.Errorf("no element in path %q", s)
+	}
+	for _, part := range parts {
+		name := localName(part)
+		if name == "" {
+			return xmlPath{}, fmt.Errorf("empty element in path %q", s)
+		}
+		p.elements = append(p.elements, name)
+	}
+	return p, nil
+}
+
+// localName strips the namespace prefix of an element or attribute name.
+func localName(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// xmlNode is an element of a generic XML tree.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+// lookup returns the trimmed text of the element or the value of the
+// attribute at p, or "" if there is none. n is the root element.
+func (n *xmlNode) lookup(p xmlPath) string {
+	if n.XMLName.Local != p.elements[0] {
+		return ""
+	}
+	node := n
+	for _, name := range p.elements[1:] {
+		if node = node.child(name); node == nil {
+			return ""
+		}
+	}
+	if p.attr == "" {
+		return strings.TrimSpace(node.Text)
+	}
+	for _, attr := range node.Attrs {
+		if attr.Name.Local == p.attr {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element with the local name, or nil.
+func (n *xmlNode) child(name string) *xmlNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
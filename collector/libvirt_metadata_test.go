@@ -0,0 +1,95 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+const metadataDomainXML = `<domain type='kvm'>
+  <name>instance-00000001</name>
+  <title>Web server</title>
+  <metadata>
+    <nova:instance xmlns:nova="http://openstack.org/xmlns/libvirt/nova/1.0">
+      <nova:name>web-1</nova:name>
+      <nova:flavor name="m1.small"><nova:memory>2048</nova:memory></nova:flavor>
+      <nova:owner>
+        <nova:user uuid="1">admin</nova:user>
+        <nova:project uuid="2">web</nova:project>
+      </nova:owner>
+    </nova:instance>
+    <acme:tags xmlns:acme="http://example.com/acme">
+      <acme:team name="platform"/>
+    </acme:tags>
+  </metadata>
+</domain>`
+
+func TestMetadataLabels(t *testing.T) {
+	labels, err := parseMetadataLabels("title=/domain/title, team=/domain/metadata/acme:tags/team/@name,missing=/domain/metadata/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels = append(append([]metadataLabel{}, novaMetadataLabels...), labels...)
+	if err := checkMetadataLabels(labels); err != nil {
+		t.Fatal(err)
+	}
+
+	var root xmlNode
+	if err := xml.Unmarshal([]byte(metadataDomainXML), &root); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"name":         "web-1",
+		"flavor":       "m1.small",
+		"project_name": "web",
+		"title":        "Web server",
+		"team":         "platform",
+		"missing":      "",
+	}
+	for _, l := range labels {
+		if got := root.lookup(l.path); got != want[l.name] {
+			t.Errorf("%s: want %q, got %q", l.name, want[l.name], got)
+		}
+	}
+}
+
+func TestMetadataLabelsInvalid(t *testing.T) {
+	for _, s := range []string{
+		"title",
+		"title=domain/title",
+		"title=/domain//title",
+		"title=/@name",
+		"title=/domain/@",
+	} {
+		if _, err := parseMetadataLabels(s); err == nil {
+			t.Errorf("%q: want error, got none", s)
+		}
+	}
+	for _, s := range []string{
+		"uuid=/domain/uuid",
+		"a-b=/domain/title",
+		"a=/domain/title,a=/domain/description",
+	} {
+		labels, err := parseMetadataLabels(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkMetadataLabels(labels); err == nil {
+			t.Errorf("%q: want error, got none", s)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build libvirt,!nolibvirt
+
+package collector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	"github.com/prometheus/common/log"
+)
+
+// libvirtDefaultState enables the collector if it's built with the libvirt
+// library.
+const libvirtDefaultState = defaultEnabled
+
+// libvirtStatsTypes are the groups of statistics read for every domain.
+const libvirtStatsTypes = libvirt.DOMAIN_STATS_STATE |
+	libvirt.DOMAIN_STATS_CPU_TOTAL |
+	libvirt.DOMAIN_STATS_BALLOON |
+	libvirt.DOMAIN_STATS_VCPU |
+	libvirt.DOMAIN_STATS_INTERFACE |
+	libvirt.DOMAIN_STATS_BLOCK
+
+// nativeLibvirtDriver uses the libvirt C library.
+type nativeLibvirtDriver struct{}
+
+func newNativeLibvirtDriver() (libvirtDriver, error) {
+	return nativeLibvirtDriver{}, nil
+}
+
+// nativeLibvirtError wraps the libvirt errors the collector handles.
+func nativeLibvirtError(err error) error {
+	lerr, ok := err.(libvirt.Error)
+	if !ok {
+		return err
+	}
+	switch lerr.Code {
+	case libvirt.ERR_NO_DOMAIN:
+		return &libvirtError{code: libvirtErrNoDomain, err: err}
+	case libvirt.ERR_NO_SUPPORT:
+		return &libvirtError{code: libvirtErrNoSupport, err: err}
+	}
+	return err
+}
+
+// setUint64 returns a pointer to v if it's set, or nil.
+func setUint64(set bool, v uint64) *uint64 {
+	if !set {
+		return nil
+	}
+	return &v
+}
+
+func (nativeLibvirtDriver) Connect(uri string) (libvirtConn, error) {
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	return &nativeLibvirtConn{conn: conn}, nil
+}
+
+var (
+	libvirtEventLoopOnce sync.Once
+	libvirtEventLoopErr  error
+)
+
+// startLibvirtEventLoop registers libvirt's default event loop and runs it
+// in the background. The event loop is shared by all connections, it's only
+// started once.
+func startLibvirtEventLoop() error {
+	libvirtEventLoopOnce.Do(func() {
+		if libvirtEventLoopErr = libvirt.EventRegisterDefaultImpl(); libvirtEventLoopErr != nil {
+			return
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					log.Errorf("Failed to run the libvirt event loop: %s", err)
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	})
+	return libvirtEventLoopErr
+}
+
+// SubscribeLifecycle opens a connection of its own, on which the events are
+// delivered by the event loop.
+func (nativeLibvirtDriver) SubscribeLifecycle(uri string, handler lifecycleHandler) (libvirtSubscription, error) {
+	if err := startLibvirtEventLoop(); err != nil {
+		return nil, err
+	}
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, err
+	}
+	// Keepalive messages detect dead connections to libvirtd.
+	if err := conn.SetKeepAlive(5, 3); err != nil {
+		log.Debugf("Failed to enable keepalive for %s: %s", uri, err)
+	}
+	sub := &nativeLibvirtSubscription{uri: uri, conn: conn, handler: handler}
+
+	id, err := conn.DomainEventLifecycleRegister(nil, sub.lifecycle)
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+	sub.callbacks = append(sub.callbacks, id)
+	id, err = conn.DomainEventRebootRegister(nil, sub.reboot)
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+	sub.callbacks = append(sub.callbacks, id)
+	id, err = conn.DomainEventTunableRegister(nil, sub.tunable)
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+	sub.callbacks = append(sub.callbacks, id)
+	return sub, nil
+}
+
+type nativeLibvirtSubscription struct {
+	uri       string
+	conn      *libvirt.Connect
+	callbacks []int
+	handler   lifecycleHandler
+}
+
+func (s *nativeLibvirtSubscription) Alive() bool {
+	alive, err := s.conn.IsAlive()
+	return err == nil && alive
+}
+
+// Close deregisters the callbacks and closes the connection.
+func (s *nativeLibvirtSubscription) Close() {
+	for _, id := range s.callbacks {
+		if err := s.conn.DomainEventDeregister(id); err != nil {
+			log.Debugf("Failed to deregister libvirt event callback for %s: %s", s.uri, err)
+		}
+	}
+	s.callbacks = nil
+	if _, err := s.conn.Close(); err != nil {
+		log.Debugf("Failed to close libvirt connection to %s: %s", s.uri, err)
+	}
+}
+
+func (s *nativeLibvirtSubscription) lifecycle(_ *libvirt.Connect, domain *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+	s.handle(domain, lifecycleEventName(int(event.Event), event.Detail))
+}
+
+func (s *nativeLibvirtSubscription) reboot(_ *libvirt.Connect, domain *libvirt.Domain) {
+	s.handle(domain, lifecycleEventRebooted)
+}
+
+func (s *nativeLibvirtSubscription) tunable(_ *libvirt.Connect, domain *libvirt.Domain, _ *libvirt.DomainEventTunable) {
+	s.handle(domain, domainEventTunable)
+}
+
+func (s *nativeLibvirtSubscription) handle(domain *libvirt.Domain, event string) {
+	name, err := domain.GetName()
+	if err != nil {
+		log.Debugf("Failed to look up the domain of an event of %s: %s", s.uri, err)
+		return
+	}
+	uuid, err := domain.GetUUIDString()
+	if err != nil {
+		log.Debugf("Failed to look up the domain of an event of %s: %s", s.uri, err)
+		return
+	}
+	s.handler(name, uuid, event)
+}
+
+type nativeLibvirtConn struct {
+	conn *libvirt.Connect
+}
+
+func (c *nativeLibvirtConn) Close() error {
+	_, err := c.conn.Close()
+	return err
+}
+
+func (c *nativeLibvirtConn) NumOfDomains() (int, error) {
+	n, err := c.conn.NumOfDomains()
+	return n, nativeLibvirtError(err)
+}
+
+func (c *nativeLibvirtConn) NumOfDefinedDomains() (int, error) {
+	n, err := c.conn.NumOfDefinedDomains()
+	return n, nativeLibvirtError(err)
+}
+
+// GetAllDomainStats reads the statistics of all active domains with a single
+// bulk call. Drivers without bulk statistics, like the test driver of older
+// libvirt versions, are read domain by domain.
+func (c *nativeLibvirtConn) GetAllDomainStats() ([]libvirtDomainStats, error) {
+	stats, err := c.conn.GetAllDomainStats(nil, libvirtStatsTypes, libvirt.CONNECT_GET_ALL_DOMAINS_STATS_ACTIVE)
+	if err != nil {
+		if lerr, ok := err.(libvirt.Error); ok && lerr.Code == libvirt.ERR_NO_SUPPORT {
+			return c.getDomainInfos()
+		}
+		return nil, nativeLibvirtError(err)
+	}
+	result := make([]libvirtDomainStats, 0, len(stats))
+	for i := range stats {
+		result = append(result, convertDomainStats(&stats[i]))
+	}
+	return result, nil
+}
+
+func convertDomainStats(stats *libvirt.DomainStats) libvirtDomainStats {
+	result := libvirtDomainStats{Domain: &nativeLibvirtDomain{domain: stats.Domain}}
+	if s := stats.State; s != nil && s.StateSet {
+		state := int(s.State)
+		result.State = &state
+	}
+	if c := stats.Cpu; c != nil {
+		result.CPU = libvirtCPUStats{
+			Time:   setUint64(c.TimeSet, c.Time),
+			User:   setUint64(c.UserSet, c.User),
+			System: setUint64(c.SystemSet, c.System),
+		}
+	}
+	if b := stats.Balloon; b != nil {
+		result.Balloon = libvirtBalloonStats{
+			Current:    setUint64(b.CurrentSet, b.Current),
+			Maximum:    setUint64(b.MaximumSet, b.Maximum),
+			Unused:     setUint64(b.UnusedSet, b.Unused),
+			Available:  setUint64(b.AvailableSet, b.Available),
+			Rss:        setUint64(b.RssSet, b.Rss),
+			Usable:     setUint64(b.UsableSet, b.Usable),
+			LastUpdate: setUint64(b.LastUpdateSet, b.LastUpdate),
+		}
+	}
+	for _, v := range stats.Vcpu {
+		vcpu := libvirtVcpuStats{
+			Time: setUint64(v.TimeSet, v.Time),
+			Wait: setUint64(v.WaitSet, v.Wait),
+		}
+		if v.StateSet {
+			state := int(v.State)
+			vcpu.State = &state
+		}
+		result.Vcpus = append(result.Vcpus, vcpu)
+	}
+	for _, n := range stats.Net {
+		result.Nets = append(result.Nets, libvirtNetStats{
+			Name:    n.Name,
+			RxBytes: setUint64(n.RxBytesSet, n.RxBytes),
+			RxPkts:  setUint64(n.RxPktsSet, n.RxPkts),
+			RxErrs:  setUint64(n.RxErrsSet, n.RxErrs),
+			RxDrop:  setUint64(n.RxDropSet, n.RxDrop),
+			TxBytes: setUint64(n.TxBytesSet, n.TxBytes),
+			TxPkts:  setUint64(n.TxPktsSet, n.TxPkts),
+			TxErrs:  setUint64(n.TxErrsSet, n.TxErrs),
+			TxDrop:  setUint64(n.TxDropSet, n.TxDrop),
+		})
+	}
+	for _, b := range stats.Block {
+		result.Blocks = append(result.Blocks, libvirtBlockStats{
+			Name:       b.Name,
+			Path:       b.Path,
+			Capacity:   setUint64(b.CapacitySet, b.Capacity),
+			Allocation: setUint64(b.AllocationSet, b.Allocation),
+			Physical:   setUint64(b.PhysicalSet, b.Physical),
+			RdBytes:    setUint64(b.RdBytesSet, b.RdBytes),
+			RdReqs:     setUint64(b.RdReqsSet, b.RdReqs),
+			RdTimes:    setUint64(b.RdTimesSet, b.RdTimes),
+			WrBytes:    setUint64(b.WrBytesSet, b.WrBytes),
+			WrReqs:     setUint64(b.WrReqsSet, b.WrReqs),
+			WrTimes:    setUint64(b.WrTimesSet, b.WrTimes),
+			FlReqs:     setUint64(b.FlReqsSet, b.FlReqs),
+			FlTimes:    setUint64(b.FlTimesSet, b.FlTimes),
+		})
+	}
+	return result
+}
+
+// getDomainInfos returns the state, memory and CPU times of all active
+// domains, which every driver supports.
+func (c *nativeLibvirtConn) getDomainInfos() ([]libvirtDomainStats, error) {
+	domains, err := c.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	result := make([]libvirtDomainStats, 0, len(domains))
+	for i := range domains {
+		domain := &domains[i]
+		stats := libvirtDomainStats{Domain: &nativeLibvirtDomain{domain: domain}}
+		// The domain is still reported, it's skipped by the collector
+		// if it can't be looked up anymore.
+		if info, err := domain.GetInfo(); err == nil {
+			state := int(info.State)
+			stats.State = &state
+			stats.CPU.Time = setUint64(true, info.CpuTime)
+			stats.Balloon.Current = setUint64(true, info.Memory)
+			stats.Balloon.Maximum = setUint64(true, info.MaxMem)
+		}
+		if vcpus, err := domain.GetVcpus(); err == nil {
+			for _, v := range vcpus {
+				state, cpu := int(v.State), int(v.Cpu)
+				stats.Vcpus = append(stats.Vcpus, libvirtVcpuStats{
+					State:  &state,
+					Time:   setUint64(true, v.CpuTime),
+					Cpu:    &cpu,
+					CpuMap: v.CpuMap,
+				})
+			}
+		}
+		result = append(result, stats)
+	}
+	return result, nil
+}
+
+func (c *nativeLibvirtConn) ListInactiveDomains() ([]libvirtDomain, error) {
+	domains, err := c.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_INACTIVE)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	result := make([]libvirtDomain, 0, len(domains))
+	for i := range domains {
+		result = append(result, &nativeLibvirtDomain{domain: &domains[i]})
+	}
+	return result, nil
+}
+
+func (c *nativeLibvirtConn) ListStoragePools() ([]libvirtStoragePool, error) {
+	pools, err := c.conn.ListAllStoragePools(0)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	result := make([]libvirtStoragePool, 0, len(pools))
+	for i := range pools {
+		result = append(result, &nativeLibvirtStoragePool{pool: &pools[i]})
+	}
+	return result, nil
+}
+
+func (c *nativeLibvirtConn) GetNodeInfo() (*libvirtNodeInfo, error) {
+	info, err := c.conn.GetNodeInfo()
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	return &libvirtNodeInfo{Model: info.Model, Cpus: info.Cpus, MHz: info.MHz}, nil
+}
+
+func (c *nativeLibvirtConn) GetNodeCPUStats() (*libvirtNodeCPUStats, error) {
+	cpu, err := c.conn.GetCPUStats(int(libvirt.NODE_CPU_STATS_ALL_CPUS), 0)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	return &libvirtNodeCPUStats{
+		User:   setUint64(cpu.UserSet, cpu.User),
+		Kernel: setUint64(cpu.KernelSet, cpu.Kernel),
+		Idle:   setUint64(cpu.IdleSet, cpu.Idle),
+		Iowait: setUint64(cpu.IowaitSet, cpu.Iowait),
+		Intr:   setUint64(cpu.IntrSet, cpu.Intr),
+	}, nil
+}
+
+func (c *nativeLibvirtConn) GetNodeMemoryStats() (*libvirtNodeMemoryStats, error) {
+	mem, err := c.conn.GetMemoryStats(libvirt.NODE_MEMORY_STATS_ALL_CELLS, 0)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	return &libvirtNodeMemoryStats{
+		Total:   setUint64(mem.TotalSet, mem.Total),
+		Free:    setUint64(mem.FreeSet, mem.Free),
+		Buffers: setUint64(mem.BuffersSet, mem.Buffers),
+		Cached:  setUint64(mem.CachedSet, mem.Cached),
+	}, nil
+}
+
+func (c *nativeLibvirtConn) GetCapabilities() (string, error) {
+	caps, err := c.conn.GetCapabilities()
+	return caps, nativeLibvirtError(err)
+}
+
+func (c *nativeLibvirtConn) GetCellFreeMemory(cell int) (uint64, error) {
+	free, err := c.conn.GetCellsFreeMemory(cell, 1)
+	if err != nil {
+		return 0, nativeLibvirtError(err)
+	}
+	if len(free) != 1 {
+		return 0, fmt.Errorf("got the free memory of %d cells", len(free))
+	}
+	return free[0], nil
+}
+
+func (c *nativeLibvirtConn) GetCellFreePages(pageSizes []uint64, cell int) ([]uint64, error) {
+	free, err := c.conn.GetFreePages(pageSizes, cell, 1, 0)
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	if len(free) != len(pageSizes) {
+		return nil, fmt.Errorf("got the free pages of %d page sizes, want %d", len(free), len(pageSizes))
+	}
+	return free, nil
+}
+
+type nativeLibvirtDomain struct {
+	domain *libvirt.Domain
+}
+
+func (d *nativeLibvirtDomain) GetName() (string, error) {
+	name, err := d.domain.GetName()
+	return name, nativeLibvirtError(err)
+}
+
+func (d *nativeLibvirtDomain) GetUUIDString() (string, error) {
+	uuid, err := d.domain.GetUUIDString()
+	return uuid, nativeLibvirtError(err)
+}
+
+func (d *nativeLibvirtDomain) GetID() (uint, error) {
+	id, err := d.domain.GetID()
+	return id, nativeLibvirtError(err)
+}
+
+func (d *nativeLibvirtDomain) GetXMLDesc() (string, error) {
+	desc, err := d.domain.GetXMLDesc(0)
+	return desc, nativeLibvirtError(err)
+}
+
+func (d *nativeLibvirtDomain) GetInfo() (*libvirtDomainInfo, error) {
+	info, err := d.domain.GetInfo()
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	return &libvirtDomainInfo{State: int(info.State), MaxMem: info.MaxMem, NrVirtCpu: info.NrVirtCpu}, nil
+}
+
+func (d *nativeLibvirtDomain) GetAutostart() (bool, error) {
+	autostart, err := d.domain.GetAutostart()
+	return autostart, nativeLibvirtError(err)
+}
+
+func (d *nativeLibvirtDomain) GetVcpus() ([]libvirtVcpuInfo, error) {
+	vcpus, err := d.domain.GetVcpus()
+	if err != nil {
+		return nil, nativeLibvirtError(err)
+	}
+	result := make([]libvirtVcpuInfo, 0, len(vcpus))
+	for _, v := range vcpus {
+		result = append(result, libvirtVcpuInfo{Number: v.Number, Cpu: v.Cpu, CpuMap: v.CpuMap})
+	}
+	return result, nil
+}
+
+func (d *nativeLibvirtDomain) Free() error {
+	return d.domain.Free()
+}
+
+type nativeLibvirtStoragePool struct {
+	pool *libvirt.StoragePool
+}
+
+func (p *nativeLibvirtStoragePool) GetName() (string, error) {
+	return p.pool.GetName()
+}
+
+func (p *nativeLibvirtStoragePool) GetXMLDesc() (string, error) {
+	return p.pool.GetXMLDesc(0)
+}
+
+func (p *nativeLibvirtStoragePool) GetInfo() (*libvirtStoragePoolInfo, error) {
+	info, err := p.pool.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStoragePoolInfo{
+		State:      int(info.State),
+		Capacity:   info.Capacity,
+		Allocation: info.Allocation,
+		Available:  info.Available,
+	}, nil
+}
+
+func (p *nativeLibvirtStoragePool) ListStorageVolumes() ([]libvirtStorageVolume, error) {
+	volumes, err := p.pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]libvirtStorageVolume, 0, len(volumes))
+	for i := range volumes {
+		result = append(result, &nativeLibvirtStorageVolume{volume: &volumes[i]})
+	}
+	return result, nil
+}
+
+func (p *nativeLibvirtStoragePool) Free() error {
+	return p.pool.Free()
+}
+
+type nativeLibvirtStorageVolume struct {
+	volume *libvirt.StorageVol
+}
+
+func (v *nativeLibvirtStorageVolume) GetName() (string, error) {
+	return v.volume.GetName()
+}
+
+func (v *nativeLibvirtStorageVolume) GetPath() (string, error) {
+	return v.volume.GetPath()
+}
+
+func (v *nativeLibvirtStorageVolume) GetInfo() (*libvirtStorageVolumeInfo, error) {
+	info, err := v.volume.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStorageVolumeInfo{Capacity: info.Capacity, Allocation: info.Allocation}, nil
+}
+
+func (v *nativeLibvirtStorageVolume) Free() error {
+	return v.volume.Free()
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build libvirt,!nolibvirt
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The test driver of libvirt has a running domain named test and a storage
+// pool named default-pool.
+const libvirtTestURI = "test:///default"
+
+func TestNativeLibvirtDriver(t *testing.T) {
+	driver, err := newNativeLibvirtDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := driver.Connect(libvirtTestURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stats, err := conn.GetAllDomainStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, stat := range stats {
+			stat.Domain.Free()
+		}
+	}()
+	if len(stats) != 1 {
+		t.Fatalf("want 1 active domain, got %d", len(stats))
+	}
+	if name, err := stats[0].Domain.GetName(); err != nil || name != "test" {
+		t.Errorf("want domain test, got %q (%v)", name, err)
+	}
+	if stats[0].State == nil {
+		t.Error("want the state of the domain")
+	}
+
+	pools, err := conn.ListStoragePools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, pool := range pools {
+			pool.Free()
+		}
+	}()
+	if len(pools) != 1 {
+		t.Errorf("want 1 storage pool, got %d", len(pools))
+	}
+}
+
+func TestLibvirtExporterTestDriver(t *testing.T) {
+	for flag, value := range map[*string]string{
+		libvirtFixtures: "",
+		libvirtURIs:     libvirtTestURI,
+	} {
+		defer func(flag *string, old string) { *flag = old }(flag, *flag)
+		*flag = value
+	}
+
+	c, err := NewLibvirtExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.(*LibvirtExporter).Close()
+
+	ch := make(chan prometheus.Metric, 1000)
+	if err := c.Update(ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	if len(ch) == 0 {
+		t.Error("want metrics of the test driver")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// collectNode reports the host of the libvirt setup at uri and the resources
+// allocated to its active domains, whose bulk statistics are in stats. Every
+// group of host metrics is skipped on its own if it can't be read, e.g.
+// because the driver doesn't support it.
+func (e *LibvirtExporter) collectNode(ch chan<- prometheus.Metric, uri string, conn libvirtConn, stats []libvirtDomainStats) {
+	if info, err := conn.GetNodeInfo(); err != nil {
+		log.Debugf("Failed to read the node info of %s: %s", uri, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(e.libvirtNodeInfo, prometheus.GaugeValue, 1, uri, info.Model)
+		ch <- prometheus.MustNewConstMetric(e.libvirtNodeCpus, prometheus.GaugeValue, float64(info.Cpus), uri)
+		ch <- prometheus.MustNewConstMetric(e.libvirtNodeCPUFrequency, prometheus.GaugeValue, float64(info.MHz)*1e6, uri)
+	}
+
+	if cpu, err := conn.GetNodeCPUStats(); err != nil {
+		log.Debugf("Failed to read the node CPU statistics of %s: %s", uri, err)
+	} else {
+		for _, m := range []struct {
+			value *uint64
+			mode  string
+		}{
+			{cpu.User, "user"},
+			{cpu.Kernel, "kernel"},
+			{cpu.Idle, "idle"},
+			{cpu.Iowait, "iowait"},
+			{cpu.Intr, "intr"},
+		} {
+			if m.value != nil {
+				ch <- prometheus.MustNewConstMetric(e.libvirtNodeCPUSeconds, prometheus.CounterValue, float64(*m.value)/1e9, uri, m.mode)
+			}
+		}
+	}
+
+	if mem, err := conn.GetNodeMemoryStats(); err != nil {
+		log.Debugf("Failed to read the node memory statistics of %s: %s", uri, err)
+	} else {
+		for _, m := range []struct {
+			value *uint64
+			desc  *prometheus.Desc
+		}{
+			{mem.Total, e.libvirtNodeMemoryTotal},
+			{mem.Free, e.libvirtNodeMemoryFree},
+			{mem.Buffers, e.libvirtNodeMemoryBuffers},
+			{mem.Cached, e.libvirtNodeMemoryCached},
+		} {
+			if m.value != nil {
+				ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(*m.value)*1024, uri)
+			}
+		}
+	}
+
+	e.collectNodeCells(ch, uri, conn)
+
+	vcpus, memory := allocatedResources(stats)
+	ch <- prometheus.MustNewConstMetric(e.libvirtNodeAllocatedVcpus, prometheus.GaugeValue, float64(vcpus), uri)
+	ch <- prometheus.MustNewConstMetric(e.libvirtNodeAllocatedMemory, prometheus.GaugeValue, float64(memory)*1024, uri)
+}
+
+// collectNodeCells reports the free memory and the free and total pages of
+// every page size of the NUMA cells of the host.
+func (e *LibvirtExporter) collectNodeCells(ch chan<- prometheus.Metric, uri string, conn libvirtConn) {
+	capsXML, err := conn.GetCapabilities()
+	if err != nil {
+		log.Debugf("Failed to read the capabilities of %s: %s", uri, err)
+		return
+	}
+	var caps Capabilities
+	if err := xml.Unmarshal([]byte(capsXML), &caps); err != nil {
+		log.Debugf("Failed to parse the capabilities of %s: %s", uri, err)
+		return
+	}
+	pageSizes := make([]uint64, 0, len(caps.Host.CPU.Pages))
+	for _, pages := range caps.Host.CPU.Pages {
+		pageSizes = append(pageSizes, pages.Size)
+	}
+
+	// Cell IDs don't have to be contiguous, so every cell is read on its own.
+	for _, cell := range caps.Host.Cells {
+		cellID := strconv.Itoa(cell.ID)
+		if free, err := conn.GetCellFreeMemory(cell.ID); err != nil {
+			log.Debugf("Failed to read the free memory of cell %d of %s: %s", cell.ID, uri, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(e.libvirtNodeCellFreeMemory, prometheus.GaugeValue, float64(free), uri, cellID)
+		}
+
+		for _, pages := range cell.Pages {
+			count, err := strconv.ParseUint(strings.TrimSpace(pages.Count), 10, 64)
+			if err != nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(e.libvirtNodeCellPages, prometheus.GaugeValue, float64(count), uri, cellID, pageSizeLabel(pages.Size))
+		}
+
+		if len(pageSizes) == 0 {
+			continue
+		}
+		free, err := conn.GetCellFreePages(pageSizes, cell.ID)
+		if err != nil || len(free) != len(pageSizes) {
+			log.Debugf("Failed to read the free pages of cell %d of %s: %v", cell.ID, uri, err)
+			continue
+		}
+		for i, size := range pageSizes {
+			ch <- prometheus.MustNewConstMetric(e.libvirtNodeCellFreePages, prometheus.GaugeValue, float64(free[i]), uri, cellID, pageSizeLabel(size))
+		}
+	}
+}
+
+// pageSizeLabel returns the page_size_bytes label of a page size in KiB.
+func pageSizeLabel(kib uint64) string {
+	return strconv.FormatUint(kib*1024, 10)
+}
+
+// allocatedResources returns the number of online vCPUs and the maximum
+// memory in KiB of the domains in stats.
+func allocatedResources(stats []libvirtDomainStats) (int, uint64) {
+	var (
+		vcpus  int
+		memory uint64
+	)
+	for i := range stats {
+		vcpus += onlineVcpus(stats[i].Vcpus)
+		if max := stats[i].Balloon.Maximum; max != nil {
+			memory += *max
+		}
+	}
+	return vcpus, memory
+}
+
+// onlineVcpus returns the number of vCPUs which aren't offline.
+func onlineVcpus(vcpus []libvirtVcpuStats) int {
+	var n int
+	for _, vcpu := range vcpus {
+		if vcpu.State != nil && *vcpu.State != libvirtVcpuOffline {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,44 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"testing"
+)
+
+func TestAllocatedResources(t *testing.T) {
+	vcpu := func(state int) libvirtVcpuStats {
+		return libvirtVcpuStats{State: &state}
+	}
+	kib := func(v uint64) *uint64 { return &v }
+	// vCPUs are running (1), blocked (2) or offline (0).
+	stats := []libvirtDomainStats{
+		{
+			Vcpus:   []libvirtVcpuStats{vcpu(1), vcpu(2), vcpu(libvirtVcpuOffline)},
+			Balloon: libvirtBalloonStats{Maximum: kib(2048)},
+		},
+		{
+			Vcpus:   []libvirtVcpuStats{vcpu(1)},
+			Balloon: libvirtBalloonStats{Maximum: kib(1024)},
+		},
+		// Statistics which couldn't be read aren't counted.
+		{Vcpus: []libvirtVcpuStats{{}}},
+	}
+	vcpus, memory := allocatedResources(stats)
+	if vcpus != 3 || memory != 3072 {
+		t.Errorf("want 3 vCPUs and 3072 KiB, got %d and %d", vcpus, memory)
+	}
+}
@@ -0,0 +1,808 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !libvirt,!nolibvirt
+
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
+	"github.com/prometheus/common/log"
+)
+
+// libvirtDefaultState disables the collector without the libvirt library.
+// Builds without it are mostly static release binaries, which also run on
+// the many hosts without libvirtd.
+const libvirtDefaultState = defaultDisabled
+
+const (
+	// libvirtSystemSocket is the socket of the system instance of libvirtd,
+	// which also serves URIs of drivers like test:///default.
+	libvirtSystemSocket = "/var/run/libvirt/libvirt-sock"
+	libvirtDialTimeout  = 5 * time.Second
+)
+
+// rpcLibvirtStatsTypes are the groups of statistics read for every domain.
+const rpcLibvirtStatsTypes = libvirt.DomainStatsState |
+	libvirt.DomainStatsCPUTotal |
+	libvirt.DomainStatsBalloon |
+	libvirt.DomainStatsVCPU |
+	libvirt.DomainStatsInterface |
+	libvirt.DomainStatsBlock
+
+// rpcLibvirtDriver speaks the RPC protocol of libvirtd over its unix socket,
+// so it doesn't need cgo or the libvirt library. It takes the place of the
+// library without the libvirt build tag.
+type rpcLibvirtDriver struct{}
+
+func newNativeLibvirtDriver() (libvirtDriver, error) {
+	return rpcLibvirtDriver{}, nil
+}
+
+// libvirtSocket returns the unix socket of the libvirtd serving uri, and the
+// URI to open on it. Like the remote driver of libvirt, the socket can be
+// set with the socket parameter of the URI. Only local connections are
+// supported, the transport has to be empty or unix.
+func libvirtSocket(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	scheme, transport := u.Scheme, ""
+	if i := strings.Index(scheme, "+"); i >= 0 {
+		scheme, transport = scheme[:i], scheme[i+1:]
+	}
+	if (transport != "" && transport != "unix") || u.Host != "" {
+		return "", "", fmt.Errorf("remote libvirt URI %s isn't supported without the libvirt build tag", uri)
+	}
+	u.Scheme = scheme
+
+	query := u.Query()
+	socket := query.Get("socket")
+	query.Del("socket")
+	u.RawQuery = query.Encode()
+
+	if socket == "" {
+		socket = libvirtSystemSocket
+		if u.Path == "/session" {
+			socket = libvirtSessionSocket()
+		}
+	}
+	return socket, u.String(), nil
+}
+
+// libvirtSessionSocket returns the socket of the libvirtd of the current
+// user.
+func libvirtSessionSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "libvirt", "libvirt-sock")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cache", "libvirt", "libvirt-sock")
+}
+
+// rpcLibvirtError wraps the libvirt errors the collector handles.
+func rpcLibvirtError(err error) error {
+	var lerr libvirt.Error
+	if !errors.As(err, &lerr) {
+		return err
+	}
+	switch libvirt.ErrorNumber(lerr.Code) {
+	case libvirt.ErrNoDomain:
+		return &libvirtError{code: libvirtErrNoDomain, err: err}
+	case libvirt.ErrNoSupport:
+		return &libvirtError{code: libvirtErrNoSupport, err: err}
+	}
+	return err
+}
+
+// dialLibvirt connects to the libvirtd serving uri. The domain events in
+// events are handed to their handler instead of go-libvirt, see
+// rpcEventConn.
+func dialLibvirt(uri string, events map[uint32]rpcEventHandler) (*libvirt.Libvirt, error) {
+	path, name, err := libvirtSocket(uri)
+	if err != nil {
+		return nil, err
+	}
+	var dialer socket.Dialer = dialers.NewLocal(
+		dialers.WithSocket(path),
+		dialers.WithLocalTimeout(libvirtDialTimeout),
+	)
+	if len(events) > 0 {
+		dialer = rpcEventDialer{Dialer: dialer, events: events}
+	}
+	l := libvirt.NewWithDialer(dialer)
+	if err := l.ConnectToURI(libvirt.ConnectURI(name)); err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	return l, nil
+}
+
+func (rpcLibvirtDriver) Connect(uri string) (libvirtConn, error) {
+	l, err := dialLibvirt(uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcLibvirtConn{l: l}, nil
+}
+
+// SubscribeLifecycle opens a connection of its own, on which the events are
+// delivered. go-libvirt only routes lifecycle events to its subscribers, so
+// reboot and tunable events are picked out of the connection by
+// rpcEventConn.
+func (rpcLibvirtDriver) SubscribeLifecycle(uri string, handler lifecycleHandler) (libvirtSubscription, error) {
+	l, err := dialLibvirt(uri, map[uint32]rpcEventHandler{
+		rpcProcDomainEventCallbackReboot: func(domain, uuid string) {
+			handler(domain, uuid, lifecycleEventRebooted)
+		},
+		rpcProcDomainEventCallbackTunable: func(domain, uuid string) {
+			handler(domain, uuid, domainEventTunable)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := &rpcLibvirtSubscription{uri: uri, l: l, cancel: cancel, done: make(chan struct{})}
+	events, err := l.LifecycleEvents(ctx)
+	if err != nil {
+		sub.abort()
+		return nil, rpcLibvirtError(err)
+	}
+	go func() {
+		defer close(sub.done)
+		for event := range events {
+			handler(event.Dom.Name, formatLibvirtUUID(event.Dom.UUID), lifecycleEventName(int(event.Event), int(event.Detail)))
+		}
+	}()
+	for _, event := range []libvirt.DomainEventID{libvirt.DomainEventIDReboot, libvirt.DomainEventIDTunable} {
+		id, err := l.ConnectDomainEventCallbackRegisterAny(int32(event), nil)
+		if err != nil {
+			sub.Close()
+			return nil, rpcLibvirtError(err)
+		}
+		sub.callbacks = append(sub.callbacks, id)
+	}
+	return sub, nil
+}
+
+type rpcLibvirtSubscription struct {
+	uri    string
+	l      *libvirt.Libvirt
+	cancel context.CancelFunc
+	// done is closed once no more events are delivered.
+	done chan struct{}
+	// callbacks are the IDs of the callbacks registered for the events
+	// go-libvirt doesn't subscribe to itself.
+	callbacks []int32
+}
+
+func (s *rpcLibvirtSubscription) Alive() bool {
+	select {
+	case <-s.done:
+		return false
+	case <-s.l.Disconnected():
+		return false
+	default:
+		return true
+	}
+}
+
+// Close stops the delivery of events and closes the connection.
+func (s *rpcLibvirtSubscription) Close() {
+	s.cancel()
+	<-s.done
+	for _, id := range s.callbacks {
+		if err := s.l.ConnectDomainEventCallbackDeregisterAny(id); err != nil {
+			log.Debugf("Failed to deregister libvirt event callback on %s: %s", s.uri, err)
+		}
+	}
+	s.abort()
+}
+
+// abort closes the connection.
+func (s *rpcLibvirtSubscription) abort() {
+	s.cancel()
+	if err := s.l.Disconnect(); err != nil {
+		log.Debugf("Failed to close libvirt connection to %s: %s", s.uri, err)
+	}
+}
+
+const (
+	// rpcPacketHeaderSize is the size of the length and the header of a
+	// packet: program, version, procedure, type, serial and status.
+	rpcPacketHeaderSize = 28
+	// rpcPacketMaxSize is the limit of libvirt on the size of packets.
+	rpcPacketMaxSize = 32 << 20
+	rpcProgramRemote = 0x20008086
+	rpcTypeMessage   = 2
+)
+
+// Procedures of the domain events go-libvirt doesn't route to subscribers.
+const (
+	rpcProcDomainEventCallbackReboot  = 319
+	rpcProcDomainEventCallbackTunable = 346
+)
+
+// rpcEventHandler handles a domain event picked out of a connection.
+type rpcEventHandler func(domain, uuid string)
+
+// rpcEventDialer wraps the connections of Dialer with rpcEventConn.
+type rpcEventDialer struct {
+	socket.Dialer
+	events map[uint32]rpcEventHandler
+}
+
+func (d rpcEventDialer) Dial() (net.Conn, error) {
+	conn, err := d.Dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &rpcEventConn{Conn: conn, events: d.events}, nil
+}
+
+// rpcEventConn hands the domain events in events to their handler rather
+// than to go-libvirt, which only routes lifecycle events to its subscribers
+// and drops the others. All other packets are passed through.
+type rpcEventConn struct {
+	net.Conn
+	events map[uint32]rpcEventHandler
+	// rest is the part of the current packet not read by go-libvirt yet.
+	rest []byte
+}
+
+func (c *rpcEventConn) Read(b []byte) (int, error) {
+	for len(c.rest) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size < rpcPacketHeaderSize || size > rpcPacketMaxSize {
+			return 0, fmt.Errorf("invalid libvirt packet size %d", size)
+		}
+		packet := make([]byte, size)
+		copy(packet, length[:])
+		if _, err := io.ReadFull(c.Conn, packet[4:]); err != nil {
+			return 0, err
+		}
+		program := binary.BigEndian.Uint32(packet[4:])
+		procedure := binary.BigEndian.Uint32(packet[12:])
+		typ := binary.BigEndian.Uint32(packet[16:])
+		if handler, ok := c.events[procedure]; ok && program == rpcProgramRemote && typ == rpcTypeMessage {
+			domain, uuid, err := decodeRPCEventDomain(packet[rpcPacketHeaderSize:])
+			if err != nil {
+				log.Debugf("Failed to decode libvirt event %d: %s", procedure, err)
+				continue
+			}
+			handler(domain, uuid)
+			continue
+		}
+		c.rest = packet
+	}
+	n := copy(b, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// decodeRPCEventDomain returns the name and UUID of the domain of an event,
+// which follows the callback ID.
+func decodeRPCEventDomain(payload []byte) (string, string, error) {
+	if len(payload) < 8 {
+		return "", "", io.ErrUnexpectedEOF
+	}
+	n := uint64(binary.BigEndian.Uint32(payload[4:]))
+	// Strings are padded to a multiple of 4 bytes.
+	end := 8 + (n+3)&^3
+	if uint64(len(payload)) < end+libvirt.UUIDBuflen {
+		return "", "", io.ErrUnexpectedEOF
+	}
+	var uuid libvirt.UUID
+	copy(uuid[:], payload[end:])
+	return string(payload[8 : 8+n]), formatLibvirtUUID(uuid), nil
+}
+
+func formatLibvirtUUID(uuid libvirt.UUID) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// rpcTypedParams are typed parameters by their field.
+type rpcTypedParams map[string]interface{}
+
+func newRPCTypedParams(params []libvirt.TypedParam) rpcTypedParams {
+	p := make(rpcTypedParams, len(params))
+	for _, param := range params {
+		p[param.Field] = param.Value.I
+	}
+	return p
+}
+
+// getUint64 returns the integer value of field, or nil if it isn't set.
+func (p rpcTypedParams) getUint64(field string) *uint64 {
+	var v uint64
+	switch value := p[field].(type) {
+	case int32:
+		v = uint64(value)
+	case uint32:
+		v = uint64(value)
+	case int64:
+		v = uint64(value)
+	case uint64:
+		v = value
+	default:
+		return nil
+	}
+	return &v
+}
+
+func (p rpcTypedParams) getInt(field string) *int {
+	v := p.getUint64(field)
+	if v == nil {
+		return nil
+	}
+	i := int(*v)
+	return &i
+}
+
+func (p rpcTypedParams) getString(field string) string {
+	s, _ := p[field].(string)
+	return s
+}
+
+// valueOf returns the value of a pointer returned by getUint64, zero if it
+// isn't set.
+func valueOf(v *uint64) uint64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+type rpcLibvirtConn struct {
+	l *libvirt.Libvirt
+}
+
+func (c *rpcLibvirtConn) Close() error {
+	return c.l.Disconnect()
+}
+
+func (c *rpcLibvirtConn) NumOfDomains() (int, error) {
+	n, err := c.l.ConnectNumOfDomains()
+	return int(n), rpcLibvirtError(err)
+}
+
+func (c *rpcLibvirtConn) NumOfDefinedDomains() (int, error) {
+	n, err := c.l.ConnectNumOfDefinedDomains()
+	return int(n), rpcLibvirtError(err)
+}
+
+// GetAllDomainStats reads the statistics of all active domains with a single
+// bulk call. Drivers without bulk statistics are read domain by domain.
+func (c *rpcLibvirtConn) GetAllDomainStats() ([]libvirtDomainStats, error) {
+	records, err := c.l.ConnectGetAllDomainStats(nil, uint32(rpcLibvirtStatsTypes), libvirt.ConnectGetAllDomainsStatsActive)
+	if err != nil {
+		if libvirtErrorCodeOf(rpcLibvirtError(err)) == libvirtErrNoSupport {
+			return c.getDomainInfos()
+		}
+		return nil, rpcLibvirtError(err)
+	}
+	result := make([]libvirtDomainStats, 0, len(records))
+	for _, record := range records {
+		result = append(result, c.convertDomainStats(record))
+	}
+	return result, nil
+}
+
+// convertDomainStats unpacks the typed parameters of a domain like the
+// libvirt library does.
+func (c *rpcLibvirtConn) convertDomainStats(record libvirt.DomainStatsRecord) libvirtDomainStats {
+	p := newRPCTypedParams(record.Params)
+	result := libvirtDomainStats{
+		Domain: &rpcLibvirtDomain{l: c.l, domain: record.Dom},
+		State:  p.getInt("state.state"),
+		CPU: libvirtCPUStats{
+			Time:   p.getUint64("cpu.time"),
+			User:   p.getUint64("cpu.user"),
+			System: p.getUint64("cpu.system"),
+		},
+		Balloon: libvirtBalloonStats{
+			Current:    p.getUint64("balloon.current"),
+			Maximum:    p.getUint64("balloon.maximum"),
+			Unused:     p.getUint64("balloon.unused"),
+			Available:  p.getUint64("balloon.available"),
+			Rss:        p.getUint64("balloon.rss"),
+			Usable:     p.getUint64("balloon.usable"),
+			LastUpdate: p.getUint64("balloon.last-update"),
+		},
+	}
+
+	vcpus := p.getUint64("vcpu.maximum")
+	if vcpus == nil {
+		vcpus = p.getUint64("vcpu.current")
+	}
+	for i := 0; i < int(valueOf(vcpus)); i++ {
+		prefix := fmt.Sprintf("vcpu.%d.", i)
+		vcpu := libvirtVcpuStats{
+			State: p.getInt(prefix + "state"),
+			Time:  p.getUint64(prefix + "time"),
+			Wait:  p.getUint64(prefix + "wait"),
+		}
+		// Nothing is reported for offline vCPUs.
+		if vcpu.State == nil && vcpu.Time == nil && vcpu.Wait == nil {
+			state := libvirtVcpuOffline
+			vcpu.State = &state
+		}
+		result.Vcpus = append(result.Vcpus, vcpu)
+	}
+
+	for i := 0; i < int(valueOf(p.getUint64("net.count"))); i++ {
+		prefix := fmt.Sprintf("net.%d.", i)
+		result.Nets = append(result.Nets, libvirtNetStats{
+			Name:    p.getString(prefix + "name"),
+			RxBytes: p.getUint64(prefix + "rx.bytes"),
+			RxPkts:  p.getUint64(prefix + "rx.pkts"),
+			RxErrs:  p.getUint64(prefix + "rx.errs"),
+			RxDrop:  p.getUint64(prefix + "rx.drop"),
+			TxBytes: p.getUint64(prefix + "tx.bytes"),
+			TxPkts:  p.getUint64(prefix + "tx.pkts"),
+			TxErrs:  p.getUint64(prefix + "tx.errs"),
+			TxDrop:  p.getUint64(prefix + "tx.drop"),
+		})
+	}
+
+	for i := 0; i < int(valueOf(p.getUint64("block.count"))); i++ {
+		prefix := fmt.Sprintf("block.%d.", i)
+		result.Blocks = append(result.Blocks, libvirtBlockStats{
+			Name:       p.getString(prefix + "name"),
+			Path:       p.getString(prefix + "path"),
+			Capacity:   p.getUint64(prefix + "capacity"),
+			Allocation: p.getUint64(prefix + "allocation"),
+			Physical:   p.getUint64(prefix + "physical"),
+			RdBytes:    p.getUint64(prefix + "rd.bytes"),
+			RdReqs:     p.getUint64(prefix + "rd.reqs"),
+			RdTimes:    p.getUint64(prefix + "rd.times"),
+			WrBytes:    p.getUint64(prefix + "wr.bytes"),
+			WrReqs:     p.getUint64(prefix + "wr.reqs"),
+			WrTimes:    p.getUint64(prefix + "wr.times"),
+			FlReqs:     p.getUint64(prefix + "fl.reqs"),
+			FlTimes:    p.getUint64(prefix + "fl.times"),
+		})
+	}
+	return result
+}
+
+// getDomainInfos returns the state, memory and CPU times of all active
+// domains, which every driver supports.
+func (c *rpcLibvirtConn) getDomainInfos() ([]libvirtDomainStats, error) {
+	domains, _, err := c.l.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	result := make([]libvirtDomainStats, 0, len(domains))
+	for _, d := range domains {
+		domain := &rpcLibvirtDomain{l: c.l, domain: d}
+		stats := libvirtDomainStats{Domain: domain}
+		// The domain is still reported, it's skipped by the collector
+		// if it can't be looked up anymore.
+		if state, maxMem, memory, nrVirtCPU, cpuTime, err := c.l.DomainGetInfo(d); err == nil {
+			s := int(state)
+			stats.State = &s
+			stats.CPU.Time = &cpuTime
+			stats.Balloon.Current = &memory
+			stats.Balloon.Maximum = &maxMem
+			if vcpus, cpumaps, err := domain.getVcpus(int32(nrVirtCPU)); err == nil {
+				hostCPUs := 0
+				if len(vcpus) > 0 {
+					hostCPUs = len(cpumaps) / len(vcpus)
+				}
+				for i, v := range vcpus {
+					state, cpuTime, cpu := int(v.State), v.CPUTime, int(v.CPU)
+					stats.Vcpus = append(stats.Vcpus, libvirtVcpuStats{
+						State:  &state,
+						Time:   &cpuTime,
+						Cpu:    &cpu,
+						CpuMap: cpumaps[i*hostCPUs : (i+1)*hostCPUs],
+					})
+				}
+			}
+		}
+		result = append(result, stats)
+	}
+	return result, nil
+}
+
+func (c *rpcLibvirtConn) ListInactiveDomains() ([]libvirtDomain, error) {
+	domains, _, err := c.l.ConnectListAllDomains(1, libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	result := make([]libvirtDomain, 0, len(domains))
+	for _, d := range domains {
+		result = append(result, &rpcLibvirtDomain{l: c.l, domain: d})
+	}
+	return result, nil
+}
+
+func (c *rpcLibvirtConn) ListStoragePools() ([]libvirtStoragePool, error) {
+	pools, _, err := c.l.ConnectListAllStoragePools(1, 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	result := make([]libvirtStoragePool, 0, len(pools))
+	for _, p := range pools {
+		result = append(result, &rpcLibvirtStoragePool{l: c.l, pool: p})
+	}
+	return result, nil
+}
+
+func (c *rpcLibvirtConn) GetNodeInfo() (*libvirtNodeInfo, error) {
+	model, _, cpus, mhz, _, _, _, _, err := c.l.NodeGetInfo()
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	var name strings.Builder
+	for _, c := range model {
+		if c == 0 {
+			break
+		}
+		name.WriteByte(byte(c))
+	}
+	return &libvirtNodeInfo{Model: name.String(), Cpus: uint(cpus), MHz: uint(mhz)}, nil
+}
+
+func (c *rpcLibvirtConn) GetNodeCPUStats() (*libvirtNodeCPUStats, error) {
+	// The first call returns the number of parameters.
+	_, n, err := c.l.NodeGetCPUStats(int32(libvirt.NodeCPUStatsAllCpus), 0, 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	params, _, err := c.l.NodeGetCPUStats(int32(libvirt.NodeCPUStatsAllCpus), n, 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	p := make(rpcTypedParams, len(params))
+	for _, param := range params {
+		p[param.Field] = param.Value
+	}
+	return &libvirtNodeCPUStats{
+		User:   p.getUint64("user"),
+		Kernel: p.getUint64("kernel"),
+		Idle:   p.getUint64("idle"),
+		Iowait: p.getUint64("iowait"),
+		Intr:   p.getUint64("intr"),
+	}, nil
+}
+
+func (c *rpcLibvirtConn) GetNodeMemoryStats() (*libvirtNodeMemoryStats, error) {
+	// The first call returns the number of parameters.
+	_, n, err := c.l.NodeGetMemoryStats(0, int32(libvirt.NodeMemoryStatsAllCells), 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	params, _, err := c.l.NodeGetMemoryStats(n, int32(libvirt.NodeMemoryStatsAllCells), 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	p := make(rpcTypedParams, len(params))
+	for _, param := range params {
+		p[param.Field] = param.Value
+	}
+	return &libvirtNodeMemoryStats{
+		Total:   p.getUint64("total"),
+		Free:    p.getUint64("free"),
+		Buffers: p.getUint64("buffers"),
+		Cached:  p.getUint64("cached"),
+	}, nil
+}
+
+func (c *rpcLibvirtConn) GetCapabilities() (string, error) {
+	caps, err := c.l.ConnectGetCapabilities()
+	return caps, rpcLibvirtError(err)
+}
+
+func (c *rpcLibvirtConn) GetCellFreeMemory(cell int) (uint64, error) {
+	free, err := c.l.NodeGetCellsFreeMemory(int32(cell), 1)
+	if err != nil {
+		return 0, rpcLibvirtError(err)
+	}
+	if len(free) != 1 {
+		return 0, fmt.Errorf("got the free memory of %d cells", len(free))
+	}
+	return free[0], nil
+}
+
+func (c *rpcLibvirtConn) GetCellFreePages(pageSizes []uint64, cell int) ([]uint64, error) {
+	pages := make([]uint32, 0, len(pageSizes))
+	for _, size := range pageSizes {
+		pages = append(pages, uint32(size))
+	}
+	free, err := c.l.NodeGetFreePages(pages, int32(cell), 1, 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	if len(free) != len(pageSizes) {
+		return nil, fmt.Errorf("got the free pages of %d page sizes, want %d", len(free), len(pageSizes))
+	}
+	return free, nil
+}
+
+// rpcLibvirtDomain is a reference to a domain, which holds no resources.
+type rpcLibvirtDomain struct {
+	l      *libvirt.Libvirt
+	domain libvirt.Domain
+}
+
+func (d *rpcLibvirtDomain) GetName() (string, error) {
+	return d.domain.Name, nil
+}
+
+func (d *rpcLibvirtDomain) GetUUIDString() (string, error) {
+	return formatLibvirtUUID(d.domain.UUID), nil
+}
+
+// GetID returns the ID of the domain, which is -1 as an unsigned int for
+// inactive domains like in the libvirt library.
+func (d *rpcLibvirtDomain) GetID() (uint, error) {
+	return uint(uint32(d.domain.ID)), nil
+}
+
+func (d *rpcLibvirtDomain) GetXMLDesc() (string, error) {
+	desc, err := d.l.DomainGetXMLDesc(d.domain, 0)
+	return desc, rpcLibvirtError(err)
+}
+
+func (d *rpcLibvirtDomain) GetInfo() (*libvirtDomainInfo, error) {
+	state, maxMem, _, nrVirtCPU, _, err := d.l.DomainGetInfo(d.domain)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	return &libvirtDomainInfo{State: int(state), MaxMem: maxMem, NrVirtCpu: uint(nrVirtCPU)}, nil
+}
+
+func (d *rpcLibvirtDomain) GetAutostart() (bool, error) {
+	autostart, err := d.l.DomainGetAutostart(d.domain)
+	return autostart != 0, rpcLibvirtError(err)
+}
+
+// getVcpus returns the online vCPUs of the domain with up to maxinfo
+// entries, and the number of host CPUs in their CPU maps.
+func (d *rpcLibvirtDomain) getVcpus(maxinfo int32) ([]libvirt.VcpuInfo, []bool, error) {
+	_, _, _, _, nodes, sockets, cores, threads, err := d.l.NodeGetInfo()
+	if err != nil {
+		return nil, nil, rpcLibvirtError(err)
+	}
+	hostCPUs := int(nodes * sockets * cores * threads)
+	maplen := (hostCPUs + 7) / 8
+	vcpus, cpumaps, err := d.l.DomainGetVcpus(d.domain, maxinfo, int32(maplen))
+	if err != nil {
+		return nil, nil, rpcLibvirtError(err)
+	}
+	bits := make([]bool, 0, len(vcpus)*hostCPUs)
+	for i := range vcpus {
+		for cpu := 0; cpu < hostCPUs; cpu++ {
+			b := i*maplen + cpu/8
+			bits = append(bits, b < len(cpumaps) && cpumaps[b]&(1<<uint(cpu%8)) != 0)
+		}
+	}
+	return vcpus, bits, nil
+}
+
+func (d *rpcLibvirtDomain) GetVcpus() ([]libvirtVcpuInfo, error) {
+	_, _, _, nrVirtCPU, _, err := d.l.DomainGetInfo(d.domain)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	vcpus, cpumaps, err := d.getVcpus(int32(nrVirtCPU))
+	if err != nil {
+		return nil, err
+	}
+	hostCPUs := 0
+	if len(vcpus) > 0 {
+		hostCPUs = len(cpumaps) / len(vcpus)
+	}
+	result := make([]libvirtVcpuInfo, 0, len(vcpus))
+	for i, v := range vcpus {
+		result = append(result, libvirtVcpuInfo{
+			Number: v.Number,
+			Cpu:    v.CPU,
+			CpuMap: cpumaps[i*hostCPUs : (i+1)*hostCPUs],
+		})
+	}
+	return result, nil
+}
+
+func (d *rpcLibvirtDomain) Free() error {
+	return nil
+}
+
+type rpcLibvirtStoragePool struct {
+	l    *libvirt.Libvirt
+	pool libvirt.StoragePool
+}
+
+func (p *rpcLibvirtStoragePool) GetName() (string, error) {
+	return p.pool.Name, nil
+}
+
+func (p *rpcLibvirtStoragePool) GetXMLDesc() (string, error) {
+	desc, err := p.l.StoragePoolGetXMLDesc(p.pool, 0)
+	return desc, rpcLibvirtError(err)
+}
+
+func (p *rpcLibvirtStoragePool) GetInfo() (*libvirtStoragePoolInfo, error) {
+	state, capacity, allocation, available, err := p.l.StoragePoolGetInfo(p.pool)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	return &libvirtStoragePoolInfo{
+		State:      int(state),
+		Capacity:   capacity,
+		Allocation: allocation,
+		Available:  available,
+	}, nil
+}
+
+func (p *rpcLibvirtStoragePool) ListStorageVolumes() ([]libvirtStorageVolume, error) {
+	volumes, _, err := p.l.StoragePoolListAllVolumes(p.pool, 1, 0)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	result := make([]libvirtStorageVolume, 0, len(volumes))
+	for _, v := range volumes {
+		result = append(result, &rpcLibvirtStorageVolume{l: p.l, volume: v})
+	}
+	return result, nil
+}
+
+func (p *rpcLibvirtStoragePool) Free() error {
+	return nil
+}
+
+type rpcLibvirtStorageVolume struct {
+	l      *libvirt.Libvirt
+	volume libvirt.StorageVol
+}
+
+func (v *rpcLibvirtStorageVolume) GetName() (string, error) {
+	return v.volume.Name, nil
+}
+
+func (v *rpcLibvirtStorageVolume) GetPath() (string, error) {
+	path, err := v.l.StorageVolGetPath(v.volume)
+	return path, rpcLibvirtError(err)
+}
+
+func (v *rpcLibvirtStorageVolume) GetInfo() (*libvirtStorageVolumeInfo, error) {
+	_, capacity, allocation, err := v.l.StorageVolGetInfo(v.volume)
+	if err != nil {
+		return nil, rpcLibvirtError(err)
+	}
+	return &libvirtStorageVolumeInfo{Capacity: capacity, Allocation: allocation}, nil
+}
+
+func (v *rpcLibvirtStorageVolume) Free() error {
+	return nil
+}
@@ -0,0 +1,416 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !libvirt,!nolibvirt
+
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+)
+
+// Procedures of the libvirt RPC protocol used by the tests.
+const (
+	libvirtProgram                          = 0x20008086
+	libvirtProcConnectOpen                  = 1
+	libvirtProcConnectClose                 = 2
+	libvirtProcDomainGetXMLDesc             = 14
+	libvirtProcConnectNumOfDomains          = 51
+	libvirtProcAuthList                     = 66
+	libvirtProcEventCallbackRegisterAny     = 316
+	libvirtProcEventCallbackDeregisterAny   = 317
+	libvirtProcDomainEventCallbackLifecycle = 318
+	libvirtProcDomainEventCallbackReboot    = 319
+	libvirtProcConnectGetAllDomainStats     = 344
+	libvirtProcDomainEventCallbackTunable   = 346
+)
+
+// xdrBuffer encodes the XDR values of the libvirt RPC protocol.
+type xdrBuffer struct {
+	bytes.Buffer
+}
+
+func (b *xdrBuffer) putUint32(v uint32) *xdrBuffer {
+	binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+func (b *xdrBuffer) putUint64(v uint64) *xdrBuffer {
+	binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+func (b *xdrBuffer) putString(s string) *xdrBuffer {
+	b.putUint32(uint32(len(s)))
+	b.WriteString(s)
+	b.Write(make([]byte, (4-len(s)%4)%4))
+	return b
+}
+
+func (b *xdrBuffer) putDomain(name string, uuid libvirt.UUID, id int32) *xdrBuffer {
+	b.putString(name)
+	b.Write(uuid[:])
+	return b.putUint32(uint32(id))
+}
+
+// putTypedParam encodes a typed parameter of type int, unsigned long long or
+// string.
+func (b *xdrBuffer) putTypedParam(field string, value interface{}) *xdrBuffer {
+	b.putString(field)
+	switch v := value.(type) {
+	case int:
+		b.putUint32(1).putUint32(uint32(v))
+	case uint64:
+		b.putUint32(4).putUint64(v)
+	case string:
+		b.putUint32(7).putString(v)
+	}
+	return b
+}
+
+// libvirtStandIn is a local stand-in for libvirtd, which answers the calls of
+// the tests on a unix socket. Other calls fail with ERR_NO_SUPPORT.
+type libvirtStandIn struct {
+	socket   string
+	listener net.Listener
+
+	// replies are the payloads of the replies by procedure.
+	replies map[uint32][]byte
+	// errors are the error codes of failing calls by procedure.
+	errors map[uint32]uint32
+
+	mtx   sync.Mutex
+	conns []net.Conn
+}
+
+func newLibvirtStandIn(t *testing.T, dir string) *libvirtStandIn {
+	s := &libvirtStandIn{
+		socket: filepath.Join(dir, "libvirt-sock"),
+		replies: map[uint32][]byte{
+			// No authentication.
+			libvirtProcAuthList:                   new(xdrBuffer).putUint32(1).putUint32(0).Bytes(),
+			libvirtProcConnectOpen:                nil,
+			libvirtProcConnectClose:               nil,
+			libvirtProcEventCallbackRegisterAny:   new(xdrBuffer).putUint32(1).Bytes(),
+			libvirtProcEventCallbackDeregisterAny: nil,
+		},
+		errors: map[uint32]uint32{},
+	}
+	l, err := net.Listen("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+	go s.serve()
+	return s
+}
+
+func (s *libvirtStandIn) uri() string {
+	return "qemu:///system?socket=" + s.socket
+}
+
+func (s *libvirtStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		s.conns = append(s.conns, conn)
+		s.mtx.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// disconnect closes all connections to the stand-in.
+func (s *libvirtStandIn) disconnect() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *libvirtStandIn) close() {
+	s.listener.Close()
+	s.disconnect()
+}
+
+func (s *libvirtStandIn) handle(conn net.Conn) {
+	for {
+		// The length of the packet and the header: program, version,
+		// procedure, type, serial and status.
+		var header [7]uint32
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, conn, int64(header[0])-28); err != nil {
+			return
+		}
+		procedure, serial := header[3], header[5]
+
+		s.mtx.Lock()
+		payload, ok := s.replies[procedure]
+		code, failed := s.errors[procedure]
+		if !ok && !failed {
+			code, failed = uint32(libvirt.ErrNoSupport), true
+		}
+		if failed {
+			s.send(conn, procedure, 1, serial, 1, new(xdrBuffer).
+				putUint32(code).
+				putUint32(0).
+				putUint32(1).putString("stand-in error").
+				putUint32(2).Bytes())
+		} else {
+			s.send(conn, procedure, 1, serial, 0, payload)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// sendEvent sends an event of procedure to all connections.
+func (s *libvirtStandIn) sendEvent(procedure uint32, event []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, conn := range s.conns {
+		s.send(conn, procedure, 2, 0, 0, event)
+	}
+}
+
+// send writes a packet to conn, with mtx held.
+func (s *libvirtStandIn) send(conn net.Conn, procedure, typ, serial, status uint32, payload []byte) {
+	packet := new(xdrBuffer).
+		putUint32(uint32(28 + len(payload))).
+		putUint32(libvirtProgram).
+		putUint32(1).
+		putUint32(procedure).
+		putUint32(typ).
+		putUint32(serial).
+		putUint32(status)
+	packet.Write(payload)
+	conn.Write(packet.Bytes())
+}
+
+var libvirtStandInUUID = libvirt.UUID{0x6f, 0x2a, 0x1c, 0x3e, 0x9b, 0x4d, 0x4e, 0x2f, 0x8a, 0x1b, 0x5c, 0x6d, 0x7e, 0x8f, 0x90, 0xa1}
+
+func TestLibvirtSocket(t *testing.T) {
+	defer func(old string) { os.Setenv("XDG_RUNTIME_DIR", old) }(os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+
+	for _, tt := range []struct {
+		uri    string
+		socket string
+		name   string
+	}{
+		{"qemu:///system", libvirtSystemSocket, "qemu:///system"},
+		{"test:///default", libvirtSystemSocket, "test:///default"},
+		{"qemu:///session", "/run/user/1000/libvirt/libvirt-sock", "qemu:///session"},
+		{"qemu+unix:///system?socket=/run/libvirt/virtqemud-sock", "/run/libvirt/virtqemud-sock", "qemu:///system"},
+	} {
+		socket, name, err := libvirtSocket(tt.uri)
+		if err != nil {
+			t.Errorf("%s: %s", tt.uri, err)
+			continue
+		}
+		if socket != tt.socket || name != tt.name {
+			t.Errorf("%s: want socket %s and URI %s, got %s and %s", tt.uri, tt.socket, tt.name, socket, name)
+		}
+	}
+
+	for _, uri := range []string{"qemu+ssh://host/system", "qemu://host/system", "qemu+tls:///system"} {
+		if _, _, err := libvirtSocket(uri); err == nil {
+			t.Errorf("%s: want an error for a remote URI", uri)
+		}
+	}
+}
+
+func TestRPCLibvirtDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newLibvirtStandIn(t, dir)
+	defer s.close()
+	s.replies[libvirtProcConnectNumOfDomains] = new(xdrBuffer).putUint32(1).Bytes()
+	s.replies[libvirtProcConnectGetAllDomainStats] = new(xdrBuffer).
+		putUint32(1).
+		putDomain("web", libvirtStandInUUID, 3).
+		putUint32(13).
+		putTypedParam("state.state", 1).
+		putTypedParam("cpu.time", uint64(12000000000)).
+		putTypedParam("balloon.current", uint64(1048576)).
+		putTypedParam("vcpu.current", 1).
+		putTypedParam("vcpu.maximum", 2).
+		putTypedParam("vcpu.0.state", 1).
+		putTypedParam("vcpu.0.time", uint64(8000000000)).
+		putTypedParam("net.count", 1).
+		putTypedParam("net.0.name", "vnet0").
+		putTypedParam("net.0.rx.bytes", uint64(4096)).
+		putTypedParam("block.count", 1).
+		putTypedParam("block.0.name", "vda").
+		putTypedParam("block.0.path", "/var/lib/libvirt/images/web.qcow2").
+		Bytes()
+	s.errors[libvirtProcDomainGetXMLDesc] = uint32(libvirt.ErrNoDomain)
+
+	driver, err := newNativeLibvirtDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := driver.Connect(s.uri())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if n, err := conn.NumOfDomains(); err != nil || n != 1 {
+		t.Errorf("want 1 active domain, got %d (%v)", n, err)
+	}
+	// The stand-in doesn't know the call, like older versions of libvirtd.
+	if _, err := conn.NumOfDefinedDomains(); libvirtErrorCodeOf(err) != libvirtErrNoSupport {
+		t.Errorf("want ERR_NO_SUPPORT, got %v", err)
+	}
+
+	stats, err := conn.GetAllDomainStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("want 1 active domain, got %d", len(stats))
+	}
+	stat := stats[0]
+	if name, _ := stat.Domain.GetName(); name != "web" {
+		t.Errorf("want domain web, got %s", name)
+	}
+	if uuid, _ := stat.Domain.GetUUIDString(); uuid != "6f2a1c3e-9b4d-4e2f-8a1b-5c6d7e8f90a1" {
+		t.Errorf("want the UUID of web, got %s", uuid)
+	}
+	if stat.State == nil || *stat.State != 1 {
+		t.Errorf("want state 1, got %v", stat.State)
+	}
+	if stat.CPU.Time == nil || *stat.CPU.Time != 12000000000 {
+		t.Errorf("want a CPU time of 12s, got %v", stat.CPU.Time)
+	}
+	if stat.CPU.User != nil {
+		t.Errorf("want no user time, got %d", *stat.CPU.User)
+	}
+	if len(stat.Vcpus) != 2 {
+		t.Fatalf("want 2 vCPUs, got %d", len(stat.Vcpus))
+	}
+	if state := stat.Vcpus[1].State; state == nil || *state != libvirtVcpuOffline {
+		t.Errorf("want vCPU 1 offline, got %v", state)
+	}
+	if len(stat.Nets) != 1 || stat.Nets[0].Name != "vnet0" || stat.Nets[0].RxBytes == nil || *stat.Nets[0].RxBytes != 4096 {
+		t.Errorf("want 4096 bytes received by vnet0, got %+v", stat.Nets)
+	}
+	if len(stat.Blocks) != 1 || stat.Blocks[0].Path != "/var/lib/libvirt/images/web.qcow2" {
+		t.Errorf("want the block device vda, got %+v", stat.Blocks)
+	}
+
+	if _, err := stat.Domain.GetXMLDesc(); libvirtErrorCodeOf(err) != libvirtErrNoDomain {
+		t.Errorf("want ERR_NO_DOMAIN, got %v", err)
+	}
+}
+
+func TestRPCLibvirtSubscription(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newLibvirtStandIn(t, dir)
+	defer s.close()
+
+	driver, err := newNativeLibvirtDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan lifecycleKey, 1)
+	sub, err := driver.SubscribeLifecycle(s.uri(), func(domain, uuid, event string) {
+		events <- lifecycleKey{domain: domain, uuid: uuid, event: event}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, test := range []struct {
+		procedure uint32
+		event     []byte
+		want      string
+	}{
+		{
+			procedure: libvirtProcDomainEventCallbackLifecycle,
+			event: new(xdrBuffer).
+				putUint32(1).
+				putDomain("web", libvirtStandInUUID, 3).
+				putUint32(libvirtEventStopped).
+				putUint32(libvirtEventStoppedCrashed).
+				Bytes(),
+			want: "crashed",
+		},
+		{
+			procedure: libvirtProcDomainEventCallbackReboot,
+			event: new(xdrBuffer).
+				putUint32(1).
+				putDomain("web", libvirtStandInUUID, 3).
+				Bytes(),
+			want: "rebooted",
+		},
+		{
+			procedure: libvirtProcDomainEventCallbackTunable,
+			event: new(xdrBuffer).
+				putUint32(1).
+				putDomain("web", libvirtStandInUUID, 3).
+				putUint32(0).
+				Bytes(),
+			want: "tunable",
+		},
+	} {
+		s.sendEvent(test.procedure, test.event)
+		select {
+		case event := <-events:
+			want := lifecycleKey{domain: "web", uuid: "6f2a1c3e-9b4d-4e2f-8a1b-5c6d7e8f90a1", event: test.want}
+			if event != want {
+				t.Errorf("want event %+v, got %+v", want, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s event", test.want)
+		}
+	}
+	if !sub.Alive() {
+		t.Error("want the subscription to be alive")
+	}
+
+	// The subscription dies with the connection, e.g. if libvirtd restarts.
+	s.disconnect()
+	for deadline := time.Now().Add(5 * time.Second); sub.Alive(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("want the subscription to die with the connection")
+		}
+	}
+}
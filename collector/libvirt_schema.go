@@ -1,5 +1,3 @@
-// +build libvirt
-
 // Copyright 2017 Kumina, https://kumina.nl/
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -13,31 +11,17 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build !nolibvirt
+
 package collector
 
 type Domain struct {
-	Devices  Devices  `xml:"devices"`
-	Metadata Metadata `xml:"metadata"`
-	UUID     string   `xml:"uuid"`
-}
-
-type Metadata struct {
-	// The actual xml tag is nova:instance, but we don't care about the namespaces
-	NovaInstance NovaInstance `xml:"instance"`
-}
-
-type NovaInstance struct {
-	Name   string     `xml:"name"`
-	Flavor NovaFlavor `xml:"flavor"`
-	Owner  NovaOwner  `xml:"owner"`
-}
-
-type NovaFlavor struct {
-	Name string `xml:"name,attr"`
-}
+	Devices Devices `xml:"devices"`
+	UUID    string  `xml:"uuid"`
 
-type NovaOwner struct {
-	ProjectName string `xml:"project"`
+	// tree is the whole description, in which the metadata labels are
+	// looked up.
+	tree xmlNode
 }
 
 type Devices struct {
@@ -49,25 +33,89 @@ type Disk struct {
 	Device string     `xml:"device,attr"`
 	Source DiskSource `xml:"source"`
 	Target DiskTarget `xml:"target"`
+	IOTune DiskIOTune `xml:"iotune"`
 }
 
 type DiskSource struct {
 	File string `xml:"file,attr"`
+	Dev  string `xml:"dev,attr"`
+	// Name is the image of network disks, e.g. pool/image for RBD.
+	Name string `xml:"name,attr"`
+	// Pool and Volume refer to a storage volume for disks of type volume.
+	Pool   string `xml:"pool,attr"`
+	Volume string `xml:"volume,attr"`
 }
 
 type DiskTarget struct {
 	Device string `xml:"dev,attr"`
 }
 
+// DiskIOTune are the throttles of a disk, zero if unlimited.
+type DiskIOTune struct {
+	TotalBytesSec uint64 `xml:"total_bytes_sec"`
+	ReadBytesSec  uint64 `xml:"read_bytes_sec"`
+	WriteBytesSec uint64 `xml:"write_bytes_sec"`
+	TotalIopsSec  uint64 `xml:"total_iops_sec"`
+	ReadIopsSec   uint64 `xml:"read_iops_sec"`
+	WriteIopsSec  uint64 `xml:"write_iops_sec"`
+}
+
+type StoragePool struct {
+	Type string `xml:"type,attr"`
+}
+
+type Capabilities struct {
+	Host CapabilitiesHost `xml:"host"`
+}
+
+type CapabilitiesHost struct {
+	CPU   CapabilitiesCPU    `xml:"cpu"`
+	Cells []CapabilitiesCell `xml:"topology>cells>cell"`
+}
+
+type CapabilitiesCPU struct {
+	Pages []CapabilitiesPages `xml:"pages"`
+}
+
+type CapabilitiesCell struct {
+	ID    int                 `xml:"id,attr"`
+	Pages []CapabilitiesPages `xml:"pages"`
+}
+
+// CapabilitiesPages is a page size in KiB. Within cells, it also has the
+// number of pages.
+type CapabilitiesPages struct {
+	Size  uint64 `xml:"size,attr"`
+	Count string `xml:",chardata"`
+}
+
 type Interface struct {
-	Mac    InterfaceMac    `xml:"mac"`
-	Source InterfaceSource `xml:"source"`
-	Target InterfaceTarget `xml:"target"`
-	Model  InterfaceModel  `xml:"model"`
+	Mac       InterfaceMac       `xml:"mac"`
+	Source    InterfaceSource    `xml:"source"`
+	Target    InterfaceTarget    `xml:"target"`
+	Model     InterfaceModel     `xml:"model"`
+	Bandwidth InterfaceBandwidth `xml:"bandwidth"`
 }
 
 type InterfaceSource struct {
-	Bridge string `xml:"bridge,attr"`
+	Bridge  string `xml:"bridge,attr"`
+	Network string `xml:"network,attr"`
+	Dev     string `xml:"dev,attr"`
+}
+
+// InterfaceBandwidth are the limits of the traffic to (inbound) and from
+// (outbound) the domain.
+type InterfaceBandwidth struct {
+	Inbound  InterfaceBandwidthLimit `xml:"inbound"`
+	Outbound InterfaceBandwidthLimit `xml:"outbound"`
+}
+
+// InterfaceBandwidthLimit has the average and peak bandwidth in KiB/s and the
+// burst in KiB, zero if unlimited.
+type InterfaceBandwidthLimit struct {
+	Average uint64 `xml:"average,attr"`
+	Peak    uint64 `xml:"peak,attr"`
+	Burst   uint64 `xml:"burst,attr"`
 }
 
 type InterfaceTarget struct {
@@ -81,3 +129,45 @@ type InterfaceMac struct {
 type InterfaceModel struct {
 	Type string `xml:"type,attr"`
 }
+
+// disk returns the disk with the target device dev, or nil if there is none.
+func (d *Domain) disk(dev string) *Disk {
+	for i := range d.Devices.Disks {
+		if d.Devices.Disks[i].Target.Device == dev {
+			return &d.Devices.Disks[i]
+		}
+	}
+	return nil
+}
+
+// path returns the file, block device or network image of the disk source.
+func (s DiskSource) path() string {
+	for _, path := range []string{s.File, s.Dev, s.Name} {
+		if path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// name returns the bridge, network or host device the interface is connected
+// to.
+func (s InterfaceSource) name() string {
+	for _, name := range []string{s.Bridge, s.Network, s.Dev} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// iface returns the interface with the target device dev, or nil if there is
+// none.
+func (d *Domain) iface(dev string) *Interface {
+	for i := range d.Devices.Interfaces {
+		if d.Devices.Interfaces[i].Target.Device == dev {
+			return &d.Devices.Interfaces[i]
+		}
+	}
+	return nil
+}
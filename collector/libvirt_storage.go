@@ -0,0 +1,186 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"encoding/xml"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var libvirtStorageVolumes = kingpin.Flag("collector.libvirt.storage-volumes", "Export the capacity and allocation of every storage volume.").Default("false").Bool()
+
+// volumeOwner is a domain a storage volume is attached to.
+type volumeOwner struct {
+	domain string
+	uuid   string
+}
+
+type poolVolume struct {
+	pool   string
+	volume string
+}
+
+// volumeOwners maps storage volumes to the domains they are attached to, by
+// the sources of the disks in the domain XML. Disks of type volume refer to
+// the pool and volume, all others to the path of the volume. A nil
+// *volumeOwners ignores all domains.
+type volumeOwners struct {
+	byPath   map[string]volumeOwner
+	byVolume map[poolVolume]volumeOwner
+}
+
+func newVolumeOwners() *volumeOwners {
+	return &volumeOwners{
+		byPath:   map[string]volumeOwner{},
+		byVolume: map[poolVolume]volumeOwner{},
+	}
+}
+
+// add records the disks of a domain.
+func (o *volumeOwners) add(name, uuid string, desc *Domain) {
+	if o == nil {
+		return
+	}
+	owner := volumeOwner{domain: name, uuid: uuid}
+	for _, disk := range desc.Devices.Disks {
+		source := disk.Source
+		if source.Pool != "" && source.Volume != "" {
+			o.byVolume[poolVolume{pool: source.Pool, volume: source.Volume}] = owner
+		}
+		// The path of an RBD volume is the same as the name of the network
+		// disk.
+		if path := source.path(); path != "" {
+			o.byPath[path] = owner
+		}
+	}
+}
+
+// lookup returns the domain a volume is attached to, or an empty volumeOwner
+// if it isn't attached.
+func (o *volumeOwners) lookup(pool, volume, path string) volumeOwner {
+	if owner, ok := o.byVolume[poolVolume{pool: pool, volume: volume}]; ok {
+		return owner
+	}
+	return o.byPath[path]
+}
+
+// collectStoragePools reports the storage pools of the libvirt setup at uri,
+// and their volumes if owners isn't nil. An error of a single pool or volume
+// only skips it.
+func (e *LibvirtExporter) collectStoragePools(ch chan<- prometheus.Metric, uri string, conn libvirtConn, owners *volumeOwners) error {
+	pools, err := conn.ListStoragePools()
+	if err != nil {
+		// Not all drivers manage storage, e.g. lxc.
+		if libvirtErrorCodeOf(err) == libvirtErrNoSupport {
+			log.Debugf("Not collecting storage pools of %s: %s", uri, err)
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		for _, pool := range pools {
+			pool.Free()
+		}
+	}()
+
+	for _, pool := range pools {
+		name, err := pool.GetName()
+		if err != nil {
+			log.Warnf("Skipping storage pool of %s: %s", uri, err)
+			continue
+		}
+		info, err := pool.GetInfo()
+		if err != nil {
+			log.Warnf("Skipping storage pool %s of %s: %s", name, uri, err)
+			continue
+		}
+		var desc StoragePool
+		if xmlDesc, err := pool.GetXMLDesc(); err != nil {
+			log.Debugf("Failed to read the XML description of storage pool %s of %s: %s", name, uri, err)
+		} else if err := xml.Unmarshal([]byte(xmlDesc), &desc); err != nil {
+			log.Debugf("Failed to parse the XML description of storage pool %s of %s: %s", name, uri, err)
+		}
+
+		poolLabelValues := []string{uri, name, desc.Type}
+		for _, m := range []struct {
+			value float64
+			desc  *prometheus.Desc
+		}{
+			{float64(info.State), e.libvirtStoragePoolState},
+			{float64(info.Capacity), e.libvirtStoragePoolCapacity},
+			{float64(info.Allocation), e.libvirtStoragePoolAllocation},
+			{float64(info.Available), e.libvirtStoragePoolAvailable},
+		} {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, m.value, poolLabelValues...)
+		}
+
+		// The volumes of inactive pools can't be listed.
+		if owners != nil && info.State == libvirtStoragePoolRunning {
+			e.collectStorageVolumes(ch, uri, name, pool, owners)
+		}
+	}
+	return nil
+}
+
+// collectStorageVolumes reports the volumes of a storage pool and the
+// domains they are attached to.
+func (e *LibvirtExporter) collectStorageVolumes(ch chan<- prometheus.Metric, uri, poolName string, pool libvirtStoragePool, owners *volumeOwners) {
+	volumes, err := pool.ListStorageVolumes()
+	if err != nil {
+		log.Warnf("Failed to list the volumes of storage pool %s of %s: %s", poolName, uri, err)
+		return
+	}
+	defer func() {
+		for _, volume := range volumes {
+			volume.Free()
+		}
+	}()
+
+	for _, volume := range volumes {
+		// Volumes may be deleted while they're read.
+		name, err := volume.GetName()
+		if err != nil {
+			log.Debugf("Skipping volume of storage pool %s of %s: %s", poolName, uri, err)
+			continue
+		}
+		path, err := volume.GetPath()
+		if err != nil {
+			log.Debugf("Skipping volume %s of storage pool %s of %s: %s", name, poolName, uri, err)
+			continue
+		}
+		info, err := volume.GetInfo()
+		if err != nil {
+			log.Debugf("Skipping volume %s of storage pool %s of %s: %s", name, poolName, uri, err)
+			continue
+		}
+
+		owner := owners.lookup(poolName, name, path)
+		volumeLabelValues := []string{uri, poolName, name, path, owner.domain, owner.uuid}
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtStorageVolumeCapacity,
+			prometheus.GaugeValue,
+			float64(info.Capacity),
+			volumeLabelValues...)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtStorageVolumeAllocation,
+			prometheus.GaugeValue,
+			float64(info.Allocation),
+			volumeLabelValues...)
+	}
+}
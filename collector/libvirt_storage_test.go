@@ -0,0 +1,55 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nolibvirt
+
+package collector
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestVolumeOwners(t *testing.T) {
+	var desc Domain
+	if err := xml.Unmarshal([]byte(`<domain>
+  <devices>
+    <disk type='file' device='disk'><source file='/var/lib/libvirt/images/a.qcow2'/><target dev='vda'/></disk>
+    <disk type='block' device='disk'><source dev='/dev/vg0/b'/><target dev='vdb'/></disk>
+    <disk type='network' device='disk'><source protocol='rbd' name='vms/c'/><target dev='vdc'/></disk>
+    <disk type='volume' device='disk'><source pool='default' volume='d.qcow2'/><target dev='vdd'/></disk>
+  </devices>
+</domain>`), &desc); err != nil {
+		t.Fatal(err)
+	}
+	owners := newVolumeOwners()
+	owners.add("instance-1", "uuid-1", &desc)
+	// A nil *volumeOwners ignores domains.
+	(*volumeOwners)(nil).add("instance-2", "uuid-2", &desc)
+
+	want := volumeOwner{domain: "instance-1", uuid: "uuid-1"}
+	for _, tt := range []struct {
+		pool, volume, path string
+		want               volumeOwner
+	}{
+		{"default", "a.qcow2", "/var/lib/libvirt/images/a.qcow2", want},
+		{"vg0", "b", "/dev/vg0/b", want},
+		{"vms", "c", "vms/c", want},
+		{"default", "d.qcow2", "/var/lib/libvirt/images/d.qcow2", want},
+		{"default", "e.qcow2", "/var/lib/libvirt/images/e.qcow2", volumeOwner{}},
+	} {
+		if got := owners.lookup(tt.pool, tt.volume, tt.path); got != tt.want {
+			t.Errorf("%s/%s: want %+v, got %+v", tt.pool, tt.volume, tt.want, got)
+		}
+	}
+}
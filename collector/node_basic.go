@@ -25,12 +25,47 @@ import (
 	"github.com/shirou/gopsutil/mem"
 	"github.com/shirou/gopsutil/net"
 	"github.com/shirou/gopsutil/process"
+	"gopkg.in/alecthomas/kingpin.v2"
 
 	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	basicProcessInfo   = kingpin.Flag("collector.basic.process-info", "Export per-process metrics for every process.").Default("true").Bool()
+	basicProcessTopN   = kingpin.Flag("collector.basic.process-top-n", "Only export the top N processes by CPU, resident memory and I/O over the last scrape interval, and the sum of all others as process_name=\"other\". Use 0 to export every process.").Default("0").Int()
+	basicLegacyMetrics = kingpin.Flag("collector.basic.legacy-metrics", "Additionally export the deprecated metrics with values in labels (node_basic_cpu, node_basic_mem, node_basic_disk, node_basic_net_dev, node_basic_process_info), which will be removed in a future release.").Default("true").Bool()
 )
 
 type linuxBasicCollector struct {
-	hostName    *prometheus.Desc
+	exportProcessInfo bool
+	processTopN       int
+	legacyMetrics     bool
+
+	hostName *prometheus.Desc
+
+	cpuInfo          *prometheus.Desc
+	cpuSockets       *prometheus.Desc
+	cpuCores         *prometheus.Desc
+	cpuMHz           *prometheus.Desc
+	memoryTotalBytes *prometheus.Desc
+	diskTotalBytes   *prometheus.Desc
+	netDevInfo       *prometheus.Desc
+	netDevMTUBytes   *prometheus.Desc
+	processes        *prometheus.Desc
+	processCPU       *prometheus.Desc
+	processMemory    *prometheus.Desc
+	topProcessCPU    *prometheus.Desc
+	topProcessRSS    *prometheus.Desc
+	topProcessIO     *prometheus.Desc
+
+	// topMtx guards the samples of the previous scrape in top-N mode.
+	topMtx      sync.Mutex
+	topLast     map[basicProcessKey]basicProcessSample
+	topLastTime time.Time
+
+	// Deprecated metrics, not exported with --no-collector.basic.legacy-metrics.
 	cpu         *prometheus.Desc
 	mem         *prometheus.Desc
 	disk        *prometheus.Desc
@@ -46,21 +81,97 @@ func init() {
 	registerCollector("basic", defaultEnabled, NewLinuxBasicCollector)
 }
 
-// NewCPUCollector returns a new Collector exposing kernel/system statistics.
+// NewLinuxBasicCollector returns a new Collector exposing basic information
+// about the host, its hardware and processes.
 func NewLinuxBasicCollector() (Collector, error) {
+	processLabels := []string{"process_id", "process_name", "process_cmd"}
 	return &linuxBasicCollector{
+		exportProcessInfo: *basicProcessInfo,
+		processTopN:       *basicProcessTopN,
+		legacyMetrics:     *basicLegacyMetrics,
+
 		hostName: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "host_info"),
 			"操作系统信息.",
 			[]string{"hostname", "os", "platform", "platform_family", "platform_version",
 				"host_id", "virtualization_system", "virtualization_role"}, nil,
 		),
+		cpuInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "cpu_info"),
+			"CPU vendor and model, value is always 1.",
+			[]string{"vendor_id", "model_name"}, nil,
+		),
+		cpuSockets: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "cpu_sockets"),
+			"Number of physical CPU packages.",
+			nil, nil,
+		),
+		cpuCores: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "cpu_cores"),
+			"Number of physical CPU cores over all packages.",
+			nil, nil,
+		),
+		cpuMHz: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "cpu_mhz"),
+			"Average clock speed of all logical CPUs in MHz.",
+			nil, nil,
+		),
+		memoryTotalBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "memory_total_bytes"),
+			"Total physical memory in bytes.",
+			nil, nil,
+		),
+		diskTotalBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "disk_total_bytes"),
+			"Total size of all mounted filesystems in bytes.",
+			nil, nil,
+		),
+		netDevInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "net_dev_info"),
+			"Network interface addresses, value is always 1.",
+			[]string{"if_index", "if_name", "ip_address", "hw_address"}, nil,
+		),
+		netDevMTUBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "net_dev_mtu_bytes"),
+			"MTU of the network interface in bytes.",
+			[]string{"if_name"}, nil,
+		),
+		processes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "processes"),
+			"Number of processes.",
+			nil, nil,
+		),
+		processCPU: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "process_cpu_percent"),
+			"CPU usage of the process in percent of one CPU since it was started.",
+			processLabels, nil,
+		),
+		processMemory: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "process_memory_percent"),
+			"Resident memory of the process in percent of the total memory.",
+			processLabels, nil,
+		),
+		topProcessCPU: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "top_process_cpu_percent"),
+			"CPU usage of the top processes by CPU over the last scrape interval in percent of one CPU.",
+			processLabels, nil,
+		),
+		topProcessRSS: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "top_process_resident_memory_bytes"),
+			"Resident memory of the top processes by resident memory in bytes.",
+			processLabels, nil,
+		),
+		topProcessIO: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "top_process_io_bytes_per_second"),
+			"Bytes read from and written to storage per second by the top processes by I/O over the last scrape interval.",
+			processLabels, nil,
+		),
+
 		cpu: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "cpu"),
 			"cpu信息.",
 			[]string{"count", "core", "vendor_id", "model_name", "mhz"}, nil,
 		),
-
 		mem: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, basicCollectorSubsystem, "mem"),
 			"内存信息.",
@@ -106,8 +217,10 @@ func (c *linuxBasicCollector) Update(ch chan<- prometheus.Metric) error {
 		return err
 	}
 
-	if err := c.updateProcessInfo(ch); err != nil {
-		return err
+	if c.exportProcessInfo {
+		if err := c.updateProcessInfo(ch); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -125,7 +238,10 @@ func (c *linuxBasicCollector) updateDisk(ch chan<- prometheus.Metric) error {
 		total = total + b.Total
 	}
 
-	ch <- prometheus.MustNewConstMetric(c.disk, prometheus.CounterValue, 1, strconv.FormatUint(total, 10))
+	ch <- prometheus.MustNewConstMetric(c.diskTotalBytes, prometheus.GaugeValue, float64(total))
+	if c.legacyMetrics {
+		ch <- prometheus.MustNewConstMetric(c.disk, prometheus.CounterValue, 1, strconv.FormatUint(total, 10))
+	}
 	return nil
 
 }
@@ -136,7 +252,7 @@ func (c *linuxBasicCollector) updateHostName(ch chan<- prometheus.Metric) error
 	if err != nil {
 		return err
 	}
-	ch <- prometheus.MustNewConstMetric(c.hostName, prometheus.CounterValue,
+	ch <- prometheus.MustNewConstMetric(c.hostName, prometheus.GaugeValue,
 		1, a.Hostname, a.OS, a.Platform, a.PlatformFamily,
 		a.PlatformVersion, a.HostID, a.VirtualizationSystem, a.VirtualizationRole)
 	return nil
@@ -148,7 +264,10 @@ func (c *linuxBasicCollector) updateMemInfo(ch chan<- prometheus.Metric) error {
 	if err != nil {
 		return err
 	}
-	ch <- prometheus.MustNewConstMetric(c.mem, prometheus.CounterValue, 1, strconv.FormatUint(a.Total, 10))
+	ch <- prometheus.MustNewConstMetric(c.memoryTotalBytes, prometheus.GaugeValue, float64(a.Total))
+	if c.legacyMetrics {
+		ch <- prometheus.MustNewConstMetric(c.mem, prometheus.CounterValue, 1, strconv.FormatUint(a.Total, 10))
+	}
 	return nil
 }
 
@@ -159,8 +278,13 @@ func (c *linuxBasicCollector) updateNetDevInfo(ch chan<- prometheus.Metric) erro
 	}
 	for _, e := range a {
 		s, _ := json.Marshal(e.Addrs)
-		ch <- prometheus.MustNewConstMetric(c.netDev, prometheus.CounterValue, 1, strconv.Itoa(e.Index),
-			e.Name, string(s), e.HardwareAddr, strconv.Itoa(e.MTU))
+		ch <- prometheus.MustNewConstMetric(c.netDevInfo, prometheus.GaugeValue, 1, strconv.Itoa(e.Index),
+			e.Name, string(s), e.HardwareAddr)
+		ch <- prometheus.MustNewConstMetric(c.netDevMTUBytes, prometheus.GaugeValue, float64(e.MTU), e.Name)
+		if c.legacyMetrics {
+			ch <- prometheus.MustNewConstMetric(c.netDev, prometheus.CounterValue, 1, strconv.Itoa(e.Index),
+				e.Name, string(s), e.HardwareAddr, strconv.Itoa(e.MTU))
+		}
 	}
 	return nil
 }
@@ -186,8 +310,14 @@ func (c *linuxBasicCollector) updateCpuInfo(ch chan<- prometheus.Metric) error {
 	}
 	mHz = mHz / float64(len(a))
 	coreNum := len(s.ToSlice()) * len(cores.ToSlice())
-	ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, 1, strconv.Itoa(len(s.ToSlice())),
-		strconv.Itoa(coreNum), a[0].VendorID, a[0].ModelName, strconv.FormatFloat(mHz, 'f', 0, 64))
+	ch <- prometheus.MustNewConstMetric(c.cpuInfo, prometheus.GaugeValue, 1, a[0].VendorID, a[0].ModelName)
+	ch <- prometheus.MustNewConstMetric(c.cpuSockets, prometheus.GaugeValue, float64(len(s.ToSlice())))
+	ch <- prometheus.MustNewConstMetric(c.cpuCores, prometheus.GaugeValue, float64(coreNum))
+	ch <- prometheus.MustNewConstMetric(c.cpuMHz, prometheus.GaugeValue, mHz)
+	if c.legacyMetrics {
+		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, 1, strconv.Itoa(len(s.ToSlice())),
+			strconv.Itoa(coreNum), a[0].VendorID, a[0].ModelName, strconv.FormatFloat(mHz, 'f', 0, 64))
+	}
 	return nil
 }
 
@@ -200,19 +330,35 @@ func (c *linuxBasicCollector) updateProcessInfo(ch chan<- prometheus.Metric) err
 		return errors.New("no process info")
 	}
 	processCount := len(a)
+	ch <- prometheus.MustNewConstMetric(c.processes, prometheus.GaugeValue, float64(processCount))
+	if c.processTopN > 0 {
+		c.updateTopProcesses(ch, a)
+		return nil
+	}
 	for _, pro := range a {
 
 		processId := pro.Pid
 
 		processName, _ := pro.Name()
 		processCmd, _ := pro.Cmdline()
-		if len(processCmd) > 100 {
-			processCmd = processCmd[:50] + "..." + processCmd[len(processCmd)-50:]
-		}
+		processCmd = shortenCmdline(processCmd)
 		processCpuPercent, _ := pro.CPUPercent()
 		processMemPercent, _ := pro.MemoryPercent()
-		ch <- prometheus.MustNewConstMetric(c.processInfo, prometheus.CounterValue, 1, strconv.Itoa(processCount), strconv.Itoa(int(processId)),
-			processName, processCmd, fmt.Sprintf("%f", processCpuPercent), fmt.Sprintf("%f", processMemPercent))
+		pid := strconv.Itoa(int(processId))
+		ch <- prometheus.MustNewConstMetric(c.processCPU, prometheus.GaugeValue, processCpuPercent, pid, processName, processCmd)
+		ch <- prometheus.MustNewConstMetric(c.processMemory, prometheus.GaugeValue, float64(processMemPercent), pid, processName, processCmd)
+		if c.legacyMetrics {
+			ch <- prometheus.MustNewConstMetric(c.processInfo, prometheus.CounterValue, 1, strconv.Itoa(processCount), pid,
+				processName, processCmd, fmt.Sprintf("%f", processCpuPercent), fmt.Sprintf("%f", processMemPercent))
+		}
 	}
 	return nil
 }
+
+// shortenCmdline limits a command line to its first and last 50 characters.
+func shortenCmdline(cmd string) string {
+	if len(cmd) > 100 {
+		return cmd[:50] + "..." + cmd[len(cmd)-50:]
+	}
+	return cmd
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// basicFixtureCollector runs the parts of the basic collector which read
+// the host's information from HOST_PROC and HOST_SYS.
+type basicFixtureCollector struct {
+	*linuxBasicCollector
+}
+
+func (c basicFixtureCollector) Update(ch chan<- prometheus.Metric) error {
+	if err := c.updateCpuInfo(ch); err != nil {
+		return err
+	}
+	if err := c.updateMemInfo(ch); err != nil {
+		return err
+	}
+	return c.updateHostName(ch)
+}
+
+func TestBasicCollector(t *testing.T) {
+	for name, value := range map[string]string{
+		"HOST_PROC": "fixtures/basic/proc",
+		// There is no cpufreq, so the clock speed is read from cpuinfo.
+		"HOST_SYS": "fixtures/basic/sys",
+	} {
+		defer os.Unsetenv(name)
+		os.Setenv(name, value)
+	}
+	defer func(old bool) { *basicLegacyMetrics = old }(*basicLegacyMetrics)
+	*basicLegacyMetrics = true
+
+	c, err := NewLinuxBasicCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorAdapter{basicFixtureCollector{c.(*linuxBasicCollector)}})
+
+	want := `# HELP node_basic_cpu_info CPU vendor and model, value is always 1.
+# TYPE node_basic_cpu_info gauge
+node_basic_cpu_info{model_name="Intel(R) Xeon(R) CPU E5-2620 v4 @ 2.10GHz",vendor_id="GenuineIntel"} 1
+# HELP node_basic_cpu_sockets Number of physical CPU packages.
+# TYPE node_basic_cpu_sockets gauge
+node_basic_cpu_sockets 2
+# HELP node_basic_cpu_cores Number of physical CPU cores over all packages.
+# TYPE node_basic_cpu_cores gauge
+node_basic_cpu_cores 4
+# HELP node_basic_cpu_mhz Average clock speed of all logical CPUs in MHz.
+# TYPE node_basic_cpu_mhz gauge
+node_basic_cpu_mhz 2150
+# HELP node_basic_memory_total_bytes Total physical memory in bytes.
+# TYPE node_basic_memory_total_bytes gauge
+node_basic_memory_total_bytes 3.831959552e+09
+# HELP node_basic_cpu cpu信息.
+# TYPE node_basic_cpu counter
+node_basic_cpu{core="4",count="2",mhz="2150",model_name="Intel(R) Xeon(R) CPU E5-2620 v4 @ 2.10GHz",vendor_id="GenuineIntel"} 1
+# HELP node_basic_mem 内存信息.
+# TYPE node_basic_mem counter
+node_basic_mem{total="3831959552"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want),
+		"node_basic_cpu_info",
+		"node_basic_cpu_sockets",
+		"node_basic_cpu_cores",
+		"node_basic_cpu_mhz",
+		"node_basic_memory_total_bytes",
+		"node_basic_cpu",
+		"node_basic_mem",
+	); err != nil {
+		t.Error(err)
+	}
+
+	// The labels of the host information depend on the host running the test.
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "node_basic_host_info" {
+			continue
+		}
+		found = true
+		if mf.GetType() != dto.MetricType_GAUGE || len(mf.Metric) != 1 || mf.Metric[0].GetGauge().GetValue() != 1 {
+			t.Errorf("want a single gauge with value 1, got %s", mf)
+		}
+	}
+	if !found {
+		t.Error("node_basic_host_info is missing")
+	}
+}
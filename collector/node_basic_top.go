@@ -0,0 +1,158 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shirou/gopsutil/process"
+)
+
+// basicTopOther is the process name of the series summing up all processes
+// which are not among the top ones.
+const basicTopOther = "other"
+
+// basicProcessKey identifies a process across scrapes. The creation time tells
+// apart processes which got the same PID.
+type basicProcessKey struct {
+	pid        int32
+	createTime int64
+}
+
+// basicProcessSample holds the values of a process read in a single scrape.
+type basicProcessSample struct {
+	key  basicProcessKey
+	name string
+	cmd  string
+	// cpuSeconds and ioBytes are the totals since the process started.
+	cpuSeconds float64
+	ioBytes    float64
+	rssBytes   float64
+}
+
+// basicProcessUsage is the usage of a process over the last scrape interval.
+type basicProcessUsage struct {
+	basicProcessSample
+	cpuPercent       float64
+	ioBytesPerSecond float64
+}
+
+// basicProcessUsages computes the CPU and I/O usage of the processes since the
+// previous samples in last, taken at lastTime. Processes without a previous
+// sample, e.g. because they were started after it, are measured since their
+// creation.
+func basicProcessUsages(samples []basicProcessSample, last map[basicProcessKey]basicProcessSample, lastTime, now time.Time) []basicProcessUsage {
+	usages := make([]basicProcessUsage, 0, len(samples))
+	for _, s := range samples {
+		u := basicProcessUsage{basicProcessSample: s}
+		prev, ok := last[s.key]
+		since := lastTime
+		if !ok {
+			prev = basicProcessSample{}
+			since = time.Unix(0, s.key.createTime*int64(time.Millisecond))
+		}
+		if elapsed := now.Sub(since).Seconds(); elapsed > 0 {
+			u.cpuPercent = (s.cpuSeconds - prev.cpuSeconds) / elapsed * 100
+			u.ioBytesPerSecond = (s.ioBytes - prev.ioBytes) / elapsed
+		}
+		usages = append(usages, u)
+	}
+	return usages
+}
+
+// topProcesses returns the n processes with the highest value and the sum of
+// the values of all others.
+func topProcesses(usages []basicProcessUsage, n int, value func(basicProcessUsage) float64) ([]basicProcessUsage, float64) {
+	sorted := make([]basicProcessUsage, len(usages))
+	copy(sorted, usages)
+	sort.Slice(sorted, func(i, j int) bool {
+		if vi, vj := value(sorted[i]), value(sorted[j]); vi != vj {
+			return vi > vj
+		}
+		return sorted[i].key.pid < sorted[j].key.pid
+	})
+	if len(sorted) <= n {
+		return sorted, 0
+	}
+	var other float64
+	for _, u := range sorted[n:] {
+		other += value(u)
+	}
+	return sorted[:n], other
+}
+
+// readBasicProcessSample reads the values of a process. Values which can't be
+// read, e.g. the I/O of other users' processes without root privileges, are
+// left at zero.
+func readBasicProcessSample(p *process.Process) (basicProcessSample, error) {
+	createTime, err := p.CreateTime()
+	if err != nil {
+		return basicProcessSample{}, err
+	}
+	s := basicProcessSample{key: basicProcessKey{pid: p.Pid, createTime: createTime}}
+	s.name, _ = p.Name()
+	cmd, _ := p.Cmdline()
+	s.cmd = shortenCmdline(cmd)
+	if times, err := p.Times(); err == nil {
+		s.cpuSeconds = times.User + times.System
+	}
+	if mem, err := p.MemoryInfo(); err == nil {
+		s.rssBytes = float64(mem.RSS)
+	}
+	if io, err := p.IOCounters(); err == nil {
+		s.ioBytes = float64(io.ReadBytes + io.WriteBytes)
+	}
+	return s, nil
+}
+
+// updateTopProcesses exports the top processes by CPU, resident memory and I/O
+// instead of all processes.
+func (c *linuxBasicCollector) updateTopProcesses(ch chan<- prometheus.Metric, procs []*process.Process) {
+	samples := make([]basicProcessSample, 0, len(procs))
+	for _, p := range procs {
+		// Processes can exit while they're read.
+		if s, err := readBasicProcessSample(p); err == nil {
+			samples = append(samples, s)
+		}
+	}
+	now := time.Now()
+
+	c.topMtx.Lock()
+	usages := basicProcessUsages(samples, c.topLast, c.topLastTime, now)
+	c.topLast = make(map[basicProcessKey]basicProcessSample, len(samples))
+	for _, s := range samples {
+		c.topLast[s.key] = s
+	}
+	c.topLastTime = now
+	c.topMtx.Unlock()
+
+	for _, m := range []struct {
+		desc  *prometheus.Desc
+		value func(basicProcessUsage) float64
+	}{
+		{c.topProcessCPU, func(u basicProcessUsage) float64 { return u.cpuPercent }},
+		{c.topProcessRSS, func(u basicProcessUsage) float64 { return u.rssBytes }},
+		{c.topProcessIO, func(u basicProcessUsage) float64 { return u.ioBytesPerSecond }},
+	} {
+		top, other := topProcesses(usages, c.processTopN, m.value)
+		for _, u := range top {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, m.value(u),
+				strconv.Itoa(int(u.key.pid)), u.name, u.cmd)
+		}
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, other, "", basicTopOther, "")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBasicProcessUsages(t *testing.T) {
+	lastTime := time.Unix(1000, 0)
+	now := lastTime.Add(10 * time.Second)
+
+	running := basicProcessKey{pid: 1, createTime: 500 * 1000}
+	reused := basicProcessKey{pid: 2, createTime: 1005 * 1000}
+	last := map[basicProcessKey]basicProcessSample{
+		running: {key: running, cpuSeconds: 100, ioBytes: 1000},
+		// PID 2 belonged to another process in the previous scrape.
+		{pid: 2, createTime: 600 * 1000}: {cpuSeconds: 50},
+	}
+	usages := basicProcessUsages([]basicProcessSample{
+		{key: running, cpuSeconds: 105, ioBytes: 3000},
+		{key: reused, cpuSeconds: 1, ioBytes: 500},
+	}, last, lastTime, now)
+
+	for i, want := range []struct {
+		cpuPercent       float64
+		ioBytesPerSecond float64
+	}{
+		// Measured over the scrape interval, not since the process started.
+		{cpuPercent: 50, ioBytesPerSecond: 200},
+		// Measured since its creation 5s ago.
+		{cpuPercent: 20, ioBytesPerSecond: 100},
+	} {
+		if got := usages[i]; got.cpuPercent != want.cpuPercent || got.ioBytesPerSecond != want.ioBytesPerSecond {
+			t.Errorf("process %d: want %+v, got cpu %v, io %v", i, want, got.cpuPercent, got.ioBytesPerSecond)
+		}
+	}
+}
+
+func TestTopProcesses(t *testing.T) {
+	var usages []basicProcessUsage
+	for pid, rss := range []float64{10, 40, 20, 40, 5} {
+		usages = append(usages, basicProcessUsage{
+			basicProcessSample: basicProcessSample{key: basicProcessKey{pid: int32(pid)}, rssBytes: rss},
+		})
+	}
+	rss := func(u basicProcessUsage) float64 { return u.rssBytes }
+
+	top, other := topProcesses(usages, 3, rss)
+	var pids []int32
+	for _, u := range top {
+		pids = append(pids, u.key.pid)
+	}
+	if want := []int32{1, 3, 2}; len(pids) != len(want) || pids[0] != want[0] || pids[1] != want[1] || pids[2] != want[2] {
+		t.Errorf("want top pids %v, got %v", want, pids)
+	}
+	if other != 15 {
+		t.Errorf("want other 15, got %v", other)
+	}
+
+	if top, other := topProcesses(usages, 10, rss); len(top) != len(usages) || other != 0 {
+		t.Errorf("want all %d processes and no other, got %d and %v", len(usages), len(top), other)
+	}
+}
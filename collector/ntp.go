@@ -46,6 +46,12 @@ var (
 )
 
 type ntpCollector struct {
+	server          string
+	protocolVersion int
+	ipTTL           int
+	maxDistance     time.Duration
+	offsetTolerance time.Duration
+
 	stratum, leap, rtt, offset, reftime, rootDelay, rootDispersion, sanity typedDesc
 }
 
@@ -72,6 +78,12 @@ func NewNtpCollector() (Collector, error) {
 	}
 
 	return &ntpCollector{
+		server:          *ntpServer,
+		protocolVersion: *ntpProtocolVersion,
+		ipTTL:           *ntpIPTTL,
+		maxDistance:     *ntpMaxDistance,
+		offsetTolerance: *ntpOffsetTolerance,
+
 		stratum: typedDesc{prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, ntpSubsystem, "stratum"),
 			"NTPD stratum.",
@@ -116,9 +128,9 @@ func NewNtpCollector() (Collector, error) {
 }
 
 func (c *ntpCollector) Update(ch chan<- prometheus.Metric) error {
-	resp, err := ntp.QueryWithOptions(*ntpServer, ntp.QueryOptions{
-		Version: *ntpProtocolVersion,
-		TTL:     *ntpIPTTL,
+	resp, err := ntp.QueryWithOptions(c.server, ntp.QueryOptions{
+		Version: c.protocolVersion,
+		TTL:     c.ipTTL,
 		Timeout: time.Second, // default `ntpdate` timeout
 	})
 	if err != nil {
@@ -144,7 +156,7 @@ func (c *ntpCollector) Update(ch chan<- prometheus.Metric) error {
 	// Here is SNTP packet sanity check that is exposed to move burden of
 	// configuration from node_exporter user to the developer.
 
-	maxerr := *ntpOffsetTolerance
+	maxerr := c.offsetTolerance
 	leapMidnightMutex.Lock()
 	if resp.Leap == ntp.LeapAddSecond || resp.Leap == ntp.LeapDelSecond {
 		// state of leapMidnight is cached as leap flag is dropped right after midnight
@@ -156,7 +168,7 @@ func (c *ntpCollector) Update(ch chan<- prometheus.Metric) error {
 	}
 	leapMidnightMutex.Unlock()
 
-	if resp.Validate() == nil && resp.RootDistance <= *ntpMaxDistance && resp.MinError <= maxerr {
+	if resp.Validate() == nil && resp.RootDistance <= c.maxDistance && resp.MinError <= maxerr {
 		ch <- c.sanity.mustNewConstMetric(1)
 	} else {
 		ch <- c.sanity.mustNewConstMetric(0)
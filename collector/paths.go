@@ -29,18 +29,26 @@ var (
 )
 
 func procFilePath(name string) string {
+	flagsMtx.RLock()
+	defer flagsMtx.RUnlock()
 	return filepath.Join(*procPath, name)
 }
 
 func sysFilePath(name string) string {
+	flagsMtx.RLock()
+	defer flagsMtx.RUnlock()
 	return filepath.Join(*sysPath, name)
 }
 
 func rootfsFilePath(name string) string {
+	flagsMtx.RLock()
+	defer flagsMtx.RUnlock()
 	return filepath.Join(*rootfsPath, name)
 }
 
 func rootfsStripPrefix(path string) string {
+	flagsMtx.RLock()
+	defer flagsMtx.RUnlock()
 	if *rootfsPath == "/" {
 		return path
 	}
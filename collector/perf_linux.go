@@ -329,6 +329,36 @@ func (c *perfCollector) Update(ch chan<- prometheus.Metric) error {
 	return nil
 }
 
+// Close implements the closer interface and stops all profilers, releasing
+// their file descriptors.
+func (c *perfCollector) Close() error {
+	type profiler interface {
+		Stop() error
+		Close() error
+	}
+	var profilers []profiler
+	for _, p := range c.perfHwProfilers {
+		profilers = append(profilers, p)
+	}
+	for _, p := range c.perfSwProfilers {
+		profilers = append(profilers, p)
+	}
+	for _, p := range c.perfCacheProfilers {
+		profilers = append(profilers, p)
+	}
+
+	var firstErr error
+	for _, p := range profilers {
+		if err := p.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 func (c *perfCollector) updateHardwareStats(ch chan<- prometheus.Metric) error {
 	for cpu, profiler := range c.perfHwProfilers {
 		cpuStr := fmt.Sprintf("%d", cpu)
@@ -0,0 +1,407 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !noprocess_groups
+
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/procfs"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	processGroupsSubsystem = "process_groups"
+	// processGroupOther holds all processes not matched by any group.
+	processGroupOther = "other"
+	// processUserHZ is the rate of the CPU times in /proc/[pid]/stat, which
+	// is fixed at 100 on all supported architectures.
+	processUserHZ = 100
+)
+
+var (
+	processGroups = kingpin.Flag(
+		"collector.process_groups.groups",
+		"Semicolon-separated list of process groups as group=field:regexp, where field is name, cmdline or user. "+
+			"A process belongs to the first group with a matching regexp, others are counted as \""+processGroupOther+"\". "+
+			"If empty, all processes are counted as \""+processGroupOther+"\".",
+	).Default("").String()
+	processGroupsStaleScrapes = kingpin.Flag(
+		"collector.process_groups.stale-scrapes",
+		"Number of scrapes for which the counters of a group without processes are still exported before they are dropped. Use 0 to keep them.",
+	).Default("10").Int()
+)
+
+// processMatcher assigns processes whose field matches re to group.
+type processMatcher struct {
+	group string
+	field string
+	re    *regexp.Regexp
+}
+
+// processCounters are the cumulative values of a process or group.
+type processCounters struct {
+	userSeconds   float64
+	systemSeconds float64
+	readBytes     float64
+	writeBytes    float64
+}
+
+func (c *processCounters) add(o processCounters) {
+	c.userSeconds += o.userSeconds
+	c.systemSeconds += o.systemSeconds
+	c.readBytes += o.readBytes
+	c.writeBytes += o.writeBytes
+}
+
+// sub returns the increase of c since o. Values which went down are treated
+// as unchanged, so that the counters of a group never decrease.
+func (c processCounters) sub(o processCounters) processCounters {
+	return processCounters{
+		userSeconds:   math.Max(c.userSeconds-o.userSeconds, 0),
+		systemSeconds: math.Max(c.systemSeconds-o.systemSeconds, 0),
+		readBytes:     math.Max(c.readBytes-o.readBytes, 0),
+		writeBytes:    math.Max(c.writeBytes-o.writeBytes, 0),
+	}
+}
+
+// processGroupStats are the values of a group in a single scrape.
+type processGroupStats struct {
+	processes     float64
+	threads       float64
+	residentBytes float64
+	swapBytes     float64
+	openFDs       float64
+}
+
+// processID identifies a process across scrapes. The start time tells apart
+// processes which got the same PID.
+type processID struct {
+	pid       int
+	startTime uint64
+}
+
+type processGroupsCollector struct {
+	fs           procfs.FS
+	matchers     []processMatcher
+	staleScrapes int
+
+	// mtx guards the state kept between scrapes.
+	mtx sync.Mutex
+	// counters holds the accumulated counters of each group, so they keep
+	// increasing when processes exit.
+	counters map[string]*processCounters
+	// idleScrapes holds the number of scrapes since a group last had any
+	// processes.
+	idleScrapes map[string]int
+	// last holds the counters of each process seen in the previous scrape.
+	last map[processID]processCounters
+	// users caches the names of user IDs.
+	users map[string]string
+
+	processes     *prometheus.Desc
+	cpuSeconds    *prometheus.Desc
+	ioBytes       *prometheus.Desc
+	threads       *prometheus.Desc
+	residentBytes *prometheus.Desc
+	swapBytes     *prometheus.Desc
+	openFDs       *prometheus.Desc
+}
+
+func init() {
+	registerCollector("process_groups", defaultDisabled, NewProcessGroupsCollector)
+}
+
+// NewProcessGroupsCollector returns a new Collector exposing the resource usage
+// of groups of processes read from the proc filesystem.
+func NewProcessGroupsCollector() (Collector, error) {
+	fs, err := procfs.NewFS(*procPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open procfs: %v", err)
+	}
+	matchers, err := parseProcessGroups(*processGroups)
+	if err != nil {
+		return nil, err
+	}
+	if *processGroupsStaleScrapes < 0 {
+		return nil, fmt.Errorf("--collector.process_groups.stale-scrapes must not be negative")
+	}
+	labels := []string{"group"}
+	return &processGroupsCollector{
+		fs:           fs,
+		matchers:     matchers,
+		staleScrapes: *processGroupsStaleScrapes,
+		counters:     map[string]*processCounters{},
+		idleScrapes:  map[string]int{},
+		last:         map[processID]processCounters{},
+		users:        map[string]string{},
+		processes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "processes"),
+			"Number of processes in the group.",
+			labels, nil,
+		),
+		cpuSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "cpu_seconds_total"),
+			"CPU time spent by the processes of the group.",
+			[]string{"group", "mode"}, nil,
+		),
+		ioBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "io_bytes_total"),
+			"Bytes read from or written to storage by the processes of the group.",
+			[]string{"group", "direction"}, nil,
+		),
+		threads: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "threads"),
+			"Number of threads of the processes of the group.",
+			labels, nil,
+		),
+		residentBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "resident_memory_bytes"),
+			"Resident memory size of the processes of the group.",
+			labels, nil,
+		),
+		swapBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "swap_bytes"),
+			"Swapped out memory of the processes of the group.",
+			labels, nil,
+		),
+		openFDs: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, processGroupsSubsystem, "open_fds"),
+			"Number of open file descriptors of the processes of the group.",
+			labels, nil,
+		),
+	}, nil
+}
+
+// parseProcessGroups parses the value of --collector.process_groups.groups.
+func parseProcessGroups(spec string) ([]processMatcher, error) {
+	var matchers []processMatcher
+	for _, def := range strings.Split(spec, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		parts := strings.SplitN(def, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid process group %q, expected group=field:regexp", def)
+		}
+		fieldRe := strings.SplitN(parts[1], ":", 2)
+		if len(fieldRe) != 2 {
+			return nil, fmt.Errorf("invalid process group %q, expected group=field:regexp", def)
+		}
+		switch fieldRe[0] {
+		case "name", "cmdline", "user":
+		default:
+			return nil, fmt.Errorf("invalid process group %q, unknown field %q", def, fieldRe[0])
+		}
+		re, err := regexp.Compile(fieldRe[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid process group %q: %s", def, err)
+		}
+		matchers = append(matchers, processMatcher{group: parts[0], field: fieldRe[0], re: re})
+	}
+	return matchers, nil
+}
+
+func (c *processGroupsCollector) Update(ch chan<- prometheus.Metric) error {
+	procs, err := c.fs.AllProcs()
+	if err != nil {
+		return fmt.Errorf("couldn't get processes: %s", err)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	stats := map[string]*processGroupStats{}
+	seen := make(map[processID]processCounters, len(procs))
+	for _, p := range procs {
+		stat, err := p.Stat()
+		if err != nil {
+			// Processes can vanish between listing and reading them.
+			if !os.IsNotExist(err) {
+				log.Debugf("couldn't read stat of process %d: %s", p.PID, err)
+			}
+			continue
+		}
+		group, err := c.group(p, stat)
+		if err != nil {
+			log.Debugf("couldn't match process %d: %s", p.PID, err)
+			continue
+		}
+
+		s, ok := stats[group]
+		if !ok {
+			s = &processGroupStats{}
+			stats[group] = s
+		}
+		s.processes++
+		s.threads += float64(stat.NumThreads)
+
+		if status, err := p.NewStatus(); err == nil {
+			s.residentBytes += float64(status.VmRSS)
+			s.swapBytes += float64(status.VmSwap)
+		} else {
+			s.residentBytes += float64(stat.ResidentMemory())
+		}
+		// The file descriptors and I/O of other users' processes can only be
+		// read with sufficient privileges.
+		if fds, err := p.FileDescriptorsLen(); err == nil {
+			s.openFDs += float64(fds)
+		}
+
+		id := processID{pid: p.PID, startTime: stat.Starttime}
+		last, known := c.last[id]
+		current := processCounters{
+			userSeconds:   float64(stat.UTime) / processUserHZ,
+			systemSeconds: float64(stat.STime) / processUserHZ,
+		}
+		if pio, err := p.IO(); err == nil {
+			current.readBytes = float64(pio.ReadBytes)
+			current.writeBytes = float64(pio.WriteBytes)
+		} else if known {
+			// Keep the I/O of the last scrape, e.g. of an exiting process,
+			// instead of dropping it to zero.
+			current.readBytes = last.readBytes
+			current.writeBytes = last.writeBytes
+		}
+
+		seen[id] = current
+		counters, ok := c.counters[group]
+		if !ok {
+			counters = &processCounters{}
+			c.counters[group] = counters
+		}
+		// Only the increase since the last scrape is added, a new process
+		// contributes everything it used so far.
+		if known {
+			counters.add(current.sub(last))
+		} else {
+			counters.add(current)
+		}
+	}
+	c.last = seen
+
+	for group, counters := range c.counters {
+		s, ok := stats[group]
+		if ok {
+			delete(c.idleScrapes, group)
+		} else {
+			// Keep exporting the counters of groups without processes for a
+			// while, they would otherwise restart from zero once a process
+			// shows up again.
+			c.idleScrapes[group]++
+			if c.staleScrapes > 0 && c.idleScrapes[group] > c.staleScrapes {
+				delete(c.counters, group)
+				delete(c.idleScrapes, group)
+				continue
+			}
+			s = &processGroupStats{}
+		}
+		ch <- prometheus.MustNewConstMetric(c.processes, prometheus.GaugeValue, s.processes, group)
+		ch <- prometheus.MustNewConstMetric(c.threads, prometheus.GaugeValue, s.threads, group)
+		ch <- prometheus.MustNewConstMetric(c.residentBytes, prometheus.GaugeValue, s.residentBytes, group)
+		ch <- prometheus.MustNewConstMetric(c.swapBytes, prometheus.GaugeValue, s.swapBytes, group)
+		ch <- prometheus.MustNewConstMetric(c.openFDs, prometheus.GaugeValue, s.openFDs, group)
+		ch <- prometheus.MustNewConstMetric(c.cpuSeconds, prometheus.CounterValue, counters.userSeconds, group, "user")
+		ch <- prometheus.MustNewConstMetric(c.cpuSeconds, prometheus.CounterValue, counters.systemSeconds, group, "system")
+		ch <- prometheus.MustNewConstMetric(c.ioBytes, prometheus.CounterValue, counters.readBytes, group, "read")
+		ch <- prometheus.MustNewConstMetric(c.ioBytes, prometheus.CounterValue, counters.writeBytes, group, "write")
+	}
+	return nil
+}
+
+// group returns the group of a process. Without matchers, all processes are
+// in the group other, so that the number of groups is bounded.
+func (c *processGroupsCollector) group(p procfs.Proc, stat procfs.ProcStat) (string, error) {
+	if len(c.matchers) == 0 {
+		return processGroupOther, nil
+	}
+	var cmdline, username string
+	for _, m := range c.matchers {
+		var value string
+		switch m.field {
+		case "name":
+			value = stat.Comm
+		case "cmdline":
+			if cmdline == "" {
+				args, err := p.CmdLine()
+				if err != nil {
+					return "", err
+				}
+				cmdline = strings.Join(args, " ")
+			}
+			value = cmdline
+		case "user":
+			if username == "" {
+				uid, err := readProcessUID(p.PID)
+				if err != nil {
+					return "", err
+				}
+				username = c.userName(uid)
+			}
+			value = username
+		}
+		if m.re.MatchString(value) {
+			return m.group, nil
+		}
+	}
+	return processGroupOther, nil
+}
+
+// userName returns the name of the user with the given ID, or the ID itself if
+// the user is unknown.
+func (c *processGroupsCollector) userName(uid string) string {
+	if name, ok := c.users[uid]; ok {
+		return name
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	c.users[uid] = name
+	return name
+}
+
+// readProcessUID returns the real user ID of a process, which procfs doesn't
+// parse from the status file.
+func readProcessUID(pid int) (string, error) {
+	f, err := os.Open(procFilePath(strconv.Itoa(pid) + "/status"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no Uid in status of process %d", pid)
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !noprocess_groups
+
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/procfs"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// collectValues runs c.Update and returns the values of all samples keyed by
+// the fully-qualified name and the label values, e.g.
+// node_process_groups_threads{kernel}.
+func collectValues(t *testing.T, c Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Update(ch)
+		close(ch)
+	}()
+	values := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		name := m.Desc().String()
+		name = name[strings.Index(name, `"`)+1:]
+		name = name[:strings.Index(name, `"`)]
+		var labels []string
+		for _, l := range pb.GetLabel() {
+			labels = append(labels, l.GetValue())
+		}
+		values[name+"{"+strings.Join(labels, ",")+"}"] = pb.GetGauge().GetValue() + pb.GetCounter().GetValue()
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestProcessGroups(t *testing.T) {
+	for _, tc := range []struct {
+		groups string
+		group  string
+	}{
+		{groups: "", group: "other"},
+		{groups: "kernel=name:^khung", group: "kernel"},
+		{groups: "web=name:^nginx$;watchdog=cmdline:--watchdog", group: "watchdog"},
+		{groups: "admin=user:^(root|0)$", group: "admin"},
+		{groups: "web=name:^nginx$", group: "other"},
+	} {
+		if _, err := kingpin.CommandLine.Parse([]string{
+			"--path.procfs", "fixtures/proc",
+			"--collector.process_groups.groups", tc.groups,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewProcessGroupsCollector()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The counters must not change between scrapes of unchanged processes.
+		for i := 0; i < 2; i++ {
+			values := collectValues(t, c)
+			for name, want := range map[string]float64{
+				"node_process_groups_processes":             1,
+				"node_process_groups_threads":               1,
+				"node_process_groups_resident_memory_bytes": 2048 * 1024,
+				"node_process_groups_swap_bytes":            512 * 1024,
+				"node_process_groups_open_fds":              3,
+				"node_process_groups_cpu_seconds_total":     0.14,
+				"node_process_groups_io_bytes_total":        1024,
+			} {
+				key := name + "{" + tc.group + "}"
+				switch name {
+				case "node_process_groups_cpu_seconds_total":
+					key = name + "{" + tc.group + ",user}"
+				case "node_process_groups_io_bytes_total":
+					key = name + "{read," + tc.group + "}"
+				}
+				if got, ok := values[key]; !ok || got != want {
+					t.Errorf("groups %q, scrape %d: %s: want %v, got %v (present: %v)", tc.groups, i, key, want, got, ok)
+				}
+			}
+		}
+	}
+}
+
+func TestParseProcessGroupsInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"web",
+		"=name:nginx",
+		"web=nginx",
+		"web=exe:nginx",
+		"web=name:(",
+	} {
+		if _, err := parseProcessGroups(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestProcessGroupsStale(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{
+		"--path.procfs", "fixtures/proc",
+		"--collector.process_groups.groups", "kernel=name:^khung",
+		"--collector.process_groups.stale-scrapes", "2",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewProcessGroupsCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "node_process_groups_cpu_seconds_total{kernel,user}"
+	if _, ok := collectValues(t, c)[key]; !ok {
+		t.Fatalf("%s is missing", key)
+	}
+
+	// All processes exit.
+	dir, err := ioutil.TempDir("", "process_groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if c.(*processGroupsCollector).fs, err = procfs.NewFS(dir); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, true, false, false} {
+		if _, got := collectValues(t, c)[key]; got != want {
+			t.Errorf("scrape %d without processes: want %s present %v, got %v", i+1, key, want, got)
+		}
+	}
+}
+
+func TestProcessGroupsIOReadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process_groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	procDir := filepath.Join(dir, "10")
+	if err := os.Mkdir(procDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	copyFile := func(name string) {
+		b, err := ioutil.ReadFile(filepath.Join("fixtures/proc/10", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(procDir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"stat", "status", "io"} {
+		copyFile(name)
+	}
+
+	if _, err := kingpin.CommandLine.Parse([]string{
+		"--path.procfs", dir,
+		"--collector.process_groups.groups", "",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewProcessGroupsCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const key = "node_process_groups_io_bytes_total{read,other}"
+	for i, prepare := range []func(){
+		func() {},
+		// The I/O of the process can't be read, e.g. because it's exiting.
+		func() {
+			if err := os.Remove(filepath.Join(procDir, "io")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() { copyFile("io") },
+	} {
+		prepare()
+		if got := collectValues(t, c)[key]; got != 1024 {
+			t.Errorf("scrape %d: %s: want 1024, got %v", i+1, key, got)
+		}
+	}
+}
@@ -26,6 +26,8 @@ import (
 )
 
 type qdiscStatCollector struct {
+	fixtures string
+
 	bytes      typedDesc
 	packets    typedDesc
 	drops      typedDesc
@@ -44,6 +46,8 @@ func init() {
 // NewQdiscStatCollector returns a new Collector exposing queuing discipline statistics.
 func NewQdiscStatCollector() (Collector, error) {
 	return &qdiscStatCollector{
+		fixtures: *collectorQdisc,
+
 		bytes: typedDesc{prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "qdisc", "bytes_total"),
 			"Number of bytes sent.",
@@ -88,7 +92,7 @@ func (c *qdiscStatCollector) Update(ch chan<- prometheus.Metric) error {
 	var msgs []qdisc.QdiscInfo
 	var err error
 
-	fixtures := *collectorQdisc
+	fixtures := c.fixtures
 
 	if fixtures == "" {
 		msgs, err = qdisc.Get()
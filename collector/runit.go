@@ -26,6 +26,8 @@ var runitServiceDir = kingpin.Flag("collector.runit.servicedir", "Path to runit
 
 type runitCollector struct {
 	state, stateDesired, stateNormal, stateTimestamp typedDesc
+
+	serviceDir string
 }
 
 func init() {
@@ -41,6 +43,7 @@ func NewRunitCollector() (Collector, error) {
 	)
 
 	return &runitCollector{
+		serviceDir: *runitServiceDir,
 		state: typedDesc{prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, subsystem, "state"),
 			"State of runit service.",
@@ -65,7 +68,7 @@ func NewRunitCollector() (Collector, error) {
 }
 
 func (c *runitCollector) Update(ch chan<- prometheus.Metric) error {
-	services, err := runit.GetServices(*runitServiceDir)
+	services, err := runit.GetServices(c.serviceDir)
 	if err != nil {
 		return err
 	}
@@ -29,6 +29,7 @@ var (
 )
 
 type supervisordCollector struct {
+	url            string
 	upDesc         *prometheus.Desc
 	stateDesc      *prometheus.Desc
 	exitStatusDesc *prometheus.Desc
@@ -46,6 +47,7 @@ func NewSupervisordCollector() (Collector, error) {
 		labelNames = []string{"name", "group"}
 	)
 	return &supervisordCollector{
+		url: *supervisordURL,
 		upDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, subsystem, "up"),
 			"Process Up",
@@ -108,7 +110,7 @@ func (c *supervisordCollector) Update(ch chan<- prometheus.Metric) error {
 		PID           int    `xmlrpc:"pid"`
 	}
 
-	res, err := xmlrpc.Call(*supervisordURL, "supervisor.getAllProcessInfo")
+	res, err := xmlrpc.Call(c.url, "supervisor.getAllProcessInfo")
 	if err != nil {
 		return fmt.Errorf("unable to call supervisord: %s", err)
 	}
@@ -52,6 +52,10 @@ type systemdCollector struct {
 	socketRefusedConnectionsDesc  *prometheus.Desc
 	unitWhitelistPattern          *regexp.Regexp
 	unitBlacklistPattern          *regexp.Regexp
+	enableStartTimeMetrics        bool
+	enableTaskMetrics             bool
+	enableRestartsMetrics         bool
+	private                       bool
 }
 
 var unitStatesName = []string{"active", "activating", "deactivating", "inactive", "failed"}
@@ -120,6 +124,10 @@ func NewSystemdCollector() (Collector, error) {
 		socketRefusedConnectionsDesc:  socketRefusedConnectionsDesc,
 		unitWhitelistPattern:          unitWhitelistPattern,
 		unitBlacklistPattern:          unitBlacklistPattern,
+		enableStartTimeMetrics:        *enableStartTimeMetrics,
+		enableTaskMetrics:             *enableTaskMetrics,
+		enableRestartsMetrics:         *enableRestartsMetrics,
+		private:                       *systemdPrivate,
 	}, nil
 }
 
@@ -159,7 +167,7 @@ func (c *systemdCollector) Update(ch chan<- prometheus.Metric) error {
 		log.Debugf("systemd collectUnitStatusMetrics took %f", time.Since(begin).Seconds())
 	}()
 
-	if *enableStartTimeMetrics {
+	if c.enableStartTimeMetrics {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -169,7 +177,7 @@ func (c *systemdCollector) Update(ch chan<- prometheus.Metric) error {
 		}()
 	}
 
-	if *enableTaskMetrics {
+	if c.enableTaskMetrics {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -228,7 +236,7 @@ func (c *systemdCollector) collectUnitStatusMetrics(conn *dbus.Conn, ch chan<- p
 				c.unitDesc, prometheus.GaugeValue, isActive,
 				unit.Name, stateName, serviceType)
 		}
-		if *enableRestartsMetrics && strings.HasSuffix(unit.Name, ".service") {
+		if c.enableRestartsMetrics && strings.HasSuffix(unit.Name, ".service") {
 			// NRestarts wasn't added until systemd 235.
 			restartsCount, err := conn.GetUnitTypeProperty(unit.Name, "Service", "NRestarts")
 			if err != nil {
@@ -370,7 +378,7 @@ func (c *systemdCollector) collectSystemState(conn *dbus.Conn, ch chan<- prometh
 }
 
 func (c *systemdCollector) newDbus() (*dbus.Conn, error) {
-	if *systemdPrivate {
+	if c.private {
 		return dbus.NewSystemdConnection()
 	}
 	return dbus.New()
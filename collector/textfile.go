@@ -28,23 +28,158 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	textFileDirectory = kingpin.Flag("collector.textfile.directory", "Directory to read text files with metrics from.").Default("").String()
-	mtimeDesc         = prometheus.NewDesc(
+	textFileDirectories = repeatableStrings(kingpin.Flag("collector.textfile.directory", "Directory or glob pattern to read text files with metrics from, can be repeated.").Default(""))
+	textFileRecursive   = kingpin.Flag("collector.textfile.recursive", "Also read text files from the subdirectories of the textfile directories.").Default("false").Bool()
+	textFileMaxAges     = repeatableStrings(kingpin.Flag("collector.textfile.max-age", "Maximum age of text files after which their metrics are dropped, as duration for all files or as path=duration for the files in a directory or matching a glob pattern, can be repeated."))
+	textFileTimestamps  = kingpin.Flag("collector.textfile.timestamps", "Pass explicit sample timestamps in text files through instead of skipping the files.").Default("false").Bool()
+	mtimeDesc           = prometheus.NewDesc(
 		"node_textfile_mtime_seconds",
 		"Unixtime mtime of textfiles successfully read.",
-		[]string{"file"},
+		[]string{"file", "source_dir"},
+		nil,
+	)
+	staleDesc = prometheus.NewDesc(
+		"node_textfile_stale",
+		"1 if the textfile is older than its maximum age and its metrics are dropped, 0 otherwise.",
+		[]string{"file", "source_dir"},
+		nil,
+	)
+	fileErrorDesc = prometheus.NewDesc(
+		"node_textfile_file_error",
+		"1 if the textfile couldn't be read, with the reason.",
+		[]string{"file", "source_dir", "reason"},
 		nil,
 	)
 )
 
+// stringsValue is the value of a repeatable string flag. Unlike kingpin's own
+// it can be emptied by Reset, so that the values don't add up when the flags
+// are parsed again on reloads.
+type stringsValue []string
+
+func repeatableStrings(f *kingpin.FlagClause) *[]string {
+	v := &stringsValue{}
+	f.SetValue(v)
+	return (*[]string)(v)
+}
+
+func (v *stringsValue) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+func (v *stringsValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+// Get returns a copy of the values.
+func (v *stringsValue) Get() interface{} {
+	return append([]string(nil), *v...)
+}
+
+func (v *stringsValue) IsCumulative() bool {
+	return true
+}
+
+func (v *stringsValue) Reset() {
+	*v = nil
+}
+
 type textFileCollector struct {
-	path string
+	// paths are directories or glob patterns matching directories and
+	// files.
+	paths     []string
+	recursive bool
+	maxAges   []textFileMaxAge
+	// timestamps passes sample timestamps through.
+	timestamps bool
+	// explicitFiles reads the files given by name in paths whatever their
+	// extension, so that textfile-lint can check files before they're
+	// renamed to *.prom.
+	explicitFiles bool
 	// Only set for testing to get predictable output.
 	mtime *float64
+	now   func() time.Time
+}
+
+// textFileMaxAge is the maximum age of the files matching a pattern.
+type textFileMaxAge struct {
+	// pattern is a directory, which matches the files in it and its
+	// subdirectories, or a glob pattern matching files. It's empty for the
+	// default of all other files.
+	pattern string
+	maxAge  time.Duration
+}
+
+// parseTextFileMaxAges parses the values of --collector.textfile.max-age,
+// either a duration or pattern=duration.
+func parseTextFileMaxAges(values []string) ([]textFileMaxAge, error) {
+	var maxAges []textFileMaxAge
+	for _, value := range values {
+		pattern, duration := "", value
+		if i := strings.LastIndex(value, "="); i >= 0 {
+			pattern, duration = value[:i], value[i+1:]
+			if pattern == "" {
+				return nil, fmt.Errorf("empty path in textfile max age %q", value)
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid path in textfile max age %q: %s", value, err)
+			}
+		}
+		maxAge, err := model.ParseDuration(duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid textfile max age %q: %s", value, err)
+		}
+		maxAges = append(maxAges, textFileMaxAge{pattern: pattern, maxAge: time.Duration(maxAge)})
+	}
+	return maxAges, nil
+}
+
+// matches returns whether the maximum age applies to file.
+func (m textFileMaxAge) matches(file textFile) bool {
+	path := file.path()
+	if ok, _ := filepath.Match(m.pattern, path); ok {
+		return true
+	}
+	dir := filepath.Clean(m.pattern)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// textFile is a text file found in a source directory. The name is relative
+// to the directory, which it's reported with.
+type textFile struct {
+	sourceDir string
+	name      string
+}
+
+func (f textFile) path() string {
+	return filepath.Join(f.sourceDir, f.name)
+}
+
+// Reasons of textFileErrors.
+const (
+	textFileErrorOpen       = "open"
+	textFileErrorParse      = "parse"
+	textFileErrorTimestamps = "timestamps"
+	textFileErrorStat       = "stat"
+	textFileErrorDuplicate  = "duplicate"
+)
+
+// textFileError is an error reading a text file, which is exported in
+// node_textfile_file_error with its reason.
+type textFileError struct {
+	file   textFile
+	reason string
+	err    error
+}
+
+func (e *textFileError) Error() string {
+	return e.err.Error()
 }
 
 func init() {
@@ -52,10 +187,22 @@ func init() {
 }
 
 // NewTextFileCollector returns a new Collector exposing metrics read from files
-// in the given textfile directory.
+// in the given textfile directories.
 func NewTextFileCollector() (Collector, error) {
+	maxAges, err := parseTextFileMaxAges(*textFileMaxAges)
+	if err != nil {
+		return nil, err
+	}
 	c := &textFileCollector{
-		path: *textFileDirectory,
+		recursive:  *textFileRecursive,
+		maxAges:    maxAges,
+		timestamps: *textFileTimestamps,
+		now:        time.Now,
+	}
+	for _, path := range *textFileDirectories {
+		if path != "" {
+			c.paths = append(c.paths, path)
+		}
 	}
 	return c, nil
 }
@@ -75,10 +222,6 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 	}
 
 	for _, metric := range metricFamily.Metric {
-		if metric.TimestampMs != nil {
-			log.Warnf("Ignoring unsupported custom timestamp on textfile collector metric %v", metric)
-		}
-
 		labels := metric.GetLabel()
 		var names []string
 		var values []string
@@ -120,7 +263,7 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 			for _, q := range metric.Summary.Quantile {
 				quantiles[q.GetQuantile()] = q.GetValue()
 			}
-			ch <- prometheus.MustNewConstSummary(
+			ch <- withTimestamp(metric, prometheus.MustNewConstSummary(
 				prometheus.NewDesc(
 					*metricFamily.Name,
 					metricFamily.GetHelp(),
@@ -129,13 +272,13 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 				metric.Summary.GetSampleCount(),
 				metric.Summary.GetSampleSum(),
 				quantiles, values...,
-			)
+			))
 		case dto.MetricType_HISTOGRAM:
 			buckets := map[float64]uint64{}
 			for _, b := range metric.Histogram.Bucket {
 				buckets[b.GetUpperBound()] = b.GetCumulativeCount()
 			}
-			ch <- prometheus.MustNewConstHistogram(
+			ch <- withTimestamp(metric, prometheus.MustNewConstHistogram(
 				prometheus.NewDesc(
 					*metricFamily.Name,
 					metricFamily.GetHelp(),
@@ -144,103 +287,300 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 				metric.Histogram.GetSampleCount(),
 				metric.Histogram.GetSampleSum(),
 				buckets, values...,
-			)
+			))
 		default:
 			panic("unknown metric type")
 		}
 		if metricType == dto.MetricType_GAUGE || metricType == dto.MetricType_COUNTER || metricType == dto.MetricType_UNTYPED {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- withTimestamp(metric, prometheus.MustNewConstMetric(
 				prometheus.NewDesc(
 					*metricFamily.Name,
 					metricFamily.GetHelp(),
 					names, nil,
 				),
 				valType, val, values...,
-			)
+			))
 		}
 	}
 }
 
-func (c *textFileCollector) exportMTimes(mtimes map[string]time.Time, ch chan<- prometheus.Metric) {
+// withTimestamp adds the timestamp of sample to m if it has one, which is only
+// the case with --collector.textfile.timestamps.
+func withTimestamp(sample *dto.Metric, m prometheus.Metric) prometheus.Metric {
+	if sample.TimestampMs == nil {
+		return m
+	}
+	return prometheus.NewMetricWithTimestamp(time.Unix(0, sample.GetTimestampMs()*int64(time.Millisecond)), m)
+}
+
+// sortTextFiles sorts files by directory and name, which is needed for
+// predictable output comparison in tests.
+func sortTextFiles(files []textFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].sourceDir != files[j].sourceDir {
+			return files[i].sourceDir < files[j].sourceDir
+		}
+		return files[i].name < files[j].name
+	})
+}
+
+func (c *textFileCollector) exportMTimes(mtimes map[textFile]time.Time, ch chan<- prometheus.Metric) {
 	// Export the mtimes of the successful files.
 	if len(mtimes) > 0 {
-		// Sorting is needed for predictable output comparison in tests.
-		filenames := make([]string, 0, len(mtimes))
-		for filename := range mtimes {
-			filenames = append(filenames, filename)
+		files := make([]textFile, 0, len(mtimes))
+		for file := range mtimes {
+			files = append(files, file)
 		}
-		sort.Strings(filenames)
+		sortTextFiles(files)
 
-		for _, filename := range filenames {
-			mtime := float64(mtimes[filename].UnixNano() / 1e9)
+		for _, file := range files {
+			mtime := float64(mtimes[file].UnixNano() / 1e9)
 			if c.mtime != nil {
 				mtime = *c.mtime
 			}
-			ch <- prometheus.MustNewConstMetric(mtimeDesc, prometheus.GaugeValue, mtime, filename)
+			ch <- prometheus.MustNewConstMetric(mtimeDesc, prometheus.GaugeValue, mtime, file.name, file.sourceDir)
 		}
 	}
 }
 
-// Update implements the Collector interface.
-func (c *textFileCollector) Update(ch chan<- prometheus.Metric) error {
-	error := 0.0
-	mtimes := map[string]time.Time{}
+// exportFileErrors exports the errors of the files which couldn't be read.
+func (c *textFileCollector) exportFileErrors(errs []*textFileError, ch chan<- prometheus.Metric) {
+	sort.Slice(errs, func(i, j int) bool {
+		a, b := errs[i].file, errs[j].file
+		if a != b {
+			return a.sourceDir < b.sourceDir || a.sourceDir == b.sourceDir && a.name < b.name
+		}
+		return errs[i].reason < errs[j].reason
+	})
 
-	// Iterate over files and accumulate their metrics.
-	files, err := ioutil.ReadDir(c.path)
-	if err != nil && c.path != "" {
-		log.Errorf("Error reading textfile collector directory %q: %s", c.path, err)
-		error = 1.0
+	for _, err := range errs {
+		ch <- prometheus.MustNewConstMetric(fileErrorDesc, prometheus.GaugeValue, 1, err.file.name, err.file.sourceDir, err.reason)
 	}
+}
 
-	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), ".prom") {
-			continue
+// exportStale exports whether the files with a maximum age are stale.
+func (c *textFileCollector) exportStale(stale map[textFile]bool, ch chan<- prometheus.Metric) {
+	files := make([]textFile, 0, len(stale))
+	for file := range stale {
+		files = append(files, file)
+	}
+	sortTextFiles(files)
+
+	for _, file := range files {
+		value := 0.0
+		if stale[file] {
+			value = 1
 		}
-		path := filepath.Join(c.path, f.Name())
-		file, err := os.Open(path)
-		if err != nil {
-			log.Errorf("Error opening %q: %v", path, err)
-			error = 1.0
+		ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.GaugeValue, value, file.name, file.sourceDir)
+	}
+}
+
+// maxAge returns the maximum age of file, or 0 if it has none. The first
+// matching pattern applies, the default applies to files matching none.
+func (c *textFileCollector) maxAge(file textFile) time.Duration {
+	var maxAge time.Duration
+	for _, m := range c.maxAges {
+		if m.pattern == "" {
+			maxAge = m.maxAge
 			continue
 		}
-		defer file.Close()
-		var parser expfmt.TextParser
-		parsedFamilies, err := parser.TextToMetricFamilies(file)
+		if m.matches(file) {
+			return m.maxAge
+		}
+	}
+	return maxAge
+}
+
+// findFiles returns the *.prom files in the textfile directories, and the
+// errors looking for them. Glob patterns which don't match anything aren't
+// an error, e.g. if a package isn't installed. A file found more than once,
+// e.g. by overlapping patterns or through a symlink, is only returned the
+// first time, the other times are returned as textFileErrors.
+func (c *textFileCollector) findFiles() ([]textFile, []error) {
+	var (
+		files []textFile
+		errs  []error
+		// seen are the found files by their resolved path.
+		seen = map[string]textFile{}
+	)
+	add := func(file textFile) {
+		resolved, err := filepath.EvalSymlinks(file.path())
 		if err != nil {
-			log.Errorf("Error parsing %q: %v", path, err)
-			error = 1.0
-			continue
+			resolved = file.path()
 		}
-		if hasTimestamps(parsedFamilies) {
-			log.Errorf("Textfile %q contains unsupported client-side timestamps, skipping entire file", path)
-			error = 1.0
-			continue
+		if resolved, err = filepath.Abs(resolved); err != nil {
+			resolved = file.path()
+		}
+		if first, ok := seen[resolved]; ok {
+			errs = append(errs, &textFileError{
+				file:   file,
+				reason: textFileErrorDuplicate,
+				err:    fmt.Errorf("textfile %q is the same file as %q, skipping it", file.path(), first.path()),
+			})
+			return
 		}
+		seen[resolved] = file
+		files = append(files, file)
+	}
 
-		for _, mf := range parsedFamilies {
-			if mf.Help == nil {
-				help := fmt.Sprintf("Metric read from %s", path)
-				mf.Help = &help
+	for _, pattern := range c.paths {
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("failed to match textfile pattern %q: %v", pattern, err))
+				continue
 			}
 		}
 
-		// Only set this once it has been parsed and validated, so that
-		// a failure does not appear fresh.
-		stat, err := file.Stat()
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to read textfile directory %q: %v", match, err))
+				continue
+			}
+			if !info.IsDir() {
+				if strings.HasSuffix(match, ".prom") || c.explicitFiles && match == pattern {
+					add(textFile{sourceDir: filepath.Dir(match), name: filepath.Base(match)})
+				}
+				continue
+			}
+			dirFiles, err := c.readDir(match)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to read textfile directory %q: %v", match, err))
+			}
+			for _, file := range dirFiles {
+				add(file)
+			}
+		}
+	}
+	return files, errs
+}
+
+// readDir returns the *.prom files in dir, and in its subdirectories if the
+// collector is recursive.
+func (c *textFileCollector) readDir(dir string) ([]textFile, error) {
+	var files []textFile
+	if !c.recursive {
+		infos, err := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".prom") {
+				files = append(files, textFile{sourceDir: dir, name: info.Name()})
+			}
+		}
+		return files, err
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Errorf("Error stat'ing %q: %v", path, err)
-			error = 1.0
-			continue
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".prom") {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
 		}
-		mtimes[f.Name()] = stat.ModTime()
+		files = append(files, textFile{sourceDir: dir, name: name})
+		return nil
+	})
+	return files, err
+}
+
+// parseFile returns the metric families of file and its mtime. The errors
+// are textFileErrors.
+func (c *textFileCollector) parseFile(file textFile) (map[string]*dto.MetricFamily, time.Time, error) {
+	path := file.path()
+	fileError := func(reason string, err error) error {
+		return &textFileError{file: file, reason: reason, err: err}
+	}
 
-		for _, mf := range parsedFamilies {
-			convertMetricFamily(mf, ch)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, fileError(textFileErrorOpen, fmt.Errorf("failed to open %q: %v", path, err))
+	}
+	defer f.Close()
+
+	var parser expfmt.TextParser
+	parsedFamilies, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return nil, time.Time{}, fileError(textFileErrorParse, fmt.Errorf("failed to parse %q: %v", path, err))
+	}
+	if !c.timestamps && hasTimestamps(parsedFamilies) {
+		return nil, time.Time{}, fileError(textFileErrorTimestamps, fmt.Errorf("textfile %q contains unsupported client-side timestamps, skipping entire file", path))
+	}
+
+	for _, mf := range parsedFamilies {
+		if mf.Help == nil {
+			help := fmt.Sprintf("Metric read from %s", path)
+			mf.Help = &help
+		}
+	}
+
+	// Only set this once it has been parsed and validated, so that
+	// a failure does not appear fresh.
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, fileError(textFileErrorStat, fmt.Errorf("failed to stat %q: %v", path, err))
+	}
+	return parsedFamilies, stat.ModTime(), nil
+}
+
+// processFile sends the metrics of file unless it's older than maxAge, and
+// returns its mtime and whether it's stale.
+func (c *textFileCollector) processFile(file textFile, maxAge time.Duration, ch chan<- prometheus.Metric) (time.Time, bool, error) {
+	parsedFamilies, mtime, err := c.parseFile(file)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if maxAge > 0 && c.now().Sub(mtime) > maxAge {
+		log.Debugf("Textfile %q is older than %s, dropping its metrics", file.path(), maxAge)
+		return mtime, true, nil
+	}
+
+	for _, mf := range parsedFamilies {
+		convertMetricFamily(mf, ch)
+	}
+	return mtime, false, nil
+}
+
+// Update implements the Collector interface.
+func (c *textFileCollector) Update(ch chan<- prometheus.Metric) error {
+	scrapeError := 0.0
+	mtimes := map[textFile]time.Time{}
+	stale := map[textFile]bool{}
+	var fileErrors []*textFileError
+	addError := func(err error) {
+		log.Error(err)
+		scrapeError = 1.0
+		if fileError, ok := err.(*textFileError); ok {
+			fileErrors = append(fileErrors, fileError)
+		}
+	}
+
+	// Iterate over files and accumulate their metrics.
+	files, errs := c.findFiles()
+	for _, err := range errs {
+		addError(err)
+	}
+
+	for _, file := range files {
+		maxAge := c.maxAge(file)
+		mtime, isStale, err := c.processFile(file, maxAge, ch)
+		if err != nil {
+			addError(err)
+			continue
+		}
+		mtimes[file] = mtime
+		if maxAge > 0 {
+			stale[file] = isStale
 		}
 	}
 
 	c.exportMTimes(mtimes, ch)
+	c.exportStale(stale, ch)
+	c.exportFileErrors(fileErrors, ch)
 
 	// Export if there were errors.
 	ch <- prometheus.MustNewConstMetric(
@@ -249,12 +589,13 @@ func (c *textFileCollector) Update(ch chan<- prometheus.Metric) error {
 			"1 if there was an error opening or reading a file, 0 otherwise",
 			nil, nil,
 		),
-		prometheus.GaugeValue, error,
+		prometheus.GaugeValue, scrapeError,
 	)
 	return nil
 }
 
-// hasTimestamps returns true when metrics contain unsupported timestamps.
+// hasTimestamps returns true when metrics contain timestamps, which are only
+// supported with --collector.textfile.timestamps.
 func hasTimestamps(parsedFamilies map[string]*dto.MetricFamily) bool {
 	for _, mf := range parsedFamilies {
 		for _, m := range mf.Metric {
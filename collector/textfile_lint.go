@@ -0,0 +1,269 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !notextfile
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// LintTextFiles checks the text files at paths, which are files, directories
+// or glob patterns, the way the textfile collector reads them with the
+// current flags. It returns the problems found: files which would be
+// skipped, metrics which would be dropped from or fail the scrape, and
+// metrics with inconsistent label names. Files given by name are checked
+// whatever their extension.
+func LintTextFiles(paths []string) []string {
+	return lintTextFiles(&textFileCollector{
+		paths:         paths,
+		recursive:     *textFileRecursive,
+		timestamps:    *textFileTimestamps,
+		explicitFiles: true,
+	})
+}
+
+func lintTextFiles(c *textFileCollector) []string {
+	l := &textFileLinter{
+		families: map[string]lintFamily{},
+		series:   map[string]textFile{},
+	}
+
+	files, errs := c.findFiles()
+	for _, err := range errs {
+		l.problems = append(l.problems, err.Error())
+	}
+	for _, file := range files {
+		families, _, err := c.parseFile(file)
+		if err != nil {
+			l.problems = append(l.problems, err.Error())
+			continue
+		}
+		l.lintFile(file, families)
+	}
+	return l.problems
+}
+
+// lintFamily is a metric family as first seen by the linter.
+type lintFamily struct {
+	file textFile
+	help string
+	// generatedHelp is whether the help was generated for a family without
+	// a HELP line, which depends on the file.
+	generatedHelp bool
+	metricType    dto.MetricType
+	labelNames    string
+}
+
+type textFileLinter struct {
+	problems []string
+	// families are the metric families of the checked files by name.
+	families map[string]lintFamily
+	// series are the files of the exported series by name and labels.
+	series map[string]textFile
+	// metrics are the metrics exported from the checked files.
+	metrics []prometheus.Metric
+	// gatherErrors is the number of errors gathering metrics which have
+	// already been reported.
+	gatherErrors int
+}
+
+func (l *textFileLinter) addProblem(file textFile, format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf("%s: ", file.path())+fmt.Sprintf(format, args...))
+}
+
+// lintFile checks the metric families of file, also against the files
+// checked before.
+func (l *textFileLinter) lintFile(file textFile, families map[string]*dto.MetricFamily) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mf := families[name]
+		labelNames := l.lintLabelNames(file, mf)
+		generatedHelp := mf.GetHelp() == fmt.Sprintf("Metric read from %s", file.path())
+
+		first, ok := l.families[name]
+		if !ok {
+			l.families[name] = lintFamily{
+				file:          file,
+				help:          mf.GetHelp(),
+				generatedHelp: generatedHelp,
+				metricType:    mf.GetType(),
+				labelNames:    labelNames,
+			}
+		} else {
+			// The collector would drop all metrics of this family.
+			if first.metricType != mf.GetType() {
+				l.addProblem(file, "metric %q is a %s, but a %s in %q", name, typeName(mf.GetType()), typeName(first.metricType), first.file.path())
+				continue
+			}
+			if first.help != mf.GetHelp() {
+				if !first.generatedHelp && !generatedHelp {
+					l.addProblem(file, "metric %q has help %q, but %q in %q", name, mf.GetHelp(), first.help, first.file.path())
+				} else {
+					l.addProblem(file, "metric %q is also in %q, which needs the same HELP line in both files", name, first.file.path())
+				}
+				continue
+			}
+			if first.labelNames != labelNames {
+				l.addProblem(file, "metric %q has the label names {%s}, but {%s} in %q", name, labelNames, first.labelNames, first.file.path())
+			}
+		}
+
+		metrics, err := convertToMetrics(mf)
+		if err != nil {
+			l.addProblem(file, "metric %q can't be exported: %s", name, err)
+			continue
+		}
+		for _, m := range metrics {
+			key, err := seriesKey(name, m)
+			if err != nil {
+				l.addProblem(file, "metric %q can't be exported: %s", name, err)
+				continue
+			}
+			if first, ok := l.series[key]; ok {
+				if first == file {
+					l.addProblem(file, "series %s is duplicated", key)
+				} else {
+					l.addProblem(file, "series %s is also in %q", key, first.path())
+				}
+				continue
+			}
+			l.series[key] = file
+			l.metrics = append(l.metrics, m)
+		}
+	}
+
+	// Gather the metrics like the exporter does to find any other problem,
+	// the new errors are those with the metrics of this file.
+	errs := gatherMetrics(l.metrics)
+	for _, err := range errs[l.gatherErrors:] {
+		l.addProblem(file, "%s", err)
+	}
+	l.gatherErrors = len(errs)
+}
+
+// lintLabelNames checks that all metrics of mf have the same label names, as
+// the collector exports the missing labels as empty. It returns all label
+// names of the family.
+func (l *textFileLinter) lintLabelNames(file textFile, mf *dto.MetricFamily) string {
+	all := map[string]struct{}{}
+	var first string
+	reported := false
+	for i, m := range mf.Metric {
+		var names []string
+		for _, label := range m.GetLabel() {
+			names = append(names, label.GetName())
+			all[label.GetName()] = struct{}{}
+		}
+		sort.Strings(names)
+		joined := strings.Join(names, ",")
+		if i == 0 {
+			first = joined
+		} else if joined != first && !reported {
+			l.addProblem(file, "metric %q has inconsistent label names {%s} and {%s}, missing labels are exported empty", mf.GetName(), first, joined)
+			reported = true
+		}
+	}
+
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// typeName returns the name of t as in TYPE lines.
+func typeName(t dto.MetricType) string {
+	return strings.ToLower(t.String())
+}
+
+// convertToMetrics returns the metrics convertMetricFamily sends for mf, or
+// an error if it panics.
+func convertToMetrics(mf *dto.MetricFamily) (metrics []prometheus.Metric, err error) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		close(ch)
+		<-done
+	}()
+
+	convertMetricFamily(mf, ch)
+	// The metrics are only complete once the deferred function has waited
+	// for them.
+	return
+}
+
+// seriesKey returns the name and labels of m like name{label="value"}.
+// Empty labels are left out, as Prometheus ignores them.
+func seriesKey(name string, m prometheus.Metric) (string, error) {
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		return "", err
+	}
+	labels := make([]string, 0, len(metric.Label))
+	for _, label := range metric.Label {
+		if label.GetValue() == "" {
+			continue
+		}
+		labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}", nil
+}
+
+// metricsCollector sends fixed metrics.
+type metricsCollector []prometheus.Metric
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// gatherMetrics gathers metrics with a registry and returns the errors in the
+// order of the metrics.
+func gatherMetrics(metrics []prometheus.Metric) []error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsCollector(metrics))
+	_, err := registry.Gather()
+	if errs, ok := err.(prometheus.MultiError); ok {
+		return errs
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
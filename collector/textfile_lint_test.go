@@ -0,0 +1,81 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintTextFiles(t *testing.T) {
+	tests := []struct {
+		paths      []string
+		timestamps bool
+		want       []string
+	}{
+		{
+			paths: []string{"fixtures/textfile/two_metric_files"},
+		},
+		{
+			paths: []string{"fixtures/textfile/lint/new.prom.tmp"},
+		},
+		{
+			paths: []string{"fixtures/textfile/nonexistent_path"},
+			want: []string{
+				`failed to read textfile directory "fixtures/textfile/nonexistent_path": stat fixtures/textfile/nonexistent_path: no such file or directory`,
+			},
+		},
+		{
+			paths: []string{"fixtures/textfile/client_side_timestamp"},
+			want: []string{
+				`textfile "fixtures/textfile/client_side_timestamp/metrics.prom" contains unsupported client-side timestamps, skipping entire file`,
+			},
+		},
+		{
+			paths:      []string{"fixtures/textfile/client_side_timestamp"},
+			timestamps: true,
+		},
+		{
+			paths: []string{"fixtures/textfile/two_metric_files", "fixtures/textfile/*/metrics1.prom"},
+			want: []string{
+				`textfile "fixtures/textfile/two_metric_files/metrics1.prom" is the same file as "fixtures/textfile/two_metric_files/metrics1.prom", skipping it`,
+			},
+		},
+		{
+			paths: []string{"fixtures/textfile/lint"},
+			want: []string{
+				`fixtures/textfile/lint/a.prom: metric "lint_labels" has inconsistent label names {a} and {b}, missing labels are exported empty`,
+				`fixtures/textfile/lint/b.prom: metric "lint_help" has help "Other help.", but "Some help." in "fixtures/textfile/lint/a.prom"`,
+				`fixtures/textfile/lint/b.prom: metric "lint_series" has inconsistent label names {b} and {a}, missing labels are exported empty`,
+				`fixtures/textfile/lint/b.prom: metric "lint_series" has the label names {a,b}, but {a} in "fixtures/textfile/lint/a.prom"`,
+				`fixtures/textfile/lint/b.prom: series lint_series{a="2"} is also in "fixtures/textfile/lint/a.prom"`,
+				`fixtures/textfile/lint/b.prom: series lint_series{b="1"} is duplicated`,
+				`fixtures/textfile/lint/b.prom: metric "lint_type" is a counter, but a gauge in "fixtures/textfile/lint/a.prom"`,
+				`fixtures/textfile/lint/b.prom: metric "lint_untyped" is also in "fixtures/textfile/lint/a.prom", which needs the same HELP line in both files`,
+				`fixtures/textfile/lint/b.prom: collected metric named "lint_summary_count" collides with previously collected summary named "lint_summary"`,
+			},
+		},
+	}
+
+	for i, test := range tests {
+		got := lintTextFiles(&textFileCollector{
+			paths:         test.paths,
+			timestamps:    test.timestamps,
+			explicitFiles: true,
+		})
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%d.%q: want %q, got %q", i, test.paths, test.want, got)
+		}
+	}
+}
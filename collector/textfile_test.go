@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -47,56 +48,106 @@ func (a collectorAdapter) Collect(ch chan<- prometheus.Metric) {
 
 func TestTextfileCollector(t *testing.T) {
 	tests := []struct {
-		path string
-		out  string
+		paths      []string
+		recursive  bool
+		maxAges    []textFileMaxAge
+		timestamps bool
+		out        string
 	}{
 		{
-			path: "fixtures/textfile/no_metric_files",
-			out:  "fixtures/textfile/no_metric_files.out",
+			paths: []string{"fixtures/textfile/no_metric_files"},
+			out:   "fixtures/textfile/no_metric_files.out",
 		},
 		{
-			path: "fixtures/textfile/two_metric_files",
-			out:  "fixtures/textfile/two_metric_files.out",
+			paths: []string{"fixtures/textfile/two_metric_files"},
+			out:   "fixtures/textfile/two_metric_files.out",
 		},
 		{
-			path: "fixtures/textfile/nonexistent_path",
-			out:  "fixtures/textfile/nonexistent_path.out",
+			paths: []string{"fixtures/textfile/nonexistent_path"},
+			out:   "fixtures/textfile/nonexistent_path.out",
 		},
 		{
-			path: "fixtures/textfile/client_side_timestamp",
-			out:  "fixtures/textfile/client_side_timestamp.out",
+			paths: []string{"fixtures/textfile/client_side_timestamp"},
+			out:   "fixtures/textfile/client_side_timestamp.out",
 		},
 		{
-			path: "fixtures/textfile/different_metric_types",
-			out:  "fixtures/textfile/different_metric_types.out",
+			paths: []string{"fixtures/textfile/different_metric_types"},
+			out:   "fixtures/textfile/different_metric_types.out",
 		},
 		{
-			path: "fixtures/textfile/inconsistent_metrics",
-			out:  "fixtures/textfile/inconsistent_metrics.out",
+			paths: []string{"fixtures/textfile/inconsistent_metrics"},
+			out:   "fixtures/textfile/inconsistent_metrics.out",
 		},
 		{
-			path: "fixtures/textfile/histogram",
-			out:  "fixtures/textfile/histogram.out",
+			paths: []string{"fixtures/textfile/histogram"},
+			out:   "fixtures/textfile/histogram.out",
 		},
 		{
-			path: "fixtures/textfile/histogram_extra_dimension",
-			out:  "fixtures/textfile/histogram_extra_dimension.out",
+			paths: []string{"fixtures/textfile/histogram_extra_dimension"},
+			out:   "fixtures/textfile/histogram_extra_dimension.out",
 		},
 		{
-			path: "fixtures/textfile/summary",
-			out:  "fixtures/textfile/summary.out",
+			paths: []string{"fixtures/textfile/summary"},
+			out:   "fixtures/textfile/summary.out",
 		},
 		{
-			path: "fixtures/textfile/summary_extra_dimension",
-			out:  "fixtures/textfile/summary_extra_dimension.out",
+			paths: []string{"fixtures/textfile/summary_extra_dimension"},
+			out:   "fixtures/textfile/summary_extra_dimension.out",
+		},
+		{
+			paths: []string{"fixtures/textfile/*_metric_files"},
+			out:   "fixtures/textfile/glob.out",
+		},
+		{
+			paths: []string{"fixtures/textfile/nested"},
+			out:   "fixtures/textfile/nested.out",
+		},
+		{
+			paths:     []string{"fixtures/textfile/nested"},
+			recursive: true,
+			out:       "fixtures/textfile/nested_recursive.out",
+		},
+		{
+			paths: []string{
+				"fixtures/textfile/two_metric_files",
+				"fixtures/textfile/nested/top.prom",
+				"fixtures/textfile/*/metrics1.prom",
+			},
+			out: "fixtures/textfile/duplicate_files.out",
+		},
+		{
+			paths:      []string{"fixtures/textfile/client_side_timestamp"},
+			timestamps: true,
+			out:        "fixtures/textfile/client_side_timestamp_passthrough.out",
+		},
+		{
+			paths:   []string{"fixtures/textfile/two_metric_files"},
+			maxAges: []textFileMaxAge{{maxAge: time.Hour}},
+			out:     "fixtures/textfile/stale_files.out",
+		},
+		{
+			paths: []string{"fixtures/textfile/two_metric_files"},
+			maxAges: []textFileMaxAge{
+				{pattern: "fixtures/textfile/*/metrics1.prom", maxAge: time.Hour},
+				{maxAge: 100 * 365 * 24 * time.Hour},
+			},
+			out: "fixtures/textfile/stale_file.out",
+		},
+		{
+			paths: []string{"fixtures/textfile/parse_error"},
+			out:   "fixtures/textfile/parse_error.out",
 		},
 	}
 
 	for i, test := range tests {
 		mtime := 1.0
 		c := &textFileCollector{
-			path:  test.path,
-			mtime: &mtime,
+			paths:      test.paths,
+			recursive:  test.recursive,
+			maxAges:    test.maxAges,
+			timestamps: test.timestamps,
+			mtime:      &mtime,
+			now:        func() time.Time { return time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC) },
 		}
 
 		// Suppress a log message about `nonexistent_path` not existing, this is
@@ -120,7 +171,40 @@ func TestTextfileCollector(t *testing.T) {
 		}
 
 		if string(want) != got {
-			t.Fatalf("%d.%q want:\n\n%s\n\ngot:\n\n%s", i, test.path, string(want), got)
+			t.Fatalf("%d.%q want:\n\n%s\n\ngot:\n\n%s", i, test.paths, string(want), got)
+		}
+	}
+}
+
+func TestTextFileMaxAge(t *testing.T) {
+	maxAges, err := parseTextFileMaxAges([]string{
+		"/var/lib/textfile/backup_*.prom=26h",
+		"/var/lib/textfile/team_a=2h",
+		"1d",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &textFileCollector{maxAges: maxAges}
+
+	for _, tt := range []struct {
+		file textFile
+		want time.Duration
+	}{
+		{textFile{sourceDir: "/var/lib/textfile", name: "backup_db.prom"}, 26 * time.Hour},
+		{textFile{sourceDir: "/var/lib/textfile", name: "team_a/jobs.prom"}, 2 * time.Hour},
+		{textFile{sourceDir: "/var/lib/textfile/team_a", name: "jobs.prom"}, 2 * time.Hour},
+		{textFile{sourceDir: "/var/lib/textfile/team_ab", name: "jobs.prom"}, 24 * time.Hour},
+		{textFile{sourceDir: "/var/lib/textfile", name: "role.prom"}, 24 * time.Hour},
+	} {
+		if got := c.maxAge(tt.file); got != tt.want {
+			t.Errorf("%s: want max age %s, got %s", tt.file.path(), tt.want, got)
+		}
+	}
+
+	for _, value := range []string{"=1h", "/var/lib/textfile=soon", "[=1h"} {
+		if _, err := parseTextFileMaxAges([]string{value}); err == nil {
+			t.Errorf("%s: want an error", value)
 		}
 	}
 }
@@ -27,6 +27,8 @@ import (
 )
 
 type wifiCollector struct {
+	fixtures string
+
 	interfaceFrequencyHertz *prometheus.Desc
 	stationInfo             *prometheus.Desc
 
@@ -71,6 +73,8 @@ func NewWifiCollector() (Collector, error) {
 	)
 
 	return &wifiCollector{
+		fixtures: *collectorWifi,
+
 		interfaceFrequencyHertz: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, subsystem, "interface_frequency_hertz"),
 			"The current frequency a WiFi interface is operating at, in hertz.",
@@ -158,7 +162,7 @@ func NewWifiCollector() (Collector, error) {
 }
 
 func (c *wifiCollector) Update(ch chan<- prometheus.Metric) error {
-	stat, err := newWifiStater(*collectorWifi)
+	stat, err := newWifiStater(c.fixtures)
 	if err != nil {
 		// Cannot access wifi metrics, report no error.
 		if os.IsNotExist(err) {
@@ -0,0 +1,542 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A configuration file sets the values of command-line flags. Every option
+// is addressed by its section and key, which are joined with a dot to form the
+// name of the flag, e.g. key unit-whitelist in section collector.systemd sets
+// --collector.systemd.unit-whitelist. Two sections are treated specially:
+//
+//  - collectors: the keys enabled and disabled list the collectors to turn
+//    on or off.
+//  - remote and local: the options of the config.ini formerly read by
+//    prometheus_pusher.py, see legacyOptions.
+//
+// Files ending in .yml or .yaml are read as YAML, where nested maps are the
+// sections. All other files are read as INI.
+
+// configOption is a single option read from a configuration file.
+type configOption struct {
+	// name is the section and key joined with a dot.
+	name   string
+	values []string
+}
+
+// legacyOptions maps the options of the config.ini formerly read by
+// prometheus_pusher.py to functions returning the flags they set.
+var legacyOptions = map[string]func(value string) (map[string]string, error){
+	"remote.url": func(v string) (map[string]string, error) {
+		return map[string]string{"push.url": v}, nil
+	},
+	"local.ip_prefix": func(v string) (map[string]string, error) {
+		return map[string]string{"push.ip-prefix": v}, nil
+	},
+	"local.program": func(v string) (map[string]string, error) {
+		return map[string]string{"push.program": v}, nil
+	},
+	"local.period": func(v string) (map[string]string, error) {
+		// The period is given in seconds.
+		if _, err := strconv.Atoi(v); err == nil {
+			v += "s"
+		}
+		return map[string]string{"push.interval": v}, nil
+	},
+	"local.url": func(v string) (map[string]string, error) {
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the host, so that an exporter bound to localhost isn't
+		// exposed on all interfaces.
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, err
+		}
+		flags := map[string]string{"web.listen-address": u.Host}
+		if u.Path != "" {
+			flags["web.telemetry-path"] = u.Path
+		}
+		return flags, nil
+	},
+	"local.process_performance": func(v string) (map[string]string, error) {
+		// The pusher appended the per-process output of ps, which is replaced
+		// by the process_groups collector.
+		return map[string]string{
+			"collector.basic.process-info": v,
+			"collector.process_groups":     v,
+		}, nil
+	},
+}
+
+// readConfigFile reads the options of a configuration file.
+func readConfigFile(filename string) ([]configOption, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(filename) {
+	case ".yml", ".yaml":
+		return parseYAMLConfig(content)
+	default:
+		return parseINIConfig(content)
+	}
+}
+
+// parseINIConfig parses an INI file with [section] headers and key=value (or
+// key: value) lines. Lines starting with # or ; are comments.
+func parseINIConfig(content []byte) ([]configOption, error) {
+	var (
+		options []configOption
+		section string
+		scanner = bufio.NewScanner(strings.NewReader(string(content)))
+		lineNo  = 0
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section header %q", lineNo, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNo, line)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: option outside of a section", lineNo)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		options = append(options, configOption{name: section + "." + key, values: []string{value}})
+	}
+	return options, scanner.Err()
+}
+
+// parseYAMLConfig parses a YAML document of nested maps. Lists become repeated
+// values of an option.
+func parseYAMLConfig(content []byte) ([]configOption, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	var options []configOption
+	if err := flattenYAML("", doc, &options); err != nil {
+		return nil, err
+	}
+	// Map iteration order is random, sort for a deterministic result.
+	sort.Slice(options, func(i, j int) bool { return options[i].name < options[j].name })
+	return options, nil
+}
+
+func flattenYAML(prefix string, value interface{}, options *[]configOption) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if err := flattenYAML(joinName(prefix, key), child, options); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, child := range v {
+			if err := flattenYAML(joinName(prefix, fmt.Sprint(key)), child, options); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("%s: lists may only contain scalar values", prefix)
+			}
+			values = append(values, fmt.Sprint(item))
+		}
+		*options = append(*options, configOption{name: prefix, values: values})
+	case nil:
+		*options = append(*options, configOption{name: prefix, values: []string{""}})
+	default:
+		*options = append(*options, configOption{name: prefix, values: []string{fmt.Sprint(v)}})
+	}
+	return nil
+}
+
+func joinName(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// configFlags resolves the options of a configuration file to flag names and
+// their values.
+func configFlags(options []configOption) (map[string][]string, error) {
+	flags := map[string][]string{}
+	for _, o := range options {
+		switch o.name {
+		case "collectors.enabled", "collectors.disabled":
+			enabled := strconv.FormatBool(o.name == "collectors.enabled")
+			for _, v := range o.values {
+				for _, c := range strings.Split(v, ",") {
+					if c = strings.TrimSpace(c); c != "" {
+						flags["collector."+c] = []string{enabled}
+					}
+				}
+			}
+			continue
+		}
+		if legacy, ok := legacyOptions[o.name]; ok {
+			for _, v := range o.values {
+				legacyFlags, err := legacy(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for %s: %s", o.name, err)
+				}
+				for name, value := range legacyFlags {
+					flags[name] = []string{value}
+				}
+			}
+			continue
+		}
+		flags[o.name] = o.values
+	}
+	return flags, nil
+}
+
+// configArgs reads a configuration file and returns its options as
+// command-line arguments for app. Flags set in cliArgs are left out, so that
+// the command line takes precedence over the configuration file.
+func configArgs(app *kingpin.Application, filename string, cliArgs []string) ([]string, error) {
+	options, err := readConfigFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file %q: %s", filename, err)
+	}
+	flags, err := configFlags(options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %s", filename, err)
+	}
+
+	ctx, err := app.ParseContext(cliArgs)
+	if err != nil {
+		return nil, err
+	}
+	setOnCLI := map[string]bool{}
+	for _, e := range ctx.Elements {
+		if f, ok := e.Clause.(*kingpin.FlagClause); ok {
+			setOnCLI[f.Model().Name] = true
+		}
+	}
+
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		flag := app.GetFlag(name)
+		if flag == nil {
+			return nil, fmt.Errorf("invalid config file %q: unknown option %q", filename, name)
+		}
+		if setOnCLI[name] {
+			continue
+		}
+		for _, value := range flags[name] {
+			if !flag.Model().IsBoolFlag() {
+				args = append(args, fmt.Sprintf("--%s=%s", name, value))
+				continue
+			}
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config file %q: invalid boolean %q for %q", filename, value, name)
+			}
+			if enabled {
+				args = append(args, "--"+name)
+			} else {
+				args = append(args, "--no-"+name)
+			}
+		}
+	}
+	return args, nil
+}
+
+// parseFlags parses cliArgs, preceded by the options of the configuration
+// file if one is given.
+func parseFlags(app *kingpin.Application, configFile string, cliArgs []string) error {
+	args := cliArgs
+	if configFile != "" {
+		fileArgs, err := configArgs(app, configFile, cliArgs)
+		if err != nil {
+			return err
+		}
+		args = append(fileArgs, cliArgs...)
+	}
+	resetFlags(app)
+	_, err := app.Parse(args)
+	return err
+}
+
+// resettableValue is the value of a repeatable flag, which is appended to on
+// every parse and so has to be emptied before parsing the flags again. Get
+// returns its values as []string.
+type resettableValue interface {
+	kingpin.Getter
+	Reset()
+}
+
+// resetFlags empties the repeatable flags of app.
+func resetFlags(app *kingpin.Application) {
+	for _, f := range app.Model().Flags {
+		if v, ok := f.Value.(resettableValue); ok {
+			v.Reset()
+		}
+	}
+}
+
+// flagValue is the saved value of a flag. Repeatable flags are saved as the
+// list of their values, as these may contain any separator.
+type flagValue struct {
+	value  string
+	values []string
+}
+
+func (v flagValue) equal(o flagValue) bool {
+	if v.value != o.value || len(v.values) != len(o.values) {
+		return false
+	}
+	for i := range v.values {
+		if v.values[i] != o.values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the value quoted for logging.
+func (v flagValue) String() string {
+	if v.values != nil {
+		return fmt.Sprintf("%q", v.values)
+	}
+	return strconv.Quote(v.value)
+}
+
+// flagValues returns the current values of all flags of app.
+func flagValues(app *kingpin.Application) map[string]flagValue {
+	values := map[string]flagValue{}
+	for _, f := range app.Model().Flags {
+		if g, ok := f.Value.(kingpin.Getter); ok {
+			if v, ok := g.Get().([]string); ok {
+				values[f.Name] = flagValue{values: append([]string{}, v...)}
+				continue
+			}
+		}
+		values[f.Name] = flagValue{value: f.Value.String()}
+	}
+	return values
+}
+
+// changedFlags returns the names of all flags whose values differ between
+// before and after.
+func changedFlags(before, after map[string]flagValue) map[string]bool {
+	changed := map[string]bool{}
+	for name, value := range after {
+		if !before[name].equal(value) {
+			changed[name] = true
+		}
+	}
+	return changed
+}
+
+// setFlags sets the flags of app to the given values. It stops at the first
+// value which can't be set.
+func setFlags(app *kingpin.Application, values map[string]flagValue) error {
+	current := flagValues(app)
+	for _, f := range app.Model().Flags {
+		v, ok := values[f.Name]
+		if !ok || current[f.Name].equal(v) {
+			continue
+		}
+		if r, ok := f.Value.(resettableValue); ok {
+			r.Reset()
+			for _, s := range v.values {
+				if err := r.Set(s); err != nil {
+					return fmt.Errorf("invalid value %q for flag --%s: %s", s, f.Name, err)
+				}
+			}
+			continue
+		}
+		if err := f.Value.Set(v.value); err != nil {
+			return fmt.Errorf("invalid value %q for flag --%s: %s", v.value, f.Name, err)
+		}
+	}
+	return nil
+}
+
+// parseFlagValues parses cliArgs, preceded by the options of the
+// configuration file if one is given, like parseFlags. The flags are parsed
+// into a copy of app, so that the values of app are left unchanged, and are
+// returned as saved by flagValues.
+func parseFlagValues(app *kingpin.Application, configFile string, cliArgs []string) (map[string]flagValue, error) {
+	shadow := shadowApp(app)
+	args := cliArgs
+	if configFile != "" {
+		fileArgs, err := configArgs(shadow, configFile, cliArgs)
+		if err != nil {
+			return nil, err
+		}
+		args = append(fileArgs, cliArgs...)
+	}
+	if _, err := shadow.Parse(args); err != nil {
+		return nil, err
+	}
+	values := flagValues(shadow)
+	for name := range values {
+		// Leave out the help flags of shadow.
+		if app.GetFlag(name) == nil {
+			delete(values, name)
+		}
+	}
+	return values, nil
+}
+
+// shadowApp returns a new application with the flags, commands and arguments
+// of app, holding fresh values of the same types.
+func shadowApp(app *kingpin.Application) *kingpin.Application {
+	shadow := kingpin.New(app.Name, app.Help)
+	copyFlags(shadow.Flag, app.Model().FlagGroupModel, shadow)
+	for _, c := range app.Model().Commands {
+		if app.HelpCommand != nil && c.Name == app.HelpCommand.Model().Name {
+			// Added by kingpin itself.
+			continue
+		}
+		cmd := shadow.Command(c.Name, c.Help)
+		if c.Default {
+			cmd.Default()
+		}
+		copyFlags(cmd.Flag, c.FlagGroupModel, shadow)
+		for _, a := range c.Args {
+			arg := cmd.Arg(a.Name, a.Help).Default(a.Default...)
+			if a.Required {
+				arg.Required()
+			}
+			copyValue(arg, a.Value)
+		}
+	}
+	return shadow
+}
+
+func copyFlags(flag func(name, help string) *kingpin.FlagClause, flags *kingpin.FlagGroupModel, shadow *kingpin.Application) {
+	for _, f := range flags.Flags {
+		if shadow.GetFlag(f.Name) != nil {
+			// The help flags.
+			continue
+		}
+		clause := flag(f.Name, f.Help).Default(f.Default...)
+		if f.Short != 0 {
+			clause.Short(f.Short)
+		}
+		if f.Required {
+			clause.Required()
+		}
+		copyValue(clause, f.Value)
+	}
+}
+
+// valueClause is a flag or argument of a kingpin application.
+type valueClause interface {
+	kingpin.Settings
+	Bool() *bool
+	Int() *int
+	Duration() *time.Duration
+	String() *string
+}
+
+// copyValue sets a fresh value of the type of value on clause. Values of
+// other types are kept as given, and only checked when they're set on the
+// flag itself. Repeatable values are kept as a list, which kingpin's own
+// accumulator doesn't return.
+func copyValue(clause valueClause, value kingpin.Value) {
+	if g, ok := value.(kingpin.Getter); ok {
+		switch g.Get().(type) {
+		case bool:
+			clause.Bool()
+			return
+		case int:
+			clause.Int()
+			return
+		case time.Duration:
+			clause.Duration()
+			return
+		case string:
+			clause.String()
+			return
+		case []string:
+			clause.SetValue(new(rawValues))
+			return
+		}
+	}
+	clause.SetValue(new(rawValue))
+}
+
+// rawValue is a value of a type unknown to copyValue.
+type rawValue string
+
+func (v *rawValue) Set(s string) error {
+	*v = rawValue(s)
+	return nil
+}
+
+func (v *rawValue) String() string {
+	return string(*v)
+}
+
+// rawValues is a repeatable value for copyValue.
+type rawValues []string
+
+func (v *rawValues) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+func (v *rawValues) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *rawValues) Get() interface{} {
+	return []string(*v)
+}
+
+func (v *rawValues) IsCumulative() bool {
+	return true
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func newTestApp() *kingpin.Application {
+	app := kingpin.New("test", "")
+	app.Flag("web.listen-address", "").Default(":9100").String()
+	app.Flag("web.telemetry-path", "").Default("/metrics").String()
+	app.Flag("push.url", "").String()
+	app.Flag("push.ip-prefix", "").String()
+	app.Flag("push.program", "").String()
+	app.Flag("push.interval", "").Duration()
+	app.Flag("collector.basic.process-info", "").Default("true").Bool()
+	app.Flag("collector.perf", "").Bool()
+	app.Flag("collector.process_groups", "").Bool()
+	app.Flag("collector.wifi", "").Bool()
+	app.Flag("collector.systemd.unit-whitelist", "").String()
+	return app
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "node_exporter_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestConfigArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		cliArgs []string
+		want    []string
+	}{
+		{
+			name: "legacy ini",
+			file: "config.ini",
+			content: `[remote]
+url=http://ops-center:9092/api/v3/monitor/metrics/receive
+
+[local]
+ip_prefix=10.10.
+period=60
+program=node_exporter
+url=http://localhost:60616/metrics
+process_performance=True`,
+			want: []string{
+				"--collector.basic.process-info",
+				"--collector.process_groups",
+				"--push.interval=60s",
+				"--push.ip-prefix=10.10.",
+				"--push.program=node_exporter",
+				"--push.url=http://ops-center:9092/api/v3/monitor/metrics/receive",
+				"--web.listen-address=localhost:60616",
+				"--web.telemetry-path=/metrics",
+			},
+		},
+		{
+			name: "generic ini",
+			file: "node_exporter.ini",
+			content: `; comment
+[collectors]
+enabled = perf
+disabled = wifi
+
+[collector.systemd]
+unit-whitelist = .+\.service`,
+			want: []string{
+				"--collector.perf",
+				"--collector.systemd.unit-whitelist=.+\\.service",
+				"--no-collector.wifi",
+			},
+		},
+		{
+			name: "yaml",
+			file: "node_exporter.yml",
+			content: `web:
+  listen-address: ":9101"
+collectors:
+  enabled: [perf]
+  disabled: [wifi]
+collector:
+  systemd:
+    unit-whitelist: .+\.service
+`,
+			want: []string{
+				"--collector.perf",
+				"--collector.systemd.unit-whitelist=.+\\.service",
+				"--no-collector.wifi",
+				"--web.listen-address=:9101",
+			},
+		},
+		{
+			name: "command line takes precedence",
+			file: "node_exporter.yml",
+			content: `web:
+  listen-address: ":9101"
+  telemetry-path: /node
+`,
+			cliArgs: []string{"--web.listen-address=:9102"},
+			want:    []string{"--web.telemetry-path=/node"},
+		},
+	}
+
+	for _, test := range tests {
+		filename := writeConfig(t, test.file, test.content)
+		defer os.RemoveAll(filepath.Dir(filename))
+
+		got, err := configArgs(newTestApp(), filename, test.cliArgs)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: want %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestConfigArgsUnknownOption(t *testing.T) {
+	filename := writeConfig(t, "config.ini", "[collector.foo]\nbar=baz\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	if _, err := configArgs(newTestApp(), filename, nil); err == nil {
+		t.Error("expected an error for an unknown option")
+	}
+}
+
+type testStrings []string
+
+func (v *testStrings) Set(s string) error { *v = append(*v, s); return nil }
+func (v *testStrings) String() string     { return strings.Join(*v, ",") }
+func (v *testStrings) Get() interface{}   { return append([]string(nil), *v...) }
+func (v *testStrings) IsCumulative() bool { return true }
+func (v *testStrings) Reset()             { *v = nil }
+
+func TestParseFlagsRepeatable(t *testing.T) {
+	app := newTestApp()
+	dirs := &testStrings{}
+	app.Flag("collector.textfile.directory", "").SetValue(dirs)
+
+	filename := writeConfig(t, "config.yml", "collector.textfile.directory:\n  - /a\n  - /b,c\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	// Like main, the command line is parsed once before the configuration
+	// file and then again on every reload.
+	args := []string{"--collector.perf"}
+	if _, err := app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := parseFlags(app, filename, args); err != nil {
+			t.Fatal(err)
+		}
+		if want := (testStrings{"/a", "/b,c"}); !reflect.DeepEqual(want, *dirs) {
+			t.Errorf("parse %d: want %q, got %q", i, want, *dirs)
+		}
+	}
+
+	before := flagValues(app)
+	if err := parseFlags(app, "", []string{"--collector.textfile.directory=/d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlags(app, before); err != nil {
+		t.Fatal(err)
+	}
+	if want := (testStrings{"/a", "/b,c"}); !reflect.DeepEqual(want, *dirs) {
+		t.Errorf("restore: want %q, got %q", want, *dirs)
+	}
+}
+
+func TestParseFlagValues(t *testing.T) {
+	app := newTestApp()
+	dirs := &testStrings{}
+	app.Flag("collector.textfile.directory", "").SetValue(dirs)
+	app.Command("serve", "").Default()
+	app.Command("lint", "").Arg("path", "").Required().Strings()
+
+	args := []string{"serve", "--collector.perf"}
+	if _, err := app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	before := flagValues(app)
+
+	filename := writeConfig(t, "config.yml", `
+collector.textfile.directory:
+  - /a
+  - /b
+collectors:
+  enabled: wifi
+local:
+  period: 30
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	values, err := parseFlagValues(app, filename, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, flagValues(app)) {
+		t.Error("parsing changed the flags of the application")
+	}
+	want := map[string]bool{
+		"collector.textfile.directory": true,
+		"collector.wifi":               true,
+		"push.interval":                true,
+	}
+	if got := changedFlags(before, values); !reflect.DeepEqual(want, got) {
+		t.Errorf("want changed flags %v, got %v", want, got)
+	}
+
+	if err := setFlags(app, values); err != nil {
+		t.Fatal(err)
+	}
+	if want := (testStrings{"/a", "/b"}); !reflect.DeepEqual(want, *dirs) {
+		t.Errorf("want %q, got %q", want, *dirs)
+	}
+	if got := app.GetFlag("push.interval").Model().Value.String(); got != "30s" {
+		t.Errorf("want push interval 30s, got %s", got)
+	}
+
+	invalid := writeConfig(t, "config.ini", "[push]\ninterval = never\n")
+	defer os.RemoveAll(filepath.Dir(invalid))
+	current := flagValues(app)
+	if _, err := parseFlagValues(app, invalid, args); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+	if !reflect.DeepEqual(current, flagValues(app)) {
+		t.Error("an invalid configuration changed the flags of the application")
+	}
+}
@@ -19,6 +19,7 @@ enabled_collectors=$(cat << COLLECTORS
   interrupts
   ipvs
   ksmd
+  libvirt
   loadavg
   mdadm
   meminfo
@@ -101,6 +102,8 @@ fi
   $(for c in ${disabled_collectors}; do echo --no-collector.${c}  ; done) \
   --collector.textfile.directory="collector/fixtures/textfile/two_metric_files/" \
   --collector.wifi.fixtures="collector/fixtures/wifi" \
+  --collector.libvirt.fixtures="collector/fixtures/libvirt" \
+  --collector.libvirt.storage-volumes \
   --collector.qdisc.fixtures="collector/fixtures/qdisc/" \
   --collector.netclass.ignored-devices="(bond0|dmz|int)" \
   --web.listen-address "127.0.0.1:${port}" \
@@ -17,10 +17,16 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"sort"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/node_exporter/collector"
@@ -31,32 +37,119 @@ import (
 // created on the fly, if filtering is requested. Create instances with
 // newHandler.
 type handler struct {
-	unfilteredHandler http.Handler
+	// mtx protects collectors. It's only held to get or replace the set, not
+	// while scraping, so that a hanging collector can't block reloads.
+	mtx        sync.RWMutex
+	collectors *collectorSet
+
 	// exporterMetricsRegistry is a separate registry for the metrics about
 	// the exporter itself.
 	exporterMetricsRegistry *prometheus.Registry
 	includeExporterMetrics  bool
 	maxRequests             int
+	// scrapes shares collections among concurrent scrapes.
+	scrapes *scrapeGroup
+	// generations counts the collector sets created.
+	generations uint64
+}
+
+// collectorSet holds the enabled collectors with the handler and gatherer
+// serving them. Reloads replace the whole set.
+type collectorSet struct {
+	unfilteredHandler  http.Handler
+	unfilteredGatherer prometheus.Gatherer
+	// nodeCollector holds all enabled collectors. It's shared by the
+	// unfiltered and all filtered handlers.
+	nodeCollector *collector.NodeCollector
+	// generation tells the collections of the set apart from those of the
+	// sets it replaced.
+	generation uint64
+
+	// inUse counts the scrapes using the set.
+	inUse sync.WaitGroup
+	// previous is closed once the sets replaced before this one are
+	// released, released once this one is as well.
+	previous <-chan struct{}
+	released chan struct{}
 }
 
-func newHandler(includeExporterMetrics bool, maxRequests int) *handler {
+func newHandler(includeExporterMetrics bool, maxRequests int, coalesceWindow time.Duration) *handler {
+	nc, err := collector.NewNodeCollector()
+	if err != nil {
+		log.Fatalf("Couldn't create collector: %s", err)
+	}
+	logEnabledCollectors(nc)
+
+	h, err := newHandlerFor(nc, includeExporterMetrics, maxRequests, coalesceWindow)
+	if err != nil {
+		log.Fatalf("Couldn't create metrics handler: %s", err)
+	}
+	return h
+}
+
+// newHandlerFor creates a handler serving the collectors of nc.
+func newHandlerFor(nc *collector.NodeCollector, includeExporterMetrics bool, maxRequests int, coalesceWindow time.Duration) (*handler, error) {
 	h := &handler{
 		exporterMetricsRegistry: prometheus.NewRegistry(),
 		includeExporterMetrics:  includeExporterMetrics,
 		maxRequests:             maxRequests,
 	}
+	scrapes, err := newScrapeGroup(coalesceWindow, h.exporterMetricsRegistry)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create scrape group: %s", err)
+	}
+	h.scrapes = scrapes
 	if h.includeExporterMetrics {
 		h.exporterMetricsRegistry.MustRegister(
 			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
 			prometheus.NewGoCollector(),
 		)
 	}
-	if innerHandler, err := h.innerHandler(); err != nil {
-		log.Fatalf("Couldn't create metrics handler: %s", err)
-	} else {
-		h.unfilteredHandler = innerHandler
+
+	if h.collectors, err = h.newCollectorSet(nc); err != nil {
+		return nil, err
 	}
-	return h
+	previous := make(chan struct{})
+	close(previous)
+	h.collectors.previous = previous
+	return h, nil
+}
+
+// newCollectorSet creates the handler and gatherer for the collectors of nc.
+// It must not be called concurrently.
+func (h *handler) newCollectorSet(nc *collector.NodeCollector) (*collectorSet, error) {
+	h.generations++
+	s := &collectorSet{nodeCollector: nc, generation: h.generations, released: make(chan struct{})}
+	var err error
+	if s.unfilteredGatherer, err = h.gatherer(s); err != nil {
+		return nil, err
+	}
+	if s.unfilteredHandler, err = h.innerHandler(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func logEnabledCollectors(nc *collector.NodeCollector) {
+	log.Infof("Enabled collectors:")
+	collectors := []string{}
+	for n := range nc.Collectors {
+		collectors = append(collectors, n)
+	}
+	sort.Strings(collectors)
+	for _, n := range collectors {
+		log.Infof(" - %s", n)
+	}
+}
+
+// acquire returns the current collector set. The caller has to call
+// s.inUse.Done once it no longer uses it.
+func (h *handler) acquire() *collectorSet {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	s := h.collectors
+	s.inUse.Add(1)
+	return s
 }
 
 // ServeHTTP implements http.Handler.
@@ -64,13 +157,16 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	filters := r.URL.Query()["collect[]"]
 	log.Debugln("collect query:", filters)
 
+	s := h.acquire()
+	defer s.inUse.Done()
+
 	if len(filters) == 0 {
 		// No filters, use the prepared unfiltered handler.
-		h.unfilteredHandler.ServeHTTP(w, r)
+		s.unfilteredHandler.ServeHTTP(w, r)
 		return
 	}
 	// To serve filtered metrics, we create a filtering handler on the fly.
-	filteredHandler, err := h.innerHandler(filters...)
+	filteredHandler, err := h.innerHandler(s, filters...)
 	if err != nil {
 		log.Warnln("Couldn't create filtered metrics handler:", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -80,38 +176,72 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	filteredHandler.ServeHTTP(w, r)
 }
 
-// innerHandler is used to create buth the one unfiltered http.Handler to be
-// wrapped by the outer handler and also the filtered handlers created on the
-// fly. The former is accomplished by calling innerHandler without any arguments
-// (in which case it will log all the collectors enabled via command-line
-// flags).
-func (h *handler) innerHandler(filters ...string) (http.Handler, error) {
-	nc, err := collector.NewNodeCollector(filters...)
+// Gather implements prometheus.Gatherer for all enabled collectors, so that
+// the push mode always uses the current collectors.
+func (h *handler) Gather() ([]*dto.MetricFamily, error) {
+	s := h.acquire()
+	defer s.inUse.Done()
+	return s.unfilteredGatherer.Gather()
+}
+
+// reload replaces the collectors after the flags have been changed. Only
+// the collectors affected by changedFlags are recreated, see
+// collector.ReloadNodeCollector, the replaced ones are closed. reload must not
+// be called concurrently.
+func (h *handler) reload(changedFlags map[string]bool) error {
+	nc, err := collector.ReloadNodeCollector(h.collectors.nodeCollector, changedFlags)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't create collector: %s", err)
+		return err
 	}
+	if err := h.replace(nc); err != nil {
+		return err
+	}
+	logEnabledCollectors(nc)
+	return nil
+}
 
-	// Only log the creation of an unfiltered handler, which should happen
-	// only once upon startup.
-	if len(filters) == 0 {
-		log.Infof("Enabled collectors:")
-		collectors := []string{}
-		for n := range nc.Collectors {
-			collectors = append(collectors, n)
-		}
-		sort.Strings(collectors)
-		for _, n := range collectors {
-			log.Infof(" - %s", n)
-		}
+// replace serves the collectors of nc instead of the current ones. The
+// replaced collectors are closed in the background once no scrape uses them
+// anymore, which takes until a hanging collector returns. replace must not
+// be called concurrently.
+func (h *handler) replace(nc *collector.NodeCollector) error {
+	old := h.collectors
+	s, err := h.newCollectorSet(nc)
+	if err != nil {
+		nc.CloseExcept(old.nodeCollector)
+		return err
 	}
+	s.previous = old.released
 
-	r := prometheus.NewRegistry()
-	r.MustRegister(version.NewCollector("node_exporter"))
-	if err := r.Register(nc); err != nil {
-		return nil, fmt.Errorf("couldn't register node collector: %s", err)
+	h.mtx.Lock()
+	h.collectors = s
+	// Drop the results of the replaced collectors.
+	h.scrapes.reset()
+	h.mtx.Unlock()
+
+	go func() {
+		// Collectors kept from earlier sets may only be closed once their
+		// scrapes are done as well.
+		<-old.previous
+		old.inUse.Wait()
+		old.nodeCollector.CloseExcept(nc)
+		close(old.released)
+	}()
+	return nil
+}
+
+// innerHandler is used to create buth the one unfiltered http.Handler to be
+// wrapped by the outer handler and also the filtered handlers created on the
+// fly. The former is accomplished by calling innerHandler without any
+// filters. Both only pick from the collectors of s, no new collectors are
+// instantiated.
+func (h *handler) innerHandler(s *collectorSet, filters ...string) (http.Handler, error) {
+	g, err := h.gatherer(s, filters...)
+	if err != nil {
+		return nil, err
 	}
 	handler := promhttp.HandlerFor(
-		prometheus.Gatherers{h.exporterMetricsRegistry, r},
+		g,
 		promhttp.HandlerOpts{
 			ErrorLog:            log.NewErrorLogger(),
 			ErrorHandling:       promhttp.ContinueOnError,
@@ -129,8 +259,70 @@ func (h *handler) innerHandler(filters ...string) (http.Handler, error) {
 	return handler, nil
 }
 
+// gatherer returns a prometheus.Gatherer for the collectors of s named in
+// filters (or all of them if none are given) and the exporter's own metrics.
+// Concurrent scrapes of the same collectors share one collection.
+func (h *handler) gatherer(s *collectorSet, filters ...string) (prometheus.Gatherer, error) {
+	nc, err := s.nodeCollector.Filter(filters...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create collector: %s", err)
+	}
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(version.NewCollector("node_exporter"))
+	if err := r.Register(nc); err != nil {
+		return nil, fmt.Errorf("couldn't register node collector: %s", err)
+	}
+	return prometheus.Gatherers{h.exporterMetricsRegistry, h.scrapes.gatherer(r, s.generation, filters)}, nil
+}
+
+// reloadConfig parses the command line and the configuration file again and
+// recreates the collectors affected by changed flags. The flags are parsed
+// into fresh values, which are only set once they're all valid, while no
+// collector reads them. On error, the previous flags and collectors are kept.
+// Changes of the web.* and push.* flags require a restart.
+func reloadConfig(h *handler, configFile string) error {
+	app := kingpin.CommandLine
+	values, err := parseFlagValues(app, configFile, os.Args[1:])
+	if err != nil {
+		return err
+	}
+	before := flagValues(app)
+	changed := changedFlags(before, values)
+	for name := range changed {
+		log.Infof("Flag %s changed to %s", name, values[name])
+	}
+	collector.UpdateFlags(func() { err = setFlags(app, values) })
+	if err == nil {
+		err = h.reload(changed)
+	}
+	if err != nil {
+		collector.UpdateFlags(func() { setFlags(app, before) })
+		return err
+	}
+	log.Infoln("Completed reloading configuration")
+	return nil
+}
+
+// lintTextFiles prints the problems of the text files at paths, and returns
+// the exit code, 1 if there are any.
+func lintTextFiles(paths []string) int {
+	problems := collector.LintTextFiles(paths)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
 func main() {
 	var (
+		configFile = kingpin.Flag(
+			"config.file",
+			"Configuration file (INI or YAML) setting any of the other flags. Flags given on the command line take precedence.",
+		).Default("").String()
 		listenAddress = kingpin.Flag(
 			"web.listen-address",
 			"Address on which to expose metrics and web interface.",
@@ -147,25 +339,142 @@ func main() {
 			"web.max-requests",
 			"Maximum number of parallel scrape requests. Use 0 to disable.",
 		).Default("40").Int()
+		coalesceWindow = kingpin.Flag(
+			"web.coalesce-window",
+			"Duration for which the result of a collection is reused by further scrapes of the same collectors. Concurrent scrapes always share a collection in flight.",
+		).Default("0s").Duration()
+		enableLifecycle = kingpin.Flag(
+			"web.enable-lifecycle",
+			"Enable reloading the configuration via HTTP requests to /-/reload.",
+		).Default("false").Bool()
+		pushURL = kingpin.Flag(
+			"push.url",
+			"URL to periodically push all metrics to, wrapped in a JSON envelope. Leave empty to disable pushing.",
+		).Default("").String()
+		pushInterval = kingpin.Flag(
+			"push.interval",
+			"Interval between two pushes, also sent as period in the envelope.",
+		).Default("60s").Duration()
+		pushProgram = kingpin.Flag(
+			"push.program",
+			"Program name sent in the push envelope.",
+		).Default("node_exporter").String()
+		pushTargetIP = kingpin.Flag(
+			"push.target-ip",
+			"IP address sent as target_ip in the push envelope. If empty, the first local address matching --push.ip-prefix is used.",
+		).Default("").String()
+		pushIPPrefix = kingpin.Flag(
+			"push.ip-prefix",
+			"Prefix of the local address to send as target_ip, e.g. 10.10.",
+		).Default("").String()
+		pushTimeout = kingpin.Flag(
+			"push.timeout",
+			"Timeout of a single push request.",
+		).Default("10s").Duration()
+		pushRetries = kingpin.Flag(
+			"push.retries",
+			"Number of retries with exponential backoff if a push fails.",
+		).Default("3").Int()
+	)
+
+	kingpin.Command(
+		"serve",
+		"Serve the metrics, the default.",
+	).Default()
+	var (
+		lintCmd = kingpin.Command(
+			"textfile-lint",
+			"Check text files for the textfile collector and print the problems found, e.g. before moving them into the textfile directory. The --collector.textfile.* flags apply.",
+		)
+		lintPaths = lintCmd.Arg(
+			"path",
+			"Text file, directory or glob pattern to check, all of them are checked together.",
+		).Required().Strings()
 	)
 
 	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("node_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	cmd := kingpin.Parse()
+	if *configFile != "" {
+		if err := parseFlags(kingpin.CommandLine, *configFile, os.Args[1:]); err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+	}
+	if cmd == lintCmd.FullCommand() {
+		os.Exit(lintTextFiles(*lintPaths))
+	}
 
 	log.Infoln("Starting node_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	http.Handle(*metricsPath, newHandler(!*disableExporterMetrics, *maxRequests))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
+	h := newHandler(!*disableExporterMetrics, *maxRequests, *coalesceWindow)
+	http.Handle(*metricsPath, h)
+
+	if *pushURL != "" {
+		targetIP := *pushTargetIP
+		if targetIP == "" {
+			ip, err := findTargetIP(*pushIPPrefix)
+			if err != nil {
+				log.Fatalf("Couldn't determine push target IP: %s", err)
+			}
+			targetIP = ip
+		}
+		p, err := newPusher(pushConfig{
+			url:        *pushURL,
+			targetIP:   targetIP,
+			program:    *pushProgram,
+			interval:   *pushInterval,
+			timeout:    *pushTimeout,
+			retries:    *pushRetries,
+			minBackoff: time.Second,
+		}, h, h.exporterMetricsRegistry)
+		if err != nil {
+			log.Fatalf("Couldn't create pusher: %s", err)
+		}
+		go p.run()
+	}
+
+	// Reloads are triggered by SIGHUP or, with --web.enable-lifecycle, a POST
+	// to /-/reload and are processed one at a time.
+	reloadCh := make(chan chan error)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for {
+			select {
+			case <-hup:
+				if err := reloadConfig(h, *configFile); err != nil {
+					log.Errorf("Error reloading configuration: %s", err)
+				}
+			case errCh := <-reloadCh:
+				errCh <- reloadConfig(h, *configFile)
+			}
+		}
+	}()
+	if *enableLifecycle {
+		http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				w.Write([]byte("Only POST requests allowed"))
+				return
+			}
+			errCh := make(chan error)
+			reloadCh <- errCh
+			if err := <-errCh; err != nil {
+				http.Error(w, fmt.Sprintf("Failed to reload configuration: %s", err), http.StatusInternalServerError)
+			}
+		})
+	}
+	landingPage := []byte(`<html>
 			<head><title>Node Exporter</title></head>
 			<body>
 			<h1>Node Exporter</h1>
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
 			</body>
-			</html>`))
+			</html>`)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(landingPage)
 	})
 
 	log.Infoln("Listening on", *listenAddress)
@@ -17,12 +17,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/collector"
 	"github.com/prometheus/procfs"
 )
 
@@ -108,6 +113,94 @@ func TestHandlingOfDuplicatedMetrics(t *testing.T) {
 	}
 }
 
+// blockingCollector blocks in Update until release is closed.
+type blockingCollector struct {
+	started chan struct{}
+	release chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newBlockingCollector() *blockingCollector {
+	return &blockingCollector{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *blockingCollector) Update(ch chan<- prometheus.Metric) error {
+	c.once.Do(func() { close(c.started) })
+	<-c.release
+	return nil
+}
+
+func (c *blockingCollector) Close() error {
+	close(c.closed)
+	return nil
+}
+
+type valueCollector struct{}
+
+func (valueCollector) Update(ch chan<- prometheus.Metric) error {
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("node_test_value", "Test value.", nil, nil),
+		prometheus.GaugeValue, 1,
+	)
+	return nil
+}
+
+func TestHandlerReplaceWithHangingScrape(t *testing.T) {
+	blocking := newBlockingCollector()
+	h, err := newHandlerFor(&collector.NodeCollector{Collectors: map[string]collector.Collector{
+		"blocking": blocking,
+	}}, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scraped := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		close(scraped)
+	}()
+	<-blocking.started
+
+	replaced := make(chan error)
+	go func() {
+		replaced <- h.replace(&collector.NodeCollector{Collectors: map[string]collector.Collector{
+			"value": valueCollector{},
+		}})
+	}()
+	select {
+	case err := <-replaced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replacing the collectors waited for the hanging scrape")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "node_test_value 1") {
+		t.Errorf("scrape didn't use the new collectors:\n%s", rec.Body)
+	}
+
+	select {
+	case <-blocking.closed:
+		t.Fatal("replaced collector closed while a scrape still uses it")
+	default:
+	}
+	close(blocking.release)
+	<-scraped
+	select {
+	case <-blocking.closed:
+	case <-time.After(time.Second):
+		t.Fatal("replaced collector not closed after its scrape finished")
+	}
+}
+
 func queryExporter(address string) error {
 	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", address))
 	if err != nil {
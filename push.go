@@ -0,0 +1,202 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// pushEnvelope is the JSON document expected by the ops-center receive API.
+type pushEnvelope struct {
+	TargetIP   string `json:"target_ip"`
+	Program    string `json:"program"`
+	MetricsStr string `json:"metrics_str"`
+	Period     int    `json:"period"`
+}
+
+// pushConfig holds the settings of the push mode.
+type pushConfig struct {
+	url        string
+	targetIP   string
+	program    string
+	interval   time.Duration
+	timeout    time.Duration
+	retries    int
+	minBackoff time.Duration
+}
+
+// pusher periodically gathers all metrics and sends them, wrapped in a
+// pushEnvelope, to a remote endpoint. Create instances with newPusher.
+type pusher struct {
+	config   pushConfig
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	successTotal       prometheus.Counter
+	failuresTotal      prometheus.Counter
+	lastSuccessSeconds prometheus.Gauge
+}
+
+// newPusher creates a pusher which gathers from g and registers its own metrics
+// with r.
+func newPusher(config pushConfig, g prometheus.Gatherer, r prometheus.Registerer) (*pusher, error) {
+	p := &pusher{
+		config:   config,
+		gatherer: g,
+		client:   &http.Client{Timeout: config.timeout},
+		successTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "node_exporter",
+			Subsystem: "push",
+			Name:      "success_total",
+			Help:      "Number of metric batches successfully pushed to the remote endpoint.",
+		}),
+		failuresTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "node_exporter",
+			Subsystem: "push",
+			Name:      "failures_total",
+			Help:      "Number of metric batches which could not be pushed to the remote endpoint after all retries.",
+		}),
+		lastSuccessSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "node_exporter",
+			Subsystem: "push",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful push.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{p.successTotal, p.failuresTotal, p.lastSuccessSeconds} {
+		if err := r.Register(c); err != nil {
+			return nil, fmt.Errorf("couldn't register push metrics: %s", err)
+		}
+	}
+	return p, nil
+}
+
+// run pushes the metrics once per interval until the process exits.
+func (p *pusher) run() {
+	log.Infof("Pushing metrics to %s every %s", p.config.url, p.config.interval)
+	ticker := time.NewTicker(p.config.interval)
+	defer ticker.Stop()
+	for {
+		p.pushWithRetries()
+		<-ticker.C
+	}
+}
+
+// pushWithRetries pushes the current metrics and retries with an exponential
+// backoff if that fails. The backoff never exceeds the push interval.
+func (p *pusher) pushWithRetries() {
+	backoff := p.config.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.push()
+		if err == nil {
+			p.successTotal.Inc()
+			p.lastSuccessSeconds.SetToCurrentTime()
+			log.Debugf("Pushed metrics to %s", p.config.url)
+			return
+		}
+		if attempt >= p.config.retries {
+			p.failuresTotal.Inc()
+			log.Errorf("Couldn't push metrics to %s after %d attempts: %s", p.config.url, attempt+1, err)
+			return
+		}
+		log.Warnf("Couldn't push metrics to %s, retrying in %s: %s", p.config.url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > p.config.interval {
+			backoff = p.config.interval
+		}
+	}
+}
+
+// push gathers all metrics and sends them to the remote endpoint once.
+func (p *pusher) push() error {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, p.gatherer); err != nil {
+		return err
+	}
+	body, err := json.Marshal(pushEnvelope{
+		TargetIP:   p.config.targetIP,
+		Program:    p.config.program,
+		MetricsStr: buf.String(),
+		Period:     int(p.config.interval / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.config.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "*/*")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body to allow reusing the connection.
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeMetrics writes all metrics of g in the text exposition format to w. Like
+// the HTTP handler, it continues on gathering errors and only logs them.
+func writeMetrics(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		log.Warnln("Error gathering metrics for push:", err)
+	}
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findTargetIP returns the first non-loopback address of this host which
+// starts with prefix.
+func findTargetIP(prefix string) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip := ipNet.IP.String(); strings.HasPrefix(ip, prefix) {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no address with prefix %q found", prefix)
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushEnvelope(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+		got      pushEnvelope
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		// Fail the first request to exercise the retry.
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("want content type application/json, got %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	metrics := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test gauge."})
+	g.Set(42)
+	metrics.MustRegister(g)
+
+	self := prometheus.NewRegistry()
+	p, err := newPusher(pushConfig{
+		url:        server.URL,
+		targetIP:   "10.10.0.1",
+		program:    "node_exporter",
+		interval:   time.Minute,
+		timeout:    time.Second,
+		retries:    1,
+		minBackoff: time.Millisecond,
+	}, metrics, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pushWithRetries()
+
+	if requests != 2 {
+		t.Fatalf("want 2 requests, got %d", requests)
+	}
+	if got.TargetIP != "10.10.0.1" || got.Program != "node_exporter" || got.Period != 60 {
+		t.Errorf("unexpected envelope: %+v", got)
+	}
+	if !strings.Contains(got.MetricsStr, "test_gauge 42\n") {
+		t.Errorf("metrics_str doesn't contain test_gauge:\n%s", got.MetricsStr)
+	}
+
+	mfs, err := self.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		m := mf.Metric[0]
+		values[mf.GetName()] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+	}
+	if values["node_exporter_push_success_total"] != 1 {
+		t.Errorf("want 1 successful push, got %v", values["node_exporter_push_success_total"])
+	}
+	if values["node_exporter_push_failures_total"] != 0 {
+		t.Errorf("want 0 failed pushes, got %v", values["node_exporter_push_failures_total"])
+	}
+	if values["node_exporter_push_last_success_timestamp_seconds"] == 0 {
+		t.Error("last success timestamp not set")
+	}
+}
@@ -10,9 +10,7 @@ Source1:    node_exporter.service
 Source2:    node_exporter.logrotate
 Source3:    license
 Source4:    notice
-source5:    prometheus_pusher.py
-source6:    prometheus_pusher.service
-source7:    config.ini
+source5:    config.ini
 
 %description
 rpm install node_exporter,
@@ -32,16 +30,12 @@ mkdir -p %{buildroot}/usr/share/doc/prometheus/
 chmod u+x %{SOURCE0}
 chmod u+x %{SOURCE1}
 chmod u+x %{SOURCE2}
-chmod u+x %{SOURCE5}
-chmod u+x %{SOURCE6}
 cp -Rf %{SOURCE0} %{buildroot}/usr/bin/
 cp -Rf %{SOURCE1} %{buildroot}/etc/init.d/node_exporter
 cp -Rf %{SOURCE2} %{buildroot}/etc/logrotate.d/node_exporter
 cp -Rf %{SOURCE3} %{buildroot}/usr/share/doc/prometheus/license
 cp -Rf %{SOURCE4} %{buildroot}/usr/share/doc/prometheus/notice
-cp -Rf %{SOURCE5} %{buildroot}/usr/bin/
-cp -Rf %{SOURCE6} %{buildroot}/etc/init.d/prometheus_pusher
-cp -Rf %{SOURCE7} %{buildroot}/etc/prometheus
+cp -Rf %{SOURCE5} %{buildroot}/etc/prometheus
 
 
 %files
@@ -50,8 +44,6 @@ cp -Rf %{SOURCE7} %{buildroot}/etc/prometheus
 /etc/logrotate.d/node_exporter
 /usr/share/doc/prometheus/license
 /usr/share/doc/prometheus/notice
-/usr/bin/prometheus_pusher.py
-/etc/init.d/prometheus_pusher
 /etc/prometheus/config.ini
 
 %clean